@@ -38,18 +38,24 @@ func searchOptionsFromParams(r *http.Request) report.QueryOptions {
 		timezone = "-0800" // Default to PST
 	}
 	opt := report.QueryOptions{
-		StartDate:     r.FormValue("startDate"),
-		EndDate:       r.FormValue("endDate"),
-		Timezone:      timezone,
-		Participants:  r.FormValue("participants"),
-		BodyOrSubject: r.FormValue("bodyOrSubject"),
-		Label:         r.FormValue("label"),
-		Starred:       r.FormValue("starred") == "true",
-		InboxUrl:      inboxUrl,
-		Size:          size,
-		SortField:     sortField,
-		SortAscending: r.FormValue("ascending") == "true",
-		Query:         r.FormValue("query"),
+		StartDate:      r.FormValue("startDate"),
+		EndDate:        r.FormValue("endDate"),
+		Timezone:       timezone,
+		Participants:   r.FormValue("participants"),
+		BodyOrSubject:  r.FormValue("bodyOrSubject"),
+		Label:          r.FormValue("label"),
+		Starred:        r.FormValue("starred") == "true",
+		InboxUrl:       inboxUrl,
+		Size:           size,
+		SortField:      sortField,
+		SortAscending:  r.FormValue("ascending") == "true",
+		Query:          r.FormValue("query"),
+		IncludeDeleted: r.FormValue("includeDeleted") == "true",
+		Account:        r.FormValue("account"),
+		Headers:        r.Form["header"],
+		Conversation:   r.FormValue("conversation"),
+		NewContentOnly: r.FormValue("newContentOnly") == "true",
+		Attachment:     r.FormValue("attachment"),
 	}
 	return opt
 }
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/store"
+	"net/http"
+)
+
+type SyncReport struct {
+	Accounts []store.SyncStatus
+}
+
+// SyncStatusHandler returns the last run and next run of the background sync of each account.
+func SyncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	statuses, err := misc.GetStoreClient().GetSyncStatuses()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	statusJson, _ := json.MarshalIndent(SyncReport{Accounts: statuses}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+
+	fmt.Fprint(w, string(statusJson))
+}
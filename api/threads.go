@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/store"
+	"net/http"
+	"strconv"
+)
+
+type ThreadsReport struct {
+	Threads []*store.Thread
+}
+
+func ThreadsHandler(w http.ResponseWriter, r *http.Request) {
+	svc := misc.GetStoreClient()
+	size, err := strconv.Atoi(r.FormValue("size"))
+	if err != nil {
+		size = 100
+	}
+	account := r.FormValue("account")
+	var labelId string
+	if label := r.FormValue("label"); label != "" {
+		if labelId, err = svc.FindLabelId(account, label); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	threads, err := svc.GetThreads(account, labelId, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	threadsJson, _ := json.MarshalIndent(ThreadsReport{Threads: threads}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+
+	fmt.Fprint(w, string(threadsJson))
+}
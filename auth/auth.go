@@ -33,12 +33,17 @@ import (
 	"google.golang.org/api/gmail/v1"
 )
 
+// Default files for the OAuth client secret and the token, in the working directory
+const (
+	DefaultClientSecretFile = "client_secret.json"
+	DefaultTokenFile        = "oauth_token.json"
+)
+
 // Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config, ctx context.Context) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
+func getClient(config *oauth2.Config, ctx context.Context, tokFile string) *http.Client {
+	// The token file stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
-	tokFile := "oauth_token.json"
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
 		tok = getTokenFromWeb(config)
@@ -100,13 +105,19 @@ func saveToken(path string, token *oauth2.Token) {
 }
 
 func Client(ctx context.Context) (c *http.Client, err error) {
+	return ClientFor(ctx, DefaultClientSecretFile, DefaultTokenFile)
+}
+
+// ClientFor returns a client authorized with the token in tokenFile, asking for permission (and
+// saving the token there) if there isn't one yet. Each account has its own token file.
+func ClientFor(ctx context.Context, clientSecretFile, tokenFile string) (c *http.Client, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
 
-	b, err := ioutil.ReadFile("client_secret.json")
+	b, err := ioutil.ReadFile(clientSecretFile)
 	if err != nil {
 		bail("Unable to read client secret file: %v", err)
 	}
@@ -116,6 +127,6 @@ func Client(ctx context.Context) (c *http.Client, err error) {
 	if err != nil {
 		bail("Unable to parse client secret file to config: %v", err)
 	}
-	client := getClient(config, ctx)
+	client := getClient(config, ctx, tokenFile)
 	return client, nil
 }
@@ -0,0 +1,76 @@
+// Package blob saves binary content (e.g. attachments) in a local directory, addressed by the
+// SHA-256 of the content so that the same file attached to many messages is only stored once.
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type Store struct {
+	Dir string
+}
+
+// New returns a Store that saves files under dir, creating it if needed.
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir}, nil
+}
+
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put saves data and returns its hash.
+func (s *Store) Put(data []byte) (string, error) {
+	hash := Hash(data)
+	path := s.Path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// Write to a temporary file first so a partially written file is never mistaken for a saved one.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), hash+".tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+// Path returns where the content with the hash is (or would be) saved. Files are spread over
+// subdirectories named after the first two characters of the hash.
+func (s *Store) Path(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(s.Dir, hash)
+	}
+	return filepath.Join(s.Dir, hash[:2], hash)
+}
+
+func (s *Store) Open(hash string) (*os.File, error) {
+	if _, err := hex.DecodeString(hash); err != nil || hash == "" {
+		return nil, errors.New("invalid blob hash")
+	}
+	return os.Open(s.Path(hash))
+}
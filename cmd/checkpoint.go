@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"github.com/oaktown/calliope/store"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of finished messages between checkpoint saves
+const checkpointInterval = 100
+
+// checkpointer keeps track of which list pages have been completely dealt with so that an
+// interrupted download can be resumed from the first page that still has unfinished messages,
+// downloading only the messages on that page that weren't saved, and the messages on earlier
+// pages that couldn't be saved.
+// All methods are safe to call on a nil checkpointer.
+type checkpointer struct {
+	mu         sync.Mutex
+	checkpoint store.Checkpoint
+	pages      []*pendingPage
+	pageOf     map[string]*pendingPage
+	failed     map[string]bool
+	sinceSave  int
+	// Save and delete the checkpoint; the store's methods, except in tests
+	saveCheckpoint   func(store.Checkpoint) error
+	deleteCheckpoint func(id string) error
+}
+
+type pendingPage struct {
+	token  string
+	listed int64
+	// Ids that haven't finished yet, and those that finished without being saved
+	pending map[string]bool
+	unsaved []string
+}
+
+func newCheckpointer(s *store.Service, checkpoint store.Checkpoint) *checkpointer {
+	c := &checkpointer{
+		checkpoint:       checkpoint,
+		pageOf:           make(map[string]*pendingPage),
+		failed:           make(map[string]bool),
+		saveCheckpoint:   s.SaveCheckpoint,
+		deleteCheckpoint: s.DeleteCheckpoint,
+	}
+	for _, id := range checkpoint.FailedIds {
+		c.failed[id] = true
+	}
+	return c
+}
+
+// retryIds returns the messages on pages before the one a resumed download starts from that
+// couldn't be saved.
+func (c *checkpointer) retryIds() []string {
+	if c == nil {
+		return nil
+	}
+	return append([]string(nil), c.checkpoint.FailedIds...)
+}
+
+// pendingIds returns the ids on the page a resumed download starts from that still have to be
+// downloaded, or nil if the whole page does.
+func (c *checkpointer) pendingIds() map[string]bool {
+	if c == nil || c.checkpoint.PendingIds == nil {
+		return nil
+	}
+	pending := make(map[string]bool, len(c.checkpoint.PendingIds))
+	for _, id := range c.checkpoint.PendingIds {
+		pending[id] = true
+	}
+	return pending
+}
+
+func (c *checkpointer) listed(pageToken string, listed int64, ids []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page := &pendingPage{token: pageToken, listed: listed, pending: make(map[string]bool)}
+	for _, id := range ids {
+		page.pending[id] = true
+		c.pageOf[id] = page
+	}
+	c.pages = append(c.pages, page)
+	c.advance()
+}
+
+// skipped records that a message was skipped by a rule, which would skip it again on resume, so
+// it's as good as saved.
+func (c *checkpointer) skipped(id string) {
+	c.finished(id, true)
+}
+
+// finished records that a message has been dealt with; messages that weren't saved are
+// downloaded again on resume.
+func (c *checkpointer) finished(id string, saved bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if page := c.pageOf[id]; page != nil {
+		delete(page.pending, id)
+		if !saved {
+			page.unsaved = append(page.unsaved, id)
+		}
+		delete(c.pageOf, id)
+	} else if saved {
+		// A message that couldn't be saved before, retried
+		delete(c.failed, id)
+	}
+	c.advance()
+	c.sinceSave++
+	if c.sinceSave >= checkpointInterval {
+		c.save()
+	}
+}
+
+// advance drops completed pages from the front, keeping the messages on them that couldn't be
+// saved to retry. The most recent page is always kept since the token for the page after it isn't
+// known until it is listed.
+func (c *checkpointer) advance() {
+	for len(c.pages) > 1 && len(c.pages[0].pending) == 0 {
+		for _, id := range c.pages[0].unsaved {
+			c.failed[id] = true
+		}
+		c.pages = c.pages[1:]
+	}
+	if len(c.pages) > 0 {
+		c.checkpoint.PageToken = c.pages[0].token
+		c.checkpoint.Listed = c.pages[0].listed
+	}
+}
+
+func (c *checkpointer) save() {
+	c.sinceSave = 0
+	c.checkpoint.UpdatedAt = time.Now()
+	if len(c.pages) > 0 {
+		page := c.pages[0]
+		pendingIds := append([]string{}, page.unsaved...)
+		for id := range page.pending {
+			pendingIds = append(pendingIds, id)
+		}
+		sort.Strings(pendingIds)
+		c.checkpoint.PendingIds = pendingIds
+	}
+	failedIds := make([]string, 0, len(c.failed))
+	for id := range c.failed {
+		failedIds = append(failedIds, id)
+	}
+	sort.Strings(failedIds)
+	c.checkpoint.FailedIds = failedIds
+	if err := c.saveCheckpoint(c.checkpoint); err != nil {
+		log.Println("Error saving download checkpoint: ", err)
+	}
+}
+
+// flush saves the checkpoint regardless of how many messages have finished since the last save.
+func (c *checkpointer) flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.save()
+}
+
+// done removes the checkpoint after a successful run.
+func (c *checkpointer) done() {
+	if c == nil {
+		return
+	}
+	if err := c.deleteCheckpoint(c.checkpoint.Id); err != nil {
+		log.Println("Error deleting download checkpoint: ", err)
+	}
+}
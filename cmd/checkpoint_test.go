@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"github.com/oaktown/calliope/store"
+	"reflect"
+	"testing"
+)
+
+// testCheckpointer returns a checkpointer that records what it saves instead of using a store.
+func testCheckpointer(checkpoint store.Checkpoint, saves *[]store.Checkpoint, deleted *string) *checkpointer {
+	c := newCheckpointer(&store.Service{}, checkpoint)
+	c.saveCheckpoint = func(checkpoint store.Checkpoint) error {
+		*saves = append(*saves, checkpoint)
+		return nil
+	}
+	c.deleteCheckpoint = func(id string) error {
+		*deleted = id
+		return nil
+	}
+	return c
+}
+
+func TestCheckpointer_save(t *testing.T) {
+	tests := []struct {
+		name        string
+		finished    map[string]bool // id: saved
+		wantToken   string
+		wantListed  int64
+		wantPending []string
+		wantFailed  []string
+	}{
+		{"Nothing finished", nil, "", 0, []string{"1", "2", "3"}, []string{}},
+		{"Part of the first page", map[string]bool{"1": true, "3": true}, "", 0, []string{"2"}, []string{}},
+		{"First page saved", map[string]bool{"1": true, "2": true, "3": true, "5": true}, "p2", 3, []string{"4"}, []string{}},
+		{"Failed on an earlier page and the page it stopped on", map[string]bool{"1": true, "2": false, "3": true, "4": false},
+			"p2", 3, []string{"4", "5"}, []string{"2"}},
+		{"Everything saved", map[string]bool{"1": true, "2": true, "3": true, "4": true, "5": true, "6": true}, "p3", 5, []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saves []store.Checkpoint
+			var deleted string
+			c := testCheckpointer(store.Checkpoint{Id: "download"}, &saves, &deleted)
+			c.listed("", 0, []string{"1", "2", "3"})
+			c.listed("p2", 3, []string{"4", "5"})
+			c.listed("p3", 5, []string{"6"})
+			for id, saved := range tt.finished {
+				c.finished(id, saved)
+			}
+			c.flush()
+
+			if len(saves) != 1 {
+				t.Fatalf("saved %v checkpoints, want 1", len(saves))
+			}
+			got := saves[0]
+			if got.PageToken != tt.wantToken || got.Listed != tt.wantListed || !reflect.DeepEqual(got.PendingIds, tt.wantPending) {
+				t.Errorf("checkpoint = %q, %v, %v; want %q, %v, %v", got.PageToken, got.Listed, got.PendingIds,
+					tt.wantToken, tt.wantListed, tt.wantPending)
+			}
+			if !reflect.DeepEqual(got.FailedIds, tt.wantFailed) {
+				t.Errorf("FailedIds = %v, want %v", got.FailedIds, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestCheckpointer_resume(t *testing.T) {
+	tests := []struct {
+		name       string
+		pendingIds []string
+		want       map[string]bool
+	}{
+		{"Checkpoint without pending ids", nil, nil},
+		{"Nothing pending", []string{}, map[string]bool{}},
+		{"Pending", []string{"2", "4"}, map[string]bool{"2": true, "4": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saves []store.Checkpoint
+			var deleted string
+			c := testCheckpointer(store.Checkpoint{Id: "download", PageToken: "p2", Listed: 3, PendingIds: tt.pendingIds}, &saves, &deleted)
+			if got := c.pendingIds(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pendingIds() = %v, want %v", got, tt.want)
+			}
+			// Stopped again before the page was listed
+			c.flush()
+			if got := saves[0]; got.PageToken != "p2" || got.Listed != 3 || !reflect.DeepEqual(got.PendingIds, tt.pendingIds) {
+				t.Errorf("checkpoint = %q, %v, %v; want the one resumed from", got.PageToken, got.Listed, got.PendingIds)
+			}
+		})
+	}
+}
+
+func TestCheckpointer_retry(t *testing.T) {
+	var saves []store.Checkpoint
+	var deleted string
+	c := testCheckpointer(store.Checkpoint{Id: "download", PageToken: "p2", Listed: 3, FailedIds: []string{"1", "2"}}, &saves, &deleted)
+	if got := c.retryIds(); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Errorf("retryIds() = %v, want the failed ids", got)
+	}
+	c.finished("1", true)
+	c.finished("2", false)
+	c.listed("p2", 3, []string{"4"})
+	c.skipped("4")
+	c.flush()
+	if got := saves[0]; !reflect.DeepEqual(got.FailedIds, []string{"2"}) || !reflect.DeepEqual(got.PendingIds, []string{}) {
+		t.Errorf("FailedIds = %v, PendingIds = %v; want [2] still to retry and nothing pending", got.FailedIds, got.PendingIds)
+	}
+}
+
+func TestCheckpointer_saveInterval(t *testing.T) {
+	var saves []store.Checkpoint
+	var deleted string
+	c := testCheckpointer(store.Checkpoint{Id: "download"}, &saves, &deleted)
+	ids := make([]string, checkpointInterval+1)
+	for i := range ids {
+		ids[i] = string(rune('a' + i%26))
+	}
+	c.listed("", 0, ids)
+	for _, id := range ids {
+		c.finished(id, true)
+	}
+	if len(saves) != 1 {
+		t.Errorf("saved %v checkpoints after %v messages, want 1", len(saves), len(ids))
+	}
+}
+
+func TestCheckpointer_done(t *testing.T) {
+	var saves []store.Checkpoint
+	var deleted string
+	c := testCheckpointer(store.Checkpoint{Id: "download-work"}, &saves, &deleted)
+	c.listed("", 0, []string{"1"})
+	c.finished("1", true)
+	c.done()
+	if deleted != "download-work" || len(saves) != 0 {
+		t.Errorf("deleted %q and saved %v, want the checkpoint deleted and nothing saved", deleted, saves)
+	}
+
+	var none *checkpointer
+	none.listed("", 0, []string{"1"})
+	none.finished("1", true)
+	none.flush()
+	none.done()
+	if none.pendingIds() != nil {
+		t.Error("pendingIds() of nil checkpointer, want nil")
+	}
+}
@@ -1,94 +1,255 @@
 package cmd
 
 import (
+	"context"
+	goerrors "errors"
 	"fmt"
 	"github.com/oaktown/calliope/gmailservice"
 	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/progress"
+	"github.com/oaktown/calliope/rules"
+	"github.com/oaktown/calliope/source"
 	"github.com/oaktown/calliope/store"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"io"
 	"log"
+	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-var limit, query, inboxUrl string
+var limit, query, inboxUrl, attachmentsDir, accountName string
+var incremental, resume, threads, raw, labelsOnly, dryRun bool
+var maxAttempts, batchSize int
+
+const defaultInboxUrl = "https://mail.google.com/mail/"
+
+var progressFormat string
+var shutdownTimeout time.Duration
+
+// Where the human readable summary goes; stdout unless that's being used for progress events
+var summaryOut io.Writer = os.Stdout
 
 func init() {
 	rootCmd.AddCommand(downloadCmd)
-	downloadCmd.Flags().StringVarP(&limit, "limit", "l", "10", "limit number of emails to download (if > 500, rounds up to next multiple of 500).")
+	downloadCmd.Flags().StringVarP(&limit, "limit", "l", "10", "limit number of emails to download (if > 500, rounds up to next multiple of 500); 0 downloads everything.")
 	downloadCmd.Flags().StringVarP(&query, "query", "q", "", "download based on Gmail query. E.g. \"after: 2018/11/01 label:my-label is:starred\" More info: See https://support.google.com/mail/answer/7190.")
-	downloadCmd.Flags().StringVarP(&inboxUrl, "inbox-url", "u", "https://mail.google.com/mail/", "Url for gmail (useful if you are logged into multiple accounts).")
+	downloadCmd.Flags().StringVarP(&accountName, "account", "a", "", "name of the account (from accounts in the config) to download. Can be left out if there is only one.")
+	downloadCmd.Flags().StringVarP(&inboxUrl, "inbox-url", "u", defaultInboxUrl, "Url for gmail (useful if you are logged into multiple accounts).")
+	downloadCmd.Flags().StringVar(&attachmentsDir, "attachments-dir", "", "save attachments in this directory (default is attachments_dir from the config; if neither is set, attachments are not downloaded).")
+	downloadCmd.Flags().BoolVarP(&threads, "threads", "t", false, "download the whole conversation of every message found.")
+	downloadCmd.Flags().BoolVar(&raw, "raw", false, "also download and archive the original source (.eml) of every message.")
+	downloadCmd.Flags().IntVar(&maxAttempts, "max-attempts", gmailservice.DefaultMaxAttempts, "number of times to try each Gmail API call before giving up on it.")
+	downloadCmd.Flags().IntVar(&batchSize, "batch-size", 0, "fetch messages in batches of up to this many (at most 100) instead of one request per message. Gmail recommends no more than 50.")
+	downloadCmd.Flags().BoolVarP(&resume, "resume", "r", false, "resume the last download that did not finish, using its query and options and skipping messages that were already saved.")
+	downloadCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "when interrupted, how long to wait for messages that are already being downloaded to be saved.")
+	downloadCmd.Flags().StringVar(&progressFormat, "progress", progress.Auto, "how to show progress: auto (a progress bar if on a terminal), bar, json (one event per line on stdout) or none.")
+	downloadCmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "only list messages and fetch their headers, and report how many would be saved and what the rules would skip. Nothing is saved.")
+	downloadCmd.Flags().BoolVar(&labelsOnly, "labels-only", false, "only refresh the labels (and starred and unread state) of messages that have already been downloaded (query and limit are ignored).")
+	downloadCmd.Flags().BoolVarP(&incremental, "sync", "s", false, "only download changes since the last download (query and limit are ignored). Falls back to a full download if there is no checkpoint or it has expired.")
 }
 
 var downloadCmd = &cobra.Command{
 	Use:   "download",
 	Short: "downloads emails",
-	Long:  `Downloads emails from Gmail into Elasticsearch. Reports can then be run on the emails that have been downloaded.`,
+	Long: `Downloads emails from Gmail, or from the source in the config for accounts of another type (e.g. imap), into
+Elasticsearch. Reports can then be run on the emails that have been downloaded.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		download()
+		download(cmd)
 	},
 }
 
-func reader(s *store.Service, messageChannel <-chan *store.Message, maxWorkers int) {
+// reader saves messages from messageChannel (which src is sending) until it's closed, and tells src
+// as each one is finished with. If ctx is cancelled first it stops reading, and saves that are
+// under way are abandoned.
+func reader(ctx context.Context, s *store.Service, messageChannel <-chan *store.Message, maxWorkers int, src source.Source, prog *progress.Reporter) (int64, int64) {
 	workers := make(chan bool, maxWorkers)
 	duplicates := make(chan *store.MessageResponse, 100000)
 	var savedMessages, errors int64
-	for message := range messageChannel { // reads from channel until it's closed
+reading:
+	for {
+		var message *store.Message
+		select {
+		case m, ok := <-messageChannel:
+			if !ok {
+				break reading
+			}
+			message = m
+		case <-ctx.Done():
+			log.Println("Stopped waiting for messages that are still being downloaded.")
+			break reading
+		}
 		workers <- true
 		go func() {
 			defer func() { <-workers }()
+			if message.FetchError != "" {
+				// Not saved, so it isn't checkpointed and --resume or the next sync tries it again
+				if err := s.SaveFetchFailure(ctx, *message); err != nil {
+					log.Printf("Error saving failure of id %s: %s\n", message.Id, err)
+				}
+				src.Finished(message.Id, false)
+				log.Printf("Error downloading id %s: %s\n", message.Id, message.FetchError)
+				atomic.AddInt64(&errors, 1)
+				prog.Failed(message.Id, goerrors.New(message.FetchError))
+				return
+			}
 			// TODO: Determine if ids are ever duplicates. Although it's weird …the number of messages total was different on two different runs of 100k. One was 94224, the other was 94092
 			// TODO: add another channel for verify
-			err := s.SaveMessage(*message, duplicates)
+			err := s.SaveMessage(ctx, *message, duplicates)
+			src.Finished(message.Id, err == nil)
 			if err != nil {
 				log.Printf("Error saving id %s: %s\n", message.Id, err)
-				errors++
+				atomic.AddInt64(&errors, 1)
+				prog.Failed(message.Id, err)
 			} else {
 				log.Printf("Saved id %s: %s\n", message.Id, message.Subject)
-				savedMessages++
+				atomic.AddInt64(&savedMessages, 1)
+				prog.Saved(message.Id)
 			}
 		}()
 	}
 	for i := 0; i < maxWorkers; i++ {
 		workers <- true
 	}
-	fmt.Println("Total messages:", savedMessages+errors)
-	fmt.Println("Total saved messages: ", savedMessages)
-	fmt.Println("Total errors: ", errors)
-	fmt.Println("Total duplicates: ", len(duplicates))
-	fmt.Println("Net messages: ", savedMessages-int64(len(duplicates)))
+	prog.Finish()
+	fmt.Fprintln(summaryOut, "Total messages:", savedMessages+errors)
+	fmt.Fprintln(summaryOut, "Total saved messages: ", savedMessages)
+	fmt.Fprintln(summaryOut, "Total errors: ", errors)
+	fmt.Fprintln(summaryOut, "Total duplicates: ", len(duplicates))
+	fmt.Fprintln(summaryOut, "Net messages: ", savedMessages-int64(len(duplicates)))
+	return savedMessages, errors
 }
 
-func download() {
+func download(cmd *cobra.Command) {
+	prog, err := progress.New(progressFormat)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logTo(prog.LogWriter(os.Stderr))
+	if prog.Format() == progress.JSON {
+		// Keep stdout for the progress events
+		summaryOut = os.Stderr
+	}
+	stop, abort := interruptible(shutdownTimeout)
 	startedAt := time.Now()
-	fmt.Println("Started at:", startedAt)
-	excludeHeaders := viper.GetStringMapStringSlice("exclude_headers_with_values")
-	for k, v := range excludeHeaders {
-		fmt.Printf("key: %s\n", k)
-		for _, s := range v {
-			fmt.Printf("  %s\n", s)
-		}
+	fmt.Fprintln(summaryOut, "Started at:", startedAt)
+	configuredRules, err := misc.Rules()
+	if err != nil {
+		log.Fatalln("Unable to read rules from config: ", err)
 	}
 	max, _ := strconv.ParseInt(limit, 10, 64)
+	account := misc.GetAccount(accountName)
+	fmt.Fprintln(summaryOut, "Account:", account.Name)
+	options := sourceOptions{
+		incremental: incremental,
+		raw:         raw,
+		resume:      resume,
+		dryRun:      dryRun,
+		query:       query,
+		limit:       max,
+		rules:       compileRules(configuredRules),
+		threads:     threads,
+		maxAttempts: maxAttempts,
+		batchSize:   batchSize,
+	}
+	if cmd.Flags().Changed("inbox-url") {
+		options.inboxUrl = inboxUrl
+	}
+	if attachmentsDir == "" {
+		attachmentsDir = misc.AttachmentsDir()
+	}
+	if attachmentsDir != "" && !dryRun {
+		options.blobs = misc.GetBlobStore(attachmentsDir)
+	}
+	var s *store.Service
+	if !dryRun {
+		s = misc.GetStoreClient()
+	}
+	src, err := newSource(s, account, options, prog)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	switch {
+	case dryRun:
+		downloadDryRun(stop, src, prog)
+	case labelsOnly:
+		refresher, ok := src.(labelRefresher)
+		if !ok {
+			log.Fatalln("--labels-only only works with Gmail accounts")
+		}
+		refresher.refreshLabels(stop)
+	default:
+		result := runSource(stop, abort, s, account.Name, src, prog)
+		switch {
+		case result.interrupted:
+			fmt.Fprintln(summaryOut, "Download interrupted. Run it again with --sync (or --resume, for a Gmail account) to pick up where it left off.")
+		case result.errors > 0:
+			fmt.Fprintln(summaryOut, "Some messages could not be saved. Run it again with --sync (or --resume, for a Gmail account) to retry them.")
+		}
+		finishedAt := time.Now()
+		fmt.Fprintln(summaryOut, "Started at:", startedAt)
+		fmt.Fprintln(summaryOut, "Time ended", finishedAt)
+		fmt.Fprintf(summaryOut, "Elapsed time: %f seconds\n", finishedAt.Sub(startedAt).Seconds())
+		if result.interrupted {
+			os.Exit(130)
+		}
+		return
+	}
+	fmt.Fprintf(summaryOut, "Elapsed time: %f seconds\n", time.Now().Sub(startedAt).Seconds())
+}
+
+// labelRefresher is a source that can refresh the labels of the messages that have already been
+// saved without downloading them again (see --labels-only).
+type labelRefresher interface {
+	refreshLabels(ctx context.Context)
+}
+
+// downloadResult is how a download went.
+type downloadResult struct {
+	saved, errors int64
+	interrupted   bool
+}
 
-	gsvc := misc.GetGmailClient()
-	s := misc.GetStoreClient()
-	options := gmailservice.Options{
-		Query:          query,
-		Limit:          max,
-		InboxUrl:       inboxUrl,
-		ExcludeHeaders: excludeHeaders,
-	}
-	d := gmailservice.New(gsvc, options, 200)
-	labels := gmailservice.Download(d)
-	if err := s.SaveLabels(labels); err != nil {
-		log.Println("Error saving labels")
+func compileRules(configured []rules.Rule) *rules.RuleSet {
+	ruleSet, err := rules.Compile(configured)
+	if err != nil {
+		log.Fatalln("Invalid rule in config: ", err)
 	}
+	for _, rule := range configured {
+		fmt.Fprintf(summaryOut, "Rule: %v (%v)\n", rule.Name, rule.Action)
+	}
+	return ruleSet
+}
 
-	reader(s, d.MessageChan, 10)
-	finishedAt := time.Now()
-	fmt.Println("Started at:", startedAt)
-	fmt.Println("Time ended", finishedAt)
-	fmt.Printf("Elapsed time: %f seconds\n", finishedAt.Sub(startedAt).Seconds())
+// downloadDryRun downloads from src, which was set up for a dry run, without saving anything, and
+// reports how many messages would be saved. Cancelling ctx stops listing and reports on the
+// messages fetched so far.
+func downloadDryRun(ctx context.Context, src source.Source, prog *progress.Reporter) {
+	fmt.Fprintln(summaryOut, "Dry run: nothing will be saved.")
+	messages, err := src.Download(ctx)
+	if err != nil {
+		log.Fatalln("Unable to start download: ", err)
+	}
+	var saved, errors int
+	senders := make(map[string]int)
+	for message := range messages {
+		if message.FetchError != "" {
+			errors++
+			prog.Failed(message.Id, goerrors.New(message.FetchError))
+			continue
+		}
+		saved++
+		senders[senderAddress(message.From)]++
+	}
+	prog.Finish()
+	fmt.Fprintln(summaryOut, "Messages that would be saved: ", saved)
+	fmt.Fprintln(summaryOut, "Messages that could not be downloaded: ", errors)
+	printSenders("Top senders of messages that would be saved:", senders)
+	if r, ok := src.(reporter); ok {
+		r.report()
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(summaryOut, "Interrupted: only the messages listed before the interrupt are counted.")
+	}
 }
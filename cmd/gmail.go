@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/oaktown/calliope/gmailservice"
+	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/progress"
+	"github.com/oaktown/calliope/rules"
+	"github.com/oaktown/calliope/store"
+	"google.golang.org/api/gmail/v1"
+	"log"
+	"sort"
+	"time"
+)
+
+// gmailSource downloads a Gmail account as a source.Source: the changes since the last sync if
+// incremental (falling back to a full download if there's no sync checkpoint), otherwise a full
+// download, picking up the last one that didn't finish if resume. Full downloads are checkpointed
+// as messages are saved, and the sync checkpoint is saved when a download of everything is
+// committed.
+type gmailSource struct {
+	s           *store.Service
+	d           gmailservice.Downloader
+	incremental bool
+	resume      bool
+	prog        *progress.Reporter
+	skips       *skipReport
+	cp          *checkpointer
+	profile     *gmail.Profile
+	labels      []*store.Label
+	historyId   uint64
+	synced      bool
+	// Why listing stopped before every message was found, if it did
+	listErr error
+}
+
+func newGmailSource(s *store.Service, account misc.Account, options sourceOptions, prog *progress.Reporter) (*gmailSource, error) {
+	client, err := misc.GmailHttpClientFor(account)
+	if err != nil {
+		return nil, err
+	}
+	gsvc, err := gmail.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("could not create gmail client, %v", err)
+	}
+	inbox := options.inboxUrl
+	if inbox == "" {
+		inbox = account.InboxUrl
+	}
+	if inbox == "" {
+		inbox = defaultInboxUrl
+	}
+	ruleSet := options.rules
+	if ruleSet == nil {
+		ruleSet, _ = rules.Compile(nil)
+	}
+	gmailOptions := gmailservice.Options{
+		Query:       options.query,
+		Limit:       options.limit,
+		Account:     account.Name,
+		InboxUrl:    inbox,
+		Rules:       ruleSet,
+		Threads:     options.threads,
+		Raw:         options.raw,
+		MaxAttempts: options.maxAttempts,
+		DryRun:      options.dryRun,
+	}
+	if options.incremental {
+		// A sync that falls back to a full download has to get everything for the next sync to
+		// be able to carry on from it
+		gmailOptions.Query = ""
+		gmailOptions.Limit = 0
+	}
+	if options.dryRun {
+		// A dry run only reports on the messages the query lists (fetching just their metadata),
+		// so there's no need to fetch the rest of their threads
+		gmailOptions.Threads = false
+	}
+	d := gmailservice.New(gsvc, gmailOptions, 200)
+	if options.batchSize > 1 {
+		if err := d.UseBatches(client, options.batchSize); err != nil {
+			return nil, fmt.Errorf("unable to set up batch requests: %v", err)
+		}
+	}
+	d.Blobs = options.blobs
+	g := &gmailSource{
+		s:           s,
+		d:           d,
+		incremental: options.incremental,
+		resume:      options.resume,
+		prog:        prog,
+		skips:       newSkipReport(),
+	}
+	g.d.OnFetched = prog.Fetched
+	g.d.OnThrottled = prog.Throttled
+	g.d.OnListFailed = func(err error) {
+		// Set before the messages are all sent, so it's there by the time Err is called
+		g.listErr = fmt.Errorf("unable to list every message: %v", err)
+	}
+	g.d.OnSkip = func(skipped gmailservice.Skipped) {
+		g.skips.add(skipped)
+		g.cp.skipped(skipped.Id)
+		prog.Skipped(skipped.Id, skipped.Rule)
+	}
+	return g, nil
+}
+
+// Download starts the download. The history id is got before listing so that nothing that
+// changes during the download is missed by the next sync.
+func (g *gmailSource) Download(ctx context.Context) (<-chan *store.Message, error) {
+	if g.d.Options.DryRun {
+		g.d.OnPage = func(pageToken string, listed int64, ids []string) {
+			g.prog.Listed(len(ids))
+		}
+		g.labels = gmailservice.Download(ctx, g.d)
+		return g.d.MessageChan, nil
+	}
+	profile, err := gmailservice.GetProfile(g.d)
+	if err != nil && g.incremental {
+		return nil, fmt.Errorf("unable to get Gmail profile: %v", err)
+	}
+	if err != nil {
+		log.Println("Unable to get Gmail profile; sync checkpoint will not be saved. Error: ", err)
+	}
+	g.profile = profile
+	if g.incremental && profile != nil {
+		g.labels, g.historyId, g.synced = g.syncChanges(ctx, profile.EmailAddress)
+	}
+	if !g.synced {
+		g.cp = startCheckpoint(g.s, &g.d, g.d.StartedAt, g.resume)
+		if g.cp.checkpoint.HistoryId == 0 && profile != nil {
+			g.cp.checkpoint.HistoryId = profile.HistoryId
+		}
+		g.historyId = g.cp.checkpoint.HistoryId
+		g.prog.Listed(len(g.d.Options.RetryIds))
+		checkpointPage := g.d.OnPage
+		g.d.OnPage = func(pageToken string, listed int64, ids []string) {
+			checkpointPage(pageToken, listed, ids)
+			g.prog.Listed(len(ids))
+		}
+		g.labels = gmailservice.Download(ctx, g.d)
+	}
+	return g.d.MessageChan, nil
+}
+
+func (g *gmailSource) Finished(id string, saved bool) {
+	g.cp.finished(id, saved)
+}
+
+// Err says if listing stopped early, so that the download isn't committed as complete. Messages
+// that can't be downloaded are sent with a FetchError instead.
+func (g *gmailSource) Err() error {
+	return g.listErr
+}
+
+func (g *gmailSource) Labels() []*store.Label {
+	return g.labels
+}
+
+// Commit removes the download checkpoint, and saves the sync checkpoint unless the download was
+// limited or had a query (and so didn't bring the store up to date).
+func (g *gmailSource) Commit() error {
+	g.cp.done()
+	if g.profile == nil {
+		return nil
+	}
+	if !g.synced && (g.d.Options.Limit > 0 || g.d.Options.Query != "") {
+		fmt.Fprintln(summaryOut, "Sync checkpoint not updated because the download was limited or filtered by a query. Use --limit 0 and no --query to download everything.")
+		return nil
+	}
+	return g.s.SaveSyncState(store.SyncState{
+		Id:        g.profile.EmailAddress,
+		HistoryId: g.historyId,
+		UpdatedAt: time.Now(),
+	})
+}
+
+// Checkpoint saves how far the download got, so that --resume can pick it up. A sync only gets
+// its checkpoint once it has finished, so the next sync starts from the same place.
+func (g *gmailSource) Checkpoint() error {
+	g.cp.flush()
+	return nil
+}
+
+func (g *gmailSource) report() {
+	if g.d.Options.DryRun {
+		g.skips.printDetails()
+	} else {
+		g.skips.printCounts()
+	}
+	fmt.Fprintln(summaryOut, "Gmail API usage:")
+	fmt.Fprint(summaryOut, g.d.Limiter.Summary())
+}
+
+// startCheckpoint sets up checkpointing for a full download, picking up the saved checkpoint and
+// its options if resuming.
+func startCheckpoint(s *store.Service, d *gmailservice.Downloader, startedAt time.Time, resume bool) *checkpointer {
+	checkpoint := store.Checkpoint{
+		Id:        store.DownloadCheckpointIdFor(d.Options.Account),
+		StartedAt: startedAt,
+	}
+	if resume {
+		saved, found, err := s.GetCheckpoint(store.DownloadCheckpointIdFor(d.Options.Account))
+		if err != nil {
+			log.Println("Error reading download checkpoint; starting a new download. Error: ", err)
+		} else if !found {
+			fmt.Fprintln(summaryOut, "No unfinished download to resume. Starting a new download.")
+		} else {
+			checkpoint = saved
+			d.Options.Query = saved.Options.Query
+			d.Options.Limit = saved.Options.Limit
+			d.Options.InboxUrl = saved.Options.InboxUrl
+			d.Options.Rules = compileRules(saved.Options.Rules)
+			d.Options.Threads = saved.Options.Threads
+			d.Options.Raw = saved.Options.Raw
+			d.Options.PageToken = saved.PageToken
+			d.Options.Listed = saved.Listed
+			fmt.Fprintf(summaryOut, "Resuming download started at %v (%v messages listed before the page it stopped on, %v to retry)\n", saved.StartedAt, saved.Listed, len(saved.FailedIds))
+		}
+	}
+	checkpoint.Options = store.DownloadOptions{
+		Query:    d.Options.Query,
+		Limit:    d.Options.Limit,
+		InboxUrl: d.Options.InboxUrl,
+		Rules:    d.Options.Rules.Rules,
+		Threads:  d.Options.Threads,
+		Raw:      d.Options.Raw,
+	}
+	cp := newCheckpointer(s, checkpoint)
+	d.Options.PendingIds = cp.pendingIds()
+	d.Options.RetryIds = cp.retryIds()
+	d.OnPage = cp.listed
+	return cp
+}
+
+// syncChanges starts an incremental download from the saved checkpoint and applies deletions and
+// label changes to the store. Returns false if a full download is needed instead.
+func (g *gmailSource) syncChanges(ctx context.Context, account string) ([]*store.Label, uint64, bool) {
+	s := g.s
+	state, found, err := s.GetSyncState(account)
+	if err != nil {
+		log.Println("Error reading sync checkpoint: ", err)
+		return nil, 0, false
+	}
+	if !found {
+		fmt.Fprintf(summaryOut, "No sync checkpoint for %v yet. Doing a full download.\n", account)
+		return nil, 0, false
+	}
+	labels, changes, err := gmailservice.Sync(ctx, g.d, state.HistoryId)
+	if err == gmailservice.ErrHistoryExpired {
+		fmt.Fprintf(summaryOut, "Sync checkpoint from %v has expired. Doing a full download.\n", state.UpdatedAt)
+		return nil, 0, false
+	}
+	if err != nil {
+		log.Println("Error listing history. Doing a full download. Error: ", err)
+		return nil, 0, false
+	}
+	deletedAt := time.Now()
+	for _, id := range changes.Deleted {
+		if err := s.TombstoneMessage(id, deletedAt); err != nil {
+			log.Printf("Error marking id %s as deleted: %s\n", id, err)
+		}
+	}
+	for id, added := range changes.LabelsAdded {
+		if err := s.UpdateLabels(id, added, nil); err != nil {
+			log.Printf("Error adding labels to id %s: %s\n", id, err)
+		}
+	}
+	for id, removed := range changes.LabelsRemoved {
+		if err := s.UpdateLabels(id, nil, removed); err != nil {
+			log.Printf("Error removing labels from id %s: %s\n", id, err)
+		}
+	}
+	g.prog.Listed(len(changes.Added))
+	fmt.Fprintln(summaryOut, "New messages since last sync: ", len(changes.Added))
+	fmt.Fprintln(summaryOut, "Deleted messages since last sync: ", len(changes.Deleted))
+	fmt.Fprintln(summaryOut, "Messages with label changes: ", len(changes.LabelsAdded)+len(changes.LabelsRemoved))
+	return labels, changes.HistoryId, true
+}
+
+// refreshLabels updates the labels of every message in the store (except deleted ones) without
+// downloading the messages again. Cancelling ctx stops it once the labels being fetched are saved.
+func (g *gmailSource) refreshLabels(ctx context.Context) {
+	s, d := g.s, g.d
+	stored, err := s.GmailMessageIds(d.Options.Account)
+	if err != nil {
+		log.Fatalln("Unable to list messages in Elasticsearch: ", err)
+	}
+	var ids []string
+	for id, deleted := range stored {
+		if !deleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	fmt.Fprintln(summaryOut, "Refreshing labels of messages: ", len(ids))
+
+	var updated, unchanged, errors int
+	for result := range gmailservice.RefreshLabels(ctx, d, ids) {
+		if result.Err != nil {
+			errors++
+			continue
+		}
+		changed, err := s.SetLabels(result.Id, result.LabelIds)
+		switch {
+		case err != nil:
+			log.Printf("Error updating labels of id %s: %s\n", result.Id, err)
+			errors++
+		case changed:
+			updated++
+		default:
+			unchanged++
+		}
+	}
+	fmt.Fprintln(summaryOut, "Messages with new labels: ", updated)
+	fmt.Fprintln(summaryOut, "Messages unchanged: ", unchanged)
+	fmt.Fprintln(summaryOut, "Total errors: ", errors)
+	if ctx.Err() != nil {
+		fmt.Fprintln(summaryOut, "Interrupted: labels not refreshed: ", len(ids)-updated-unchanged-errors)
+	}
+	fmt.Fprintln(summaryOut, "Gmail API usage:")
+	fmt.Fprint(summaryOut, d.Limiter.Summary())
+}
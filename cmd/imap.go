@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/oaktown/calliope/imapservice"
+	"github.com/oaktown/calliope/importer"
+	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/store"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var imapServer string
+var imapUser string
+var imapFolders []string
+var imapInsecure bool
+var imapFull bool
+
+func init() {
+	importCmd.AddCommand(importImapCmd)
+	importImapCmd.Flags().StringVar(&imapServer, "server", "", "host:port of the IMAP server, e.g. imap.fastmail.com:993.")
+	importImapCmd.Flags().StringVar(&imapUser, "user", "", "user name to log in with. The password is read from $"+misc.DefaultImapPasswordEnv+".")
+	importImapCmd.Flags().StringArrayVar(&imapFolders, "folder", nil, "folder to download (can be repeated). Every folder is downloaded if left out.")
+	importImapCmd.Flags().BoolVar(&imapInsecure, "insecure", false, "connect without TLS, e.g. to a server on localhost.")
+	importImapCmd.Flags().BoolVar(&imapFull, "full", false, "download every message again instead of just the ones that are new since the last import.")
+}
+
+var importImapCmd = &cobra.Command{
+	Use:   "imap",
+	Short: "imports messages from an IMAP server",
+	Long: `Downloads messages from an IMAP server, such as Fastmail or Exchange. Each message is labelled with its
+folder, and its flags set the Unread, Starred and Draft labels. Only messages that are new since the last
+import of each folder are downloaded. To download an IMAP account that is in the config, use download or sync.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		r := startImport()
+		fmt.Fprintln(summaryOut, "Importing from", imapServer)
+		settings := misc.ImapAccount{Server: imapServer, User: imapUser, Folders: imapFolders, Insecure: imapInsecure}
+		d, err := imapDownloader(r.s, r.im, settings, imapFull)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		d.OnListed = r.prog.Listed
+		d.OnFailed = r.failed
+		result := runSource(r.stop, r.abort, r.s, importAccount, imapservice.NewSource(d, r.s.SaveImapState), r.prog)
+		r.finish(result.errors, "Run it again to pick up the rest.")
+	},
+}
+
+// imapDownloader returns a downloader for the IMAP account, which picks up from the checkpoints
+// of the last download unless full.
+func imapDownloader(s *store.Service, im *importer.Importer, settings misc.ImapAccount, full bool) (imapservice.Downloader, error) {
+	if settings.Server == "" || settings.User == "" {
+		return imapservice.Downloader{}, errors.New("the IMAP server and user are required")
+	}
+	password := settings.Password()
+	dial := func() (*imapservice.Client, error) {
+		c, err := imapservice.Dial(settings.Server, settings.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Login(settings.User, password); err != nil {
+			c.Logout()
+			return nil, err
+		}
+		return c, nil
+	}
+	d := imapservice.New(dial, im, imapservice.Options{Account: im.Account, Folders: settings.Folders, Full: full})
+	d.GetState = func(folder string) (store.ImapState, bool, error) {
+		return s.GetImapState(im.Account, folder)
+	}
+	return d, nil
+}
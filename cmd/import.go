@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/oaktown/calliope/importer"
+	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/progress"
+	"github.com/oaktown/calliope/store"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var importAccount string
+var importRaw bool
+var importAttachmentsDir string
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.PersistentFlags().StringVarP(&importAccount, "account", "a", store.DefaultAccount, "name of the account to import the messages into. Doesn't have to be in the config.")
+	importCmd.PersistentFlags().BoolVar(&importRaw, "raw", false, "also archive the original source of every message.")
+	importCmd.PersistentFlags().StringVar(&importAttachmentsDir, "attachments-dir", "", "save attachments in this directory (default is attachments_dir from the config; if neither is set, attachments are not saved).")
+	importCmd.PersistentFlags().StringVar(&progressFormat, "progress", progress.Auto, "how to show progress: auto (a progress bar if on a terminal), bar, json (one event per line on stdout) or none.")
+	importCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "when interrupted, how long to wait for messages that have been read to be saved.")
+	importCmd.AddCommand(importMboxCmd)
+	importCmd.AddCommand(importMaildirCmd)
+	importCmd.AddCommand(importEmlCmd)
+}
+
+// Number of files read at once when importing a directory
+const importWorkers = 8
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "imports messages from files",
+	Long:  `Imports messages from files into Elasticsearch, alongside messages downloaded from Gmail.`,
+}
+
+var importMboxCmd = &cobra.Command{
+	Use:   "mbox <file>...",
+	Short: "imports messages from mbox files",
+	Long: `Imports every message in mbox files, such as Google Takeout exports and Thunderbird archives. Gmail
+thread ids and labels are kept if the file has them (Takeout does).`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runImport(func(im *importer.Importer) *importer.Source {
+			return importer.MboxSource(im, args)
+		})
+	},
+}
+
+var importMaildirCmd = &cobra.Command{
+	Use:   "maildir <dir>...",
+	Short: "imports messages from Maildir trees",
+	Long: `Imports every message in Maildir trees (including Maildir++ subfolders). Each message is labelled with
+its folder, and the Maildir flags set the Unread, Starred, Trash and Draft labels.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runImport(func(im *importer.Importer) *importer.Source {
+			return importer.MaildirSource(im, args, importWorkers)
+		})
+	},
+}
+
+var importEmlCmd = &cobra.Command{
+	Use:   "eml <dir>...",
+	Short: "imports directories of .eml files",
+	Long:  `Imports every .eml file in directory trees. Each message is labelled with the directory it is in.`,
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runImport(func(im *importer.Importer) *importer.Source {
+			return importer.EmlSource(im, args, importWorkers)
+		})
+	},
+}
+
+// importRun is an import that is under way: the store and importer for the account, progress
+// reporting, and the contexts that stop it (see interruptible).
+type importRun struct {
+	s          *store.Service
+	im         *importer.Importer
+	prog       *progress.Reporter
+	stop       context.Context
+	abort      context.Context
+	startedAt  time.Time
+	unreadable int64
+}
+
+func startImport() *importRun {
+	prog, err := progress.New(progressFormat)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logTo(prog.LogWriter(os.Stderr))
+	if prog.Format() == progress.JSON {
+		summaryOut = os.Stderr
+	}
+	stop, abort := interruptible(shutdownTimeout)
+	r := &importRun{prog: prog, stop: stop, abort: abort, startedAt: time.Now()}
+	fmt.Fprintln(summaryOut, "Started at:", r.startedAt)
+	fmt.Fprintln(summaryOut, "Account:", importAccount)
+	r.s = misc.GetStoreClient()
+	if r.im, err = newImporter(r.s, importAccount); err != nil {
+		log.Fatalln(err)
+	}
+	r.im.Raw = importRaw
+	if importAttachmentsDir == "" {
+		importAttachmentsDir = misc.AttachmentsDir()
+	}
+	if importAttachmentsDir != "" {
+		r.im.Blobs = misc.GetBlobStore(importAttachmentsDir)
+	}
+	if accounts, err := misc.Accounts(); err == nil {
+		for _, account := range accounts {
+			if account.Name == importAccount {
+				r.im.InboxUrl = account.InboxUrl
+			}
+		}
+	}
+	if r.im.InboxUrl == "" {
+		r.im.InboxUrl = defaultInboxUrl
+	}
+	return r
+}
+
+// failed records a message that could not be read.
+func (r *importRun) failed(origin string, err error) {
+	r.prog.Failed(origin, err)
+	atomic.AddInt64(&r.unreadable, 1)
+}
+
+// finish prints the summary, then exits if the import was interrupted (again is how to pick up
+// the rest) or there were errors.
+func (r *importRun) finish(errors int64, again string) {
+	fmt.Fprintln(summaryOut, "Messages that could not be read: ", atomic.LoadInt64(&r.unreadable))
+	finishedAt := time.Now()
+	fmt.Fprintf(summaryOut, "Elapsed time: %f seconds\n", finishedAt.Sub(r.startedAt).Seconds())
+	if r.stop.Err() != nil {
+		fmt.Fprintln(summaryOut, "Import interrupted.", again)
+		os.Exit(130)
+	}
+	if errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// runImport saves the messages from the files that newSource returns the source of.
+func runImport(newSource func(*importer.Importer) *importer.Source) {
+	r := startImport()
+	src := newSource(r.im)
+	src.OnOpen = func(path string) {
+		fmt.Fprintln(summaryOut, "Importing", path)
+	}
+	src.OnListed = r.prog.Listed
+	src.OnFailed = r.failed
+	result := runSource(r.stop, r.abort, r.s, importAccount, src, r.prog)
+	r.finish(result.errors, "Importing the same files again picks up the rest (messages already imported are updated, not copied).")
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Default time allowed after an interrupt for the messages being fetched and saved to finish
+const defaultShutdownTimeout = 30 * time.Second
+
+// interruptible returns two contexts for a long running command. stop is cancelled when the
+// process gets SIGINT or SIGTERM, to stop starting new work. abort is cancelled timeout after
+// that, or straight away on a second signal, to give up on the work that's still under way.
+func interruptible(timeout time.Duration) (stop context.Context, abort context.Context) {
+	stop, stopCancel := context.WithCancel(context.Background())
+	abort, abortCancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Got %v: stopping. Waiting up to %v for messages already being downloaded to be saved (interrupt again to stop now).\n", sig, timeout)
+		stopCancel()
+		select {
+		case <-signals:
+		case <-time.After(timeout):
+			log.Println("Gave up waiting for messages to be saved.")
+		}
+		abortCancel()
+	}()
+	return stop, abort
+}
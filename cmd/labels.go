@@ -14,6 +14,7 @@ var userLabelsOnly bool
 func init() {
 	rootCmd.AddCommand(labelsCmd)
 	labelsCmd.Flags().StringVarP(&labelName, "label", "l", "", "Look up the label id of a particular label.")
+	labelsCmd.Flags().StringVarP(&accountName, "account", "a", "", "only show labels of this account (default is every account).")
 	labelsCmd.Flags().BoolVarP(&userLabelsOnly, "only", "o", false, "Display only user labels.")
 }
 
@@ -33,7 +34,7 @@ var labelsCmd = &cobra.Command{
 }
 
 func lookupLabel(store *store.Service) {
-	labelId, err := store.FindLabelId(labelName)
+	labelId, err := store.FindLabelId(accountName, labelName)
 	if err != nil {
 		log.Printf("Error looking up label %v: %v\n", labelName, err)
 	}
@@ -41,11 +42,11 @@ func lookupLabel(store *store.Service) {
 }
 
 func showLabels(store *store.Service) {
-	labels, err := store.GetLabels(userLabelsOnly)
+	labels, err := store.GetLabels(accountName, userLabelsOnly)
 	if err != nil {
 		log.Println("Could not get labels from Elasticsearch. Error: ", err)
 	}
 	for _, label := range labels {
-		fmt.Printf("|%30s|%-30s|\n", label.Name, label.Id)
+		fmt.Printf("|%30s|%-30s|%-20s|\n", label.Name, label.Id, label.Account)
 	}
 }
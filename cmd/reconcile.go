@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/oaktown/calliope/gmailservice"
+	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/store"
+	"github.com/spf13/cobra"
+	"log"
+	"time"
+)
+
+var reconcileDryRun bool
+
+func init() {
+	rootCmd.AddCommand(reconcileCmd)
+	reconcileCmd.Flags().StringVarP(&accountName, "account", "a", "", "name of the account (from accounts in the config) to reconcile. Can be left out if there is only one.")
+	reconcileCmd.Flags().BoolVarP(&reconcileDryRun, "dry-run", "n", false, "only report what would change.")
+}
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "marks messages that were deleted in Gmail",
+	Long: `Compares every message id in Gmail with the messages in Elasticsearch. Messages that have been deleted or
+trashed in Gmail are marked as deleted (and left out of searches) rather than removed. Messages that are
+back in Gmail (e.g. taken out of the trash) are unmarked.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		reconcile()
+	},
+}
+
+func reconcile() {
+	account := misc.GetAccount(accountName)
+	if account.Type != misc.AccountGmail {
+		log.Fatalf("account %v is not a Gmail account; only Gmail accounts can be reconciled", account.Name)
+	}
+	fmt.Println("Account:", account.Name)
+	s := misc.GetStoreClient()
+	gsvc := misc.NewGmailService(misc.GetGmailHttpClientFor(account))
+	d := gmailservice.New(gsvc, gmailservice.Options{Account: account.Name}, 1)
+
+	// List the store first so that anything downloaded while Gmail is being listed isn't
+	// mistaken for a deleted message.
+	stored, err := s.GmailMessageIds(account.Name)
+	if err != nil {
+		log.Fatalln("Unable to list messages in Elasticsearch: ", err)
+	}
+	gmailIds, err := gmailservice.ListMessageIds(d)
+	if err != nil {
+		// A partial listing would make everything that wasn't listed look deleted.
+		log.Fatalln("Unable to list messages in Gmail: ", err)
+	}
+	tombstone, restore := store.Reconcile(gmailIds, stored)
+	fmt.Println("Messages in Gmail: ", len(gmailIds))
+	fmt.Println("Messages from Gmail in Elasticsearch: ", len(stored))
+	fmt.Println("Deleted from Gmail since last reconciled: ", len(tombstone))
+	fmt.Println("Back in Gmail since last reconciled: ", len(restore))
+	if reconcileDryRun {
+		return
+	}
+
+	deletedAt := time.Now()
+	var errors int
+	for _, id := range tombstone {
+		if err := s.TombstoneMessage(id, deletedAt); err != nil {
+			log.Printf("Error marking id %s as deleted: %s\n", id, err)
+			errors++
+		}
+	}
+	for _, id := range restore {
+		if err := s.RestoreMessage(id); err != nil {
+			log.Printf("Error unmarking id %s as deleted: %s\n", id, err)
+			errors++
+		}
+	}
+	fmt.Println("Total errors: ", errors)
+}
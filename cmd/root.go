@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"log"
 	"os"
 
 	homedir "github.com/mitchellh/go-homedir"
@@ -11,6 +13,10 @@ import (
 
 var cfgFile string
 
+// LogFile is where log output is kept, as well as being shown on the terminal. It's set by
+// main.main.
+var LogFile io.Writer
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "calliope",
@@ -30,6 +36,15 @@ func Execute() {
 	}
 }
 
+// logTo shows log output on terminal (e.g. through a progress bar) and keeps it in LogFile.
+func logTo(terminal io.Writer) {
+	if LogFile == nil {
+		log.SetOutput(terminal)
+		return
+	}
+	log.SetOutput(io.MultiWriter(terminal, LogFile))
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/oaktown/calliope/gmailservice"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Number of subjects to show for each rule in a dry run
+const sampleSubjects = 5
+
+// Number of senders to show in a dry run
+const topSenders = 10
+
+// skipReport keeps track of the messages skipped by each rule.
+type skipReport struct {
+	mu       sync.Mutex
+	counts   map[string]int
+	senders  map[string]int
+	subjects map[string][]string
+}
+
+func newSkipReport() *skipReport {
+	return &skipReport{
+		counts:   make(map[string]int),
+		senders:  make(map[string]int),
+		subjects: make(map[string][]string),
+	}
+}
+
+func (r *skipReport) add(skipped gmailservice.Skipped) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[skipped.Rule]++
+	r.senders[senderAddress(skipped.From)]++
+	if len(r.subjects[skipped.Rule]) < sampleSubjects {
+		r.subjects[skipped.Rule] = append(r.subjects[skipped.Rule], skipped.Subject)
+	}
+}
+
+func (r *skipReport) total() int {
+	var total int
+	for _, count := range r.counts {
+		total += count
+	}
+	return total
+}
+
+// printCounts prints the number of messages skipped by each rule.
+func (r *skipReport) printCounts() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintln(summaryOut, "Total skipped messages: ", r.total())
+	for _, name := range sortedByCount(r.counts) {
+		fmt.Fprintf(summaryOut, "  %-50s %v\n", name, r.counts[name])
+	}
+}
+
+// printDetails prints the counts along with some of the subjects each rule skipped and the
+// senders with the most skipped messages.
+func (r *skipReport) printDetails() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintln(summaryOut, "Total skipped messages: ", r.total())
+	for _, name := range sortedByCount(r.counts) {
+		fmt.Fprintf(summaryOut, "  %-50s %v\n", name, r.counts[name])
+		for _, subject := range r.subjects[name] {
+			fmt.Fprintf(summaryOut, "      %v\n", subject)
+		}
+	}
+	printSenders("Top senders of skipped messages:", r.senders)
+}
+
+func printSenders(title string, senders map[string]int) {
+	fmt.Fprintln(summaryOut, title)
+	for i, sender := range sortedByCount(senders) {
+		if i == topSenders {
+			break
+		}
+		fmt.Fprintf(summaryOut, "  %-50s %v\n", sender, senders[sender])
+	}
+}
+
+// senderAddress returns the lower case address from a From header, so that the same sender
+// with different display names is counted once.
+func senderAddress(from string) string {
+	if address, err := mail.ParseAddress(from); err == nil {
+		return strings.ToLower(address.Address)
+	}
+	return strings.ToLower(from)
+}
+
+// sortedByCount returns the keys with the largest counts first.
+func sortedByCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/oaktown/calliope/blob"
+	"github.com/oaktown/calliope/imapservice"
+	"github.com/oaktown/calliope/importer"
+	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/progress"
+	"github.com/oaktown/calliope/rules"
+	"github.com/oaktown/calliope/source"
+	"github.com/oaktown/calliope/store"
+	"log"
+)
+
+// sourceOptions are how to download an account. Those after resume are only used for Gmail
+// accounts.
+type sourceOptions struct {
+	// Only download what's new since the last download, rather than everything
+	incremental bool
+	// Also archive the original source of every message
+	raw bool
+	// Pick up the last full download that didn't finish
+	resume bool
+	// Only fetch headers, to report what would be saved; the store isn't used
+	dryRun bool
+	// A Gmail search, and how many messages it can list (0 for all of them)
+	query       string
+	limit       int64
+	inboxUrl    string
+	rules       *rules.RuleSet
+	threads     bool
+	maxAttempts int
+	batchSize   int
+	blobs       *blob.Store
+}
+
+// newSource returns the source to download the account from. s can be nil for a dry run. Only
+// Gmail accounts can be resumed or dry run.
+func newSource(s *store.Service, account misc.Account, options sourceOptions, prog *progress.Reporter) (source.Source, error) {
+	switch account.Type {
+	case misc.AccountGmail:
+		return newGmailSource(s, account, options, prog)
+	case misc.AccountImap:
+		if options.resume || options.dryRun {
+			return nil, fmt.Errorf("account %v: --resume and --dry-run only work with Gmail accounts", account.Name)
+		}
+		im, err := newImporter(s, account.Name)
+		if err != nil {
+			return nil, err
+		}
+		im.Raw = options.raw
+		im.Blobs = options.blobs
+		d, err := imapDownloader(s, im, account.Imap, !options.incremental)
+		if err != nil {
+			return nil, fmt.Errorf("account %v: %v", account.Name, err)
+		}
+		d.OnListed = prog.Listed
+		d.OnFailed = prog.Failed
+		return imapservice.NewSource(d, s.SaveImapState), nil
+	}
+	return nil, fmt.Errorf("account %v has type %v, which can't be downloaded", account.Name, account.Type)
+}
+
+// newImporter returns an importer for the account that knows its labels.
+func newImporter(s *store.Service, account string) (*importer.Importer, error) {
+	labels, err := s.GetLabels(account, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get labels from Elasticsearch: %v", err)
+	}
+	return importer.New(account, labels), nil
+}
+
+// runSource downloads from src into the store, and commits the download once every message has
+// been saved and src has no error, or checkpoints it if not. Cancelling stop stops the download and cancelling abort
+// gives up on the messages still being saved.
+func runSource(stop, abort context.Context, s *store.Service, account string, src source.Source, prog *progress.Reporter) downloadResult {
+	messages, err := src.Download(stop)
+	if err != nil {
+		log.Println("Unable to start download: ", err)
+		return downloadResult{errors: 1}
+	}
+	saved, errors := reader(abort, s, messages, 10, src, prog)
+	downloadErr := src.Err()
+	if err := s.SaveLabels(account, src.Labels()); err != nil {
+		log.Println("Error saving labels: ", err)
+	}
+	interrupted := stop.Err() != nil
+	if interrupted || errors > 0 || downloadErr != nil {
+		if err := src.Checkpoint(); err != nil {
+			log.Println("Error saving checkpoint: ", err)
+		}
+	} else if err := src.Commit(); err != nil {
+		log.Println("Error saving checkpoint: ", err)
+	}
+	if downloadErr != nil {
+		log.Println("Error downloading: ", downloadErr)
+		errors++
+	}
+	if r, ok := src.(reporter); ok {
+		r.report()
+	}
+	return downloadResult{saved: saved, errors: errors, interrupted: interrupted}
+}
+
+// reporter is a source that has more to say in the summary of a download, e.g. how many
+// messages rules skipped.
+type reporter interface {
+	report()
+}
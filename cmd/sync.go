@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/oaktown/calliope/blob"
+	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/rules"
+	"github.com/oaktown/calliope/scheduler"
+	"github.com/oaktown/calliope/store"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"time"
+)
+
+var syncEvery time.Duration
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().DurationVar(&syncEvery, "every", 0, "keep running and sync every so often (e.g. 15m) instead of syncing once.")
+	syncCmd.Flags().StringVarP(&accountName, "account", "a", "", "name of the account (from accounts in the config) to sync. Syncs every account if left out.")
+	syncCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "when interrupted, how long to wait for messages that are already being downloaded to be saved.")
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "downloads changes since the last sync",
+	Long: `Downloads what has changed since the last sync of each account (in Gmail or on an IMAP server), the same
+as download --sync. Accounts that haven't been synced before get a full download. With --every, keeps running
+and syncs each account on a schedule, waiting longer after a sync fails.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		stop, abort := interruptible(shutdownTimeout)
+		s := misc.GetStoreClient()
+		syncer := newSyncScheduler(s, abort, syncAccounts())
+		if syncEvery <= 0 {
+			for _, status := range syncer.RunAll(stop) {
+				if status.LastError != "" {
+					os.Exit(1)
+				}
+			}
+			return
+		}
+		syncer.Every = syncEvery
+		syncer.Start(stop)
+	},
+}
+
+// syncAccounts returns the names of the accounts to sync: the one chosen with --account, or all of them.
+func syncAccounts() []string {
+	if accountName != "" {
+		return []string{misc.GetAccount(accountName).Name}
+	}
+	accounts, err := misc.Accounts()
+	if err != nil {
+		log.Fatalln("Unable to read accounts from config: ", err)
+	}
+	var names []string
+	for _, account := range accounts {
+		names = append(names, account.Name)
+	}
+	return names
+}
+
+// newSyncScheduler returns a scheduler that syncs the accounts into the store, keeping track of
+// its status and locks there. Cancelling abort gives up on messages still being saved when a sync
+// is stopped.
+func newSyncScheduler(s *store.Service, abort context.Context, accounts []string) *scheduler.Scheduler {
+	var blobs *blob.Store
+	if dir := misc.AttachmentsDir(); dir != "" {
+		blobs = misc.GetBlobStore(dir)
+	}
+	syncer := scheduler.New(syncEvery, accounts, func(stop context.Context, account string) (int64, error) {
+		return syncAccount(stop, abort, s, misc.GetAccount(account), blobs)
+	})
+	host, _ := os.Hostname()
+	syncer.StoreLock(s, fmt.Sprintf("%v:%v", host, os.Getpid()))
+	syncer.OnStatus = func(status store.SyncStatus) {
+		if err := s.SaveSyncStatus(status); err != nil {
+			log.Printf("Error saving sync status of account %v: %v\n", status.Account, err)
+		}
+	}
+	return syncer
+}
+
+// syncAccount does an incremental download of the account with the rules from the config, and
+// returns the number of messages saved.
+func syncAccount(stop, abort context.Context, s *store.Service, account misc.Account, blobs *blob.Store) (int64, error) {
+	configuredRules, err := misc.Rules()
+	if err != nil {
+		return 0, fmt.Errorf("unable to read rules from config: %v", err)
+	}
+	ruleSet, err := rules.Compile(configuredRules)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rule in config: %v", err)
+	}
+	// A Gmail sync that falls back to a full download picks up the last one that didn't finish
+	options := sourceOptions{incremental: true, resume: account.Type == misc.AccountGmail, rules: ruleSet, blobs: blobs}
+	src, err := newSource(s, account, options, nil)
+	if err != nil {
+		return 0, err
+	}
+	return syncResult(stop, runSource(stop, abort, s, account.Name, src, nil))
+}
+
+// syncResult returns the number of messages a sync saved, and an error if it didn't finish.
+func syncResult(stop context.Context, result downloadResult) (int64, error) {
+	switch {
+	case result.interrupted:
+		return result.saved, stop.Err()
+	case result.errors > 0:
+		return result.saved, fmt.Errorf("%v messages could not be saved", result.errors)
+	}
+	return result.saved, nil
+}
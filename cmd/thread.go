@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/store"
+	"github.com/oaktown/calliope/threading"
+	"github.com/spf13/cobra"
+	"log"
+	"sort"
+	"strings"
+)
+
+var threadDryRun bool
+
+func init() {
+	rootCmd.AddCommand(threadCmd)
+	threadCmd.Flags().StringVarP(&accountName, "account", "a", "", "name of the account to thread, including accounts made by an import that aren't in the config. Can be left out if there is only one.")
+	threadCmd.Flags().BoolVarP(&threadDryRun, "dry-run", "n", false, "only report what would change.")
+}
+
+var threadCmd = &cobra.Command{
+	Use:   "thread",
+	Short: "groups saved messages into conversations",
+	Long: `Works out the conversation of every message in the account from all of their Message-ID, In-Reply-To and
+References headers (and subjects, for replies whose original is missing), and moves the messages whose
+conversation has changed. Messages are put in a conversation as they're saved, from their own headers, but
+that can't take into account messages with broken references or none at all. Gmail threads are kept together,
+but Gmail threads that turn out to be one conversation (e.g. because Gmail split it when the subject changed)
+are joined, and keep the id of the earliest of them. Messages downloaded later start out in their Gmail thread
+again, so run it again after downloading.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		thread()
+	},
+}
+
+func thread() {
+	s := misc.GetStoreClient()
+	account := storedAccount(s, accountName)
+	fmt.Println("Account:", account)
+	messages, current, err := s.ThreadingMessages(account)
+	if err != nil {
+		log.Fatalln("Unable to list messages in Elasticsearch: ", err)
+	}
+	conversations := threading.Thread(account, messages)
+	var moved []string
+	distinct := make(map[string]bool)
+	for id, conversation := range conversations {
+		distinct[conversation] = true
+		if current[id] != conversation {
+			moved = append(moved, id)
+		}
+	}
+	sort.Strings(moved)
+	fmt.Println("Messages: ", len(messages))
+	fmt.Println("Conversations: ", len(distinct))
+	fmt.Println("Messages to move: ", len(moved))
+	if threadDryRun {
+		return
+	}
+
+	var errors int
+	for _, id := range moved {
+		if err := s.MoveToConversation(id, conversations[id]); err != nil {
+			log.Printf("Error moving id %s to conversation %s: %s\n", id, conversations[id], err)
+			errors++
+		}
+	}
+	fmt.Println("Total errors: ", errors)
+}
+
+// storedAccount returns the name of the account with messages in the store, which can be left
+// out if there is only one.
+func storedAccount(s *store.Service, name string) string {
+	names, err := s.AccountNames()
+	if err != nil {
+		log.Fatalln("Unable to list accounts in Elasticsearch: ", err)
+	}
+	if name == "" {
+		if len(names) != 1 {
+			log.Fatalf("there are %v accounts with messages (%v); choose one with --account", len(names), strings.Join(names, ", "))
+		}
+		return names[0]
+	}
+	for _, n := range names {
+		if n == name {
+			return name
+		}
+	}
+	log.Fatalf("account %v has no messages in Elasticsearch", name)
+	return ""
+}
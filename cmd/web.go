@@ -1,11 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/gorilla/mux"
 	"time"
 
 	"github.com/oaktown/calliope/api"
+	"github.com/oaktown/calliope/misc"
 	"github.com/oaktown/calliope/web"
 	"github.com/spf13/cobra"
 	"log"
@@ -13,10 +15,12 @@ import (
 )
 
 var port string
+var webSyncEvery time.Duration
 
 func init() {
 	rootCmd.AddCommand(webCmd)
 	webCmd.Flags().StringVarP(&port, "port", "p", "8080", "Port to run web server on.")
+	webCmd.Flags().DurationVar(&webSyncEvery, "sync-every", 0, "also sync every account this often (e.g. 15m), as calliope sync --every does.")
 }
 
 var webCmd = &cobra.Command{
@@ -34,7 +38,11 @@ func startServer() {
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("public"))))
 	r.HandleFunc("/stats", web.StatsHandler)
 	r.HandleFunc("/api/search", api.SearchHandler)
+	r.HandleFunc("/api/threads", api.ThreadsHandler)
+	r.HandleFunc("/api/sync", api.SyncStatusHandler)
 	r.HandleFunc("/message/{id:[^/]+}", web.MessageHandler)
+	r.HandleFunc("/message/{id:[^/]+}/eml", web.RawMessageHandler)
+	r.HandleFunc("/message/{id:[^/]+}/attachment/{index:[0-9]+}", web.AttachmentHandler)
 	r.HandleFunc("/report", web.ReportHandler)
 	r.HandleFunc("/", DefaultHandler)
 
@@ -45,8 +53,29 @@ func startServer() {
 		ReadTimeout:  15 * time.Second,
 	}
 
-	fmt.Printf("Starting web server: http://localhost:%s/\n\n", port)
-	log.Fatal(srv.ListenAndServe())
+	if webSyncEvery <= 0 {
+		fmt.Printf("Starting web server: http://localhost:%s/\n\n", port)
+		log.Fatal(srv.ListenAndServe())
+	}
+
+	stop, abort := interruptible(defaultShutdownTimeout)
+	syncEvery = webSyncEvery
+	syncer := newSyncScheduler(misc.GetStoreClient(), abort, syncAccounts())
+	synced := make(chan bool)
+	go func() {
+		syncer.Start(stop)
+		close(synced)
+	}()
+	go func() {
+		<-stop.Done()
+		srv.Shutdown(context.Background())
+	}()
+	fmt.Printf("Starting web server: http://localhost:%s/ (syncing every %v)\n\n", port, webSyncEvery)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Let the sync that's under way finish saving what it has downloaded
+	<-synced
 }
 
 func DefaultHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,71 @@
+package gmailservice
+
+import (
+	"github.com/oaktown/calliope/store"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+var addressParser = &mail.AddressParser{WordDecoder: &mime.WordDecoder{CharsetReader: CharsetReader}}
+
+// ParseAddressHeaders parses the address headers of a message, which get returns by name.
+func ParseAddressHeaders(get func(name string) string) store.Addresses {
+	return store.Addresses{
+		From:    ParseAddresses(get("From")),
+		To:      ParseAddresses(get("To")),
+		Cc:      ParseAddresses(get("Cc")),
+		Bcc:     ParseAddresses(get("Bcc")),
+		ReplyTo: ParseAddresses(get("Reply-To")),
+	}
+}
+
+// ParseAddresses parses an address list header (RFC 5322), decoding RFC 2047 encoded names and
+// flattening groups ("Team: a@example.com, b@example.com;"). Headers that don't follow the RFC
+// (e.g. with an unquoted comma in a name) still give up whatever addresses are in them.
+func ParseAddresses(header string) []store.Address {
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+	list, err := addressParser.ParseList(header)
+	if err != nil {
+		list = scanAddresses(header)
+	}
+	var addresses []store.Address
+	for _, parsed := range list {
+		address := strings.ToLower(parsed.Address)
+		var domain string
+		if at := strings.LastIndex(address, "@"); at >= 0 {
+			domain = address[at+1:]
+		}
+		addresses = append(addresses, store.Address{Name: strings.TrimSpace(parsed.Name), Address: address, Domain: domain})
+	}
+	return addresses
+}
+
+// An address in angle brackets, or a bare one
+var addrSpec = regexp.MustCompile(`<([^<>\s]+@[^<>\s]+)>|([^\s<>,;:"()]+@[^\s<>,;:"()]+)`)
+
+// scanAddresses finds the addresses in a header that can't be parsed. The name of an address in
+// angle brackets is whatever is between it and the address before.
+func scanAddresses(header string) []*mail.Address {
+	var list []*mail.Address
+	last := 0
+	for _, match := range addrSpec.FindAllStringSubmatchIndex(header, -1) {
+		address := &mail.Address{}
+		if match[2] >= 0 {
+			address.Address = header[match[2]:match[3]]
+			name := strings.Trim(header[last:match[0]], " \t\r\n,;\"")
+			if decoded, err := addressParser.WordDecoder.DecodeHeader(name); err == nil {
+				name = decoded
+			}
+			address.Name = name
+		} else {
+			address.Address = header[match[4]:match[5]]
+		}
+		list = append(list, address)
+		last = match[1]
+	}
+	return list
+}
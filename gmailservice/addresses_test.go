@@ -0,0 +1,38 @@
+package gmailservice
+
+import (
+	"github.com/oaktown/calliope/store"
+	"reflect"
+	"testing"
+)
+
+func TestParseAddresses(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []store.Address
+	}{
+		{"", nil},
+		{"Amy@Example.COM", []store.Address{{Address: "amy@example.com", Domain: "example.com"}}},
+		{`"Smith, Amy" <amy@example.com>, bob@mail.acme.com`, []store.Address{
+			{Name: "Smith, Amy", Address: "amy@example.com", Domain: "example.com"},
+			{Address: "bob@mail.acme.com", Domain: "mail.acme.com"},
+		}},
+		{"=?ISO-8859-1?Q?Jos=E9?= <jose@example.com>", []store.Address{{Name: "José", Address: "jose@example.com", Domain: "example.com"}}},
+		{"Team: a@x.com, B <b@y.com>;, c@z.com", []store.Address{
+			{Address: "a@x.com", Domain: "x.com"},
+			{Name: "B", Address: "b@y.com", Domain: "y.com"},
+			{Address: "c@z.com", Domain: "z.com"},
+		}},
+		{"undisclosed-recipients:;", nil},
+		// Not valid: the comma in the name isn't quoted
+		{"Smith, Amy <amy@example.com>, =?UTF-8?Q?Jos=C3=A9?= <jose@example.com>", []store.Address{
+			{Name: "Smith, Amy", Address: "amy@example.com", Domain: "example.com"},
+			{Name: "José", Address: "jose@example.com", Domain: "example.com"},
+		}},
+	}
+	for _, test := range tests {
+		if got := ParseAddresses(test.header); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseAddresses(%q) = %+v, want %+v", test.header, got, test.want)
+		}
+	}
+}
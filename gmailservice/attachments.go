@@ -0,0 +1,89 @@
+package gmailservice
+
+import (
+	"github.com/oaktown/calliope/store"
+	"google.golang.org/api/gmail/v1"
+	"log"
+)
+
+// AttachmentParts returns every part of the message that has a filename, in the order they
+// appear in the message.
+func AttachmentParts(msg gmail.Message) []*gmail.MessagePart {
+	var parts []*gmail.MessagePart
+	WalkParts(msg.Payload, func(part *gmail.MessagePart) {
+		if part.Filename != "" {
+			parts = append(parts, part)
+		}
+	})
+	return parts
+}
+
+// Attachments returns the metadata of the message's attachments without their content.
+func Attachments(msg gmail.Message) []store.Attachment {
+	var attachments []store.Attachment
+	for _, part := range AttachmentParts(msg) {
+		attachment := store.Attachment{
+			Filename: part.Filename,
+			MimeType: part.MimeType,
+		}
+		if part.Body != nil {
+			attachment.Size = part.Body.Size
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments
+}
+
+// downloadAttachments saves the content of each attachment to the blob store and records its hash.
+// Attachments that can't be downloaded are logged and left without a hash.
+func (d Downloader) downloadAttachments(gmailMsg *gmail.Message, message *store.Message) {
+	for i, part := range AttachmentParts(*gmailMsg) {
+		if i >= len(message.Attachments) {
+			break
+		}
+		if part.Body == nil {
+			continue
+		}
+		data, err := d.attachmentData(gmailMsg.Id, part.Body)
+		if err != nil {
+			log.Printf("Unable to download attachment %v of message %v: %v\n", part.Filename, gmailMsg.Id, err)
+			continue
+		}
+		hash, err := d.Blobs.Put(data)
+		if err != nil {
+			log.Printf("Unable to save attachment %v of message %v: %v\n", part.Filename, gmailMsg.Id, err)
+			continue
+		}
+		message.Attachments[i].Sha256 = hash
+		message.Attachments[i].Size = int64(len(data))
+	}
+}
+
+// attachmentData returns the decoded content of an attachment. Small attachments are included
+// in the message; larger ones have to be fetched separately.
+func (d Downloader) attachmentData(messageId string, body *gmail.MessagePartBody) ([]byte, error) {
+	encoded := body.Data
+	if encoded == "" && body.AttachmentId != "" {
+		attachment, err := d.doGetAttachmentWrapper(messageId, body.AttachmentId)
+		if err != nil {
+			return nil, err
+		}
+		encoded = attachment.Data
+	}
+	return DecodeBase64Url(encoded)
+}
+
+func (d *Downloader) doGetAttachmentWrapper(messageId, id string) (*gmail.MessagePartBody, error) {
+	var attachment *gmail.MessagePartBody
+	fn := func() error {
+		r, err := d.doGetAttachment(d, messageId, id)
+		attachment = r
+		return err
+	}
+	err := d.retry(MethodGetAttachment, fn)
+	return attachment, err
+}
+
+func doGetAttachment(d *Downloader, messageId, id string) (*gmail.MessagePartBody, error) {
+	return d.Svc.Users.Messages.Attachments.Get("me", messageId, id).Do()
+}
@@ -0,0 +1,98 @@
+package gmailservice
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/oaktown/calliope/blob"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestDownloadAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calliope-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inline := []byte("inline attachment")
+	fetched := []byte("%PDF-1.4 large attachment")
+	encode := base64.URLEncoding.EncodeToString
+	gmailMsg := &gmail.Message{
+		Id: "m1",
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Body:     &gmail.MessagePartBody{},
+			Parts: []*gmail.MessagePart{
+				{MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: encode([]byte("Hi"))}},
+				{
+					MimeType: "multipart/related",
+					Body:     &gmail.MessagePartBody{},
+					Parts: []*gmail.MessagePart{
+						{Filename: "note.txt", MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: encode(inline), Size: 17}},
+					},
+				},
+				{Filename: "contract.pdf", MimeType: "application/pdf", Body: &gmail.MessagePartBody{AttachmentId: "a1", Size: 25}},
+			},
+		},
+	}
+
+	d := New(nil, Options{}, 1)
+	d.Blobs, _ = blob.New(dir)
+	d.doGetAttachment = func(d *Downloader, messageId, id string) (*gmail.MessagePartBody, error) {
+		if messageId != "m1" || id != "a1" {
+			t.Errorf("Unexpected attachment request: %v %v", messageId, id)
+		}
+		return &gmail.MessagePartBody{Data: encode(fetched)}, nil
+	}
+
+	message, _ := GmailToMessage(*gmailMsg, "", time.Now())
+	if len(message.Attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got %+v", message.Attachments)
+	}
+	d.downloadAttachments(gmailMsg, &message)
+
+	for i, want := range [][]byte{inline, fetched} {
+		attachment := message.Attachments[i]
+		if attachment.Sha256 != blob.Hash(want) {
+			t.Errorf("Attachment %v: expected hash %v, got %v", attachment.Filename, blob.Hash(want), attachment.Sha256)
+		}
+		saved, err := ioutil.ReadFile(d.Blobs.Path(attachment.Sha256))
+		if err != nil || string(saved) != string(want) {
+			t.Errorf("Attachment %v: expected %q to be saved, got %q (err: %v)", attachment.Filename, want, saved, err)
+		}
+	}
+	if message.Attachments[1].Filename != "contract.pdf" || message.Attachments[1].MimeType != "application/pdf" {
+		t.Errorf("Unexpected metadata: %+v", message.Attachments[1])
+	}
+}
+
+func TestDownloadAttachments_noBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calliope-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("after the part without a body")
+	gmailMsg := &gmail.Message{
+		Id: "m1",
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Parts: []*gmail.MessagePart{
+				{Filename: "empty.txt", MimeType: "text/plain"},
+				{Filename: "note.txt", MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString(data)}},
+			},
+		},
+	}
+	d := New(nil, Options{}, 1)
+	d.Blobs, _ = blob.New(dir)
+	message, _ := GmailToMessage(*gmailMsg, "", time.Now())
+	d.downloadAttachments(gmailMsg, &message)
+	if message.Attachments[0].Sha256 != "" || message.Attachments[1].Sha256 != blob.Hash(data) {
+		t.Errorf("Expected only the attachment with a body to be saved, got %+v", message.Attachments)
+	}
+}
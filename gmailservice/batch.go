@@ -0,0 +1,236 @@
+package gmailservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Gmail accepts up to 100 calls in one batch request, but recommends no more than 50 because
+// larger batches are more likely to be rate limited.
+const MaxBatchSize = 100
+
+// How long to wait for a batch to fill up before sending it anyway
+const BatchWait = 50 * time.Millisecond
+
+// Batcher collects messages.get calls from many goroutines and sends them to Gmail as
+// multipart batch requests. Each call still gets its own result, so a message that fails
+// inside an otherwise successful batch is retried on its own.
+type Batcher struct {
+	client   *http.Client
+	endpoint string // where batch requests are posted
+	basePath string // path of the gmail API, which each call in the batch is relative to
+	size     int
+	wait     time.Duration
+	requests chan batchCall
+}
+
+type batchCall struct {
+	id     string
+	format string
+	result chan batchResult
+}
+
+type batchResult struct {
+	msg *gmail.Message
+	err error
+}
+
+// NewBatcher returns a Batcher that sends up to size calls at a time. basePath is the
+// gmail service's BasePath; the batch endpoint is on the same host.
+func NewBatcher(client *http.Client, basePath string, size int) (*Batcher, error) {
+	base, err := url.Parse(basePath)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxBatchSize {
+		size = MaxBatchSize
+	}
+	if size < 1 {
+		size = 1
+	}
+	endpoint := url.URL{Scheme: base.Scheme, Host: base.Host, Path: "/batch/gmail/v1"}
+	b := &Batcher{
+		client:   client,
+		endpoint: endpoint.String(),
+		basePath: strings.TrimSuffix(base.Path, "/"),
+		size:     size,
+		wait:     BatchWait,
+		requests: make(chan batchCall),
+	}
+	go b.run()
+	return b, nil
+}
+
+// UseBatches makes the Downloader fetch messages in batches of up to size. It must be called
+// before the download starts.
+func (d *Downloader) UseBatches(client *http.Client, size int) error {
+	b, err := NewBatcher(client, d.Svc.BasePath, size)
+	if err != nil {
+		return err
+	}
+	d.batcher = b
+	d.doGet = func(d *Downloader, id string) (*gmail.Message, error) {
+		return d.batcher.Get(id, "full")
+	}
+	d.doGetFormat = func(d *Downloader, id, format string) (*gmail.Message, error) {
+		return d.batcher.Get(id, format)
+	}
+	return nil
+}
+
+// Get fetches one message in the given format ("full", "minimal", ...), waiting for the batch it
+// is sent in to come back.
+func (b *Batcher) Get(id, format string) (*gmail.Message, error) {
+	call := batchCall{id: id, format: format, result: make(chan batchResult, 1)}
+	b.requests <- call
+	result := <-call.result
+	return result.msg, result.err
+}
+
+// Close sends whatever calls are waiting and stops collecting new ones.
+func (b *Batcher) Close() {
+	close(b.requests)
+}
+
+func (b *Batcher) run() {
+	var pending []batchCall
+	var timeout <-chan time.Time
+	flush := func() {
+		go b.send(pending)
+		pending = nil
+		timeout = nil
+	}
+	for {
+		select {
+		case call, ok := <-b.requests:
+			if !ok {
+				if len(pending) > 0 {
+					flush()
+				}
+				return
+			}
+			pending = append(pending, call)
+			if len(pending) == 1 {
+				timeout = time.After(b.wait)
+			}
+			if len(pending) >= b.size {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		}
+	}
+}
+
+// send makes one batch request. If the batch as a whole fails, every call in it gets the error.
+func (b *Batcher) send(calls []batchCall) {
+	results, err := b.do(calls)
+	for i, call := range calls {
+		if err != nil {
+			call.result <- batchResult{err: err}
+			continue
+		}
+		call.result <- results[i]
+	}
+}
+
+func (b *Batcher) do(calls []batchCall) ([]batchResult, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i, call := range calls {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", fmt.Sprintf("<item-%d>", i))
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(part, "GET %v/me/messages/%v?alt=json&format=%v HTTP/1.1\r\n\r\n",
+			b.basePath, url.PathEscape(call.id), url.QueryEscape(call.format))
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("POST", b.endpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	response, err := b.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if err := googleapi.CheckResponse(response); err != nil {
+		return nil, err
+	}
+	return parseBatchResponse(response, len(calls))
+}
+
+// parseBatchResponse splits a batch response into the result of each call, matching them up
+// by Content-ID. Calls missing from the response get an error so that they are retried.
+func parseBatchResponse(response *http.Response, count int) ([]batchResult, error) {
+	_, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("batch response has no valid Content-Type: %v", err)
+	}
+	results := make([]batchResult, count)
+	found := make([]bool, count)
+	reader := multipart.NewReader(response.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var i int
+		if _, err := fmt.Sscanf(part.Header.Get("Content-ID"), "<response-item-%d>", &i); err != nil || i < 0 || i >= count {
+			continue
+		}
+		results[i] = parseBatchPart(part)
+		found[i] = true
+	}
+	for i := range results {
+		if !found[i] {
+			// Treated like a server error so that the call is retried
+			results[i].err = &googleapi.Error{Code: http.StatusBadGateway, Message: "no response for call in batch"}
+		}
+	}
+	return results, nil
+}
+
+func parseBatchPart(part io.Reader) batchResult {
+	response, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return batchResult{err: err}
+	}
+	defer response.Body.Close()
+	if err := googleapi.CheckResponse(response); err != nil {
+		return batchResult{err: err}
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return batchResult{err: err}
+	}
+	msg := &gmail.Message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return batchResult{err: err}
+	}
+	return batchResult{msg: msg}
+}
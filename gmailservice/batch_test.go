@@ -0,0 +1,123 @@
+package gmailservice
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// fakeBatchServer answers batch requests for messages "found-*" with a message, "missing-*"
+// with a 404 and leaves "dropped-*" out of the response altogether.
+func fakeBatchServer(t *testing.T, batches *int) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/batch/gmail/v1" {
+			t.Errorf("batch posted to %v", r.URL.Path)
+		}
+		mu.Lock()
+		*batches++
+		mu.Unlock()
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		writer := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			request, err := http.ReadRequest(bufio.NewReader(part))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			id := strings.TrimPrefix(request.URL.Path, "/gmail/v1/users/me/messages/")
+			if id == "" || id == request.URL.Path {
+				t.Errorf("unexpected call %v", request.URL)
+			}
+			if strings.HasPrefix(id, "dropped") {
+				continue
+			}
+			contentId := strings.Replace(part.Header.Get("Content-ID"), "<", "<response-", 1)
+			out, _ := writer.CreatePart(map[string][]string{
+				"Content-Type": {"application/http"},
+				"Content-ID":   {contentId},
+			})
+			if strings.HasPrefix(id, "missing") {
+				body := `{"error": {"code": 404, "message": "Not Found"}}`
+				fmt.Fprintf(out, "HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+				continue
+			}
+			body := fmt.Sprintf(`{"id": %q, "snippet": "hello"}`, id)
+			fmt.Fprintf(out, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+		writer.Close()
+	}))
+}
+
+func TestBatcher(t *testing.T) {
+	var batches int
+	server := fakeBatchServer(t, &batches)
+	defer server.Close()
+
+	b, err := NewBatcher(server.Client(), server.URL+"/gmail/v1/users/", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{"found-1", "missing-1", "found-2", "dropped-1", "found-3"}
+	type result struct {
+		snippet string
+		code    int
+	}
+	results := make([]result, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			msg, err := b.Get(id, "full")
+			if e, ok := err.(*googleapi.Error); ok {
+				results[i].code = e.Code
+				return
+			}
+			if err != nil {
+				t.Errorf("Get(%v) error = %v", id, err)
+				return
+			}
+			if msg.Id != id {
+				t.Errorf("Get(%v) returned message %v", id, msg.Id)
+			}
+			results[i].snippet = msg.Snippet
+		}(i, id)
+	}
+	wg.Wait()
+	b.Close()
+
+	want := []result{{"hello", 0}, {"", 404}, {"hello", 0}, {"", 502}, {"hello", 0}}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("Get(%v) = %+v, want %+v", ids[i], results[i], want[i])
+		}
+	}
+	if batches != 2 {
+		t.Errorf("sent %v batches, want 2", batches)
+	}
+	// Calls that are missing from the response are retried; ones that failed are not
+	if retryable, _, _ := classifyError(&googleapi.Error{Code: 502}, time.Now()); !retryable {
+		t.Error("missing response should be retryable")
+	}
+}
@@ -1,61 +1,128 @@
 package gmailservice
 
 import (
-	"encoding/base64"
+	"context"
 	"fmt"
 	"github.com/jonboulle/clockwork"
+	"github.com/oaktown/calliope/blob"
+	"github.com/oaktown/calliope/rules"
 	"github.com/oaktown/calliope/store"
 	"google.golang.org/api/gmail/v1"
-	"google.golang.org/api/googleapi"
 	"log"
 	"strings"
 	"time"
 )
 
-// number of seconds to wait before retrying (multiplied by number of retries)
-//    10s was too short for API rate limiting to recover,
-//   60s may be longer than needed
+// number of seconds to wait before the first retry (doubled for each retry after that).
+// 10s was too short for API rate limiting to recover, 60s may be longer than needed
 const RetryWaitInterval = 60
 
 type Downloader struct {
-	SearchChan     chan *gmail.Message
-	MessageChan    chan *store.Message
-	M2             chan *store.Message
-	WorkersQueue   chan bool
-	MaxWorkers     int
-	Svc            *gmail.Service
-	Options        Options
-	doList         func(*gmail.UsersMessagesListCall) (*gmail.ListMessagesResponse, error)
-	doGet          func(*Downloader, string) (*gmail.Message, error)
-	DoListLabels   func(*gmail.UsersLabelsListCall)
-	GmailToMessage func(gmail.Message, string, time.Time) (store.Message, error)
-	StartedAt      time.Time
-	clock          clockwork.Clock
+	SearchChan      chan *gmail.Message
+	MessageChan     chan *store.Message
+	M2              chan *store.Message
+	WorkersQueue    chan bool
+	MaxWorkers      int
+	Svc             *gmail.Service
+	Options         Options
+	doList          func(*gmail.UsersMessagesListCall) (*gmail.ListMessagesResponse, error)
+	doGet           func(*Downloader, string) (*gmail.Message, error)
+	doGetFormat     func(*Downloader, string, string) (*gmail.Message, error)
+	doListHistory   func(*gmail.UsersHistoryListCall) (*gmail.ListHistoryResponse, error)
+	doGetThread     func(*Downloader, string) (*gmail.Thread, error)
+	doGetAttachment func(*Downloader, string, string) (*gmail.MessagePartBody, error)
+	doGetRaw        func(*Downloader, string) (*gmail.Message, error)
+	DoListLabels    func(*gmail.UsersLabelsListCall)
+	GmailToMessage  func(gmail.Message, string, time.Time) (store.Message, error)
+	StartedAt       time.Time
+	clock           clockwork.Clock
+	// Cancelled to stop the download: no more messages are listed or fetched and retries are
+	// abandoned, but fetches that are under way are left to finish. Set by Download and friends.
+	ctx context.Context
+	// Shared by copies of the Downloader so all goroutines stay within the quota together
+	Limiter *Limiter
+	// Where to save attachments; if nil, only attachment metadata is saved
+	Blobs *blob.Store
+	// OnPage, if set, is called with each page of search results before they are downloaded.
+	// pageToken is the token the page was requested with and listed is the number of messages
+	// listed on earlier pages.
+	OnPage func(pageToken string, listed int64, ids []string)
+	// OnSkip, if set, is called for each message that is not saved because of Options.Rules.
+	OnSkip func(Skipped)
+	// OnFetched, if set, is called for each message downloaded from Gmail.
+	OnFetched func(id string)
+	// OnThrottled, if set, is called each time Gmail says we've gone over the quota.
+	OnThrottled func(method string)
+	// OnListFailed, if set, is called if a page of search results can't be listed, which stops
+	// the listing before every message has been found.
+	OnListFailed func(err error)
+	// Set by UseBatches when messages are fetched in batches
+	batcher *Batcher
+	// Label names by id, for rules that match labels by name
+	labelNames map[string]string
+}
+
+// Skipped describes a message that was downloaded but filtered out, and the rule that did it.
+type Skipped struct {
+	Id      string
+	Subject string
+	From    string
+	Rule    string
+	Reason  string
 }
 
 type Options struct {
-	Query          string
-	Limit          int64
-	InboxUrl       string
-	ExcludeHeaders map[string][]string
+	// Name of the account being downloaded, saved on every message
+	Account string
+	Query   string
+	// Stop listing once at least this many messages are listed; 0 lists everything
+	Limit    int64
+	InboxUrl string
+	// Messages that match these rules aren't saved; nil saves everything
+	Rules *rules.RuleSet
+	// Download the whole thread of every message found, instead of just the message
+	Threads bool
+	// Also download the original RFC 822 source of every message
+	Raw bool
+	// Only download headers (format=METADATA), to see what the rules would skip. Rules that
+	// match the body never match.
+	DryRun bool
+	// Number of times to try each API call before giving up (default DefaultMaxAttempts)
+	MaxAttempts int
+	// Used to resume an interrupted download: the page to start listing from, the number
+	// of messages listed before that page, and the ids on that page that hadn't been saved. If
+	// PendingIds isn't nil, the rest of the first page is skipped. RetryIds are messages on
+	// earlier pages that couldn't be saved, which are downloaded before listing.
+	PageToken  string
+	Listed     int64
+	PendingIds map[string]bool
+	RetryIds   []string
 }
 
 func New(svc *gmail.Service, options Options, maxWorkers int) Downloader {
 	search := make(chan *gmail.Message)
 	message := make(chan *store.Message)
 	workers := make(chan bool, maxWorkers)
+	clock := clockwork.NewRealClock()
 	return Downloader{
-		SearchChan:     search,
-		MessageChan:    message,
-		WorkersQueue:   workers,
-		MaxWorkers:     maxWorkers,
-		Svc:            svc,
-		Options:        options,
-		doList:         doList,
-		doGet:          doGet,
-		GmailToMessage: GmailToMessage,
-		StartedAt:      time.Now(),
-		clock:          clockwork.NewRealClock(),
+		SearchChan:      search,
+		MessageChan:     message,
+		WorkersQueue:    workers,
+		MaxWorkers:      maxWorkers,
+		Svc:             svc,
+		Options:         options,
+		doList:          doList,
+		doGet:           doGet,
+		doGetFormat:     doGetFormat,
+		doListHistory:   doListHistory,
+		doGetThread:     doGetThread,
+		doGetAttachment: doGetAttachment,
+		doGetRaw:        doGetRaw,
+		GmailToMessage:  GmailToMessage,
+		StartedAt:       time.Now(),
+		clock:           clock,
+		ctx:             context.Background(),
+		Limiter:         NewLimiter(clock, DefaultUnitsPerSecond),
 	}
 }
 
@@ -65,17 +132,37 @@ func (d Downloader) NoNewWorkers() {
 	}
 }
 
-// Download everything that is requested in calliope generic Message format
-func Download(d Downloader) []*store.Label {
+// Download everything that is requested in calliope generic Message format. Cancelling ctx stops
+// the download; MessageChan is still closed once the messages already being fetched are sent.
+func Download(ctx context.Context, d Downloader) []*store.Label {
 	labels := DownloadLabels(d)
-	go SearchMessages(d)
-	go DownloadFullMessages(d)
+	d.labelNames = labelNames(labels)
+	go SearchMessages(ctx, d)
+	go DownloadFullMessages(ctx, d)
 	return labels
 }
 
+// done returns a channel that's closed when the download is stopped (never, if there's no context).
+func (d *Downloader) done() <-chan struct{} {
+	if d.ctx == nil {
+		return nil
+	}
+	return d.ctx.Done()
+}
+
+// stopped says whether the download has been stopped.
+func (d *Downloader) stopped() bool {
+	return d.ctx != nil && d.ctx.Err() != nil
+}
+
 func DownloadLabels(d Downloader) []*store.Label {
 	request := d.Svc.Users.Labels.List("me")
-	response, err := request.Do()
+	var response *gmail.ListLabelsResponse
+	err := d.retry(MethodListLabels, func() error {
+		r, err := request.Do()
+		response = r
+		return err
+	})
 	if err != nil {
 		// TODO: need better error handling
 		log.Fatal("Error occurred downloading labels. Error: ", err)
@@ -91,20 +178,48 @@ func DownloadLabels(d Downloader) []*store.Label {
 	return labels
 }
 
-// SearchMessages gets list of message and thread IDs (not full message content)
-func SearchMessages(d Downloader) {
-	var totalMessages int64
-	totalMessages = 0
+func labelNames(labels []*store.Label) map[string]string {
+	names := make(map[string]string, len(labels))
+	for _, label := range labels {
+		names[label.Id] = label.Name
+	}
+	return names
+}
+
+// The most messages Gmail lists in a page
+const maxListPage = 500
+
+// SearchMessages gets list of message and thread IDs (not full message content). It stops listing
+// when ctx is cancelled.
+func SearchMessages(ctx context.Context, d Downloader) {
+	defer close(d.SearchChan)
+	d.ctx = ctx
+	totalMessages := d.Options.Listed
 	// Seems like MaxResults over 500 results in pages of 500; possibly subject to change?
 	request := d.Svc.Users.Messages.List("me")
-	if d.Options.Limit > 0 {
+	if d.Options.Limit > 0 && d.Options.Limit < maxListPage {
 		request = request.MaxResults(d.Options.Limit)
+	} else {
+		request = request.MaxResults(maxListPage)
 	}
 	if d.Options.Query != "" {
 		request = request.Q(d.Options.Query)
 	}
-	pageToken := ""
+	for _, id := range d.Options.RetryIds {
+		select {
+		case d.SearchChan <- &gmail.Message{Id: id}:
+		case <-d.done():
+			log.Println("Stopped retrying messages that couldn't be saved")
+			return
+		}
+	}
+	pageToken := d.Options.PageToken
+	pending := d.Options.PendingIds
 	for {
+		if d.stopped() {
+			log.Printf("Stopped listing messages after %v\n", totalMessages)
+			return
+		}
 		if pageToken != "" {
 			request = request.PageToken(pageToken)
 		}
@@ -112,29 +227,79 @@ func SearchMessages(d Downloader) {
 
 		if err != nil {
 			log.Printf("!!!!!!!!!!!!!!!!!!!!! Error calling search API. \n  Query: %v \n  Page token: %v\n  Search error: %v", d.Options.Query, pageToken, err)
+			if d.OnListFailed != nil && !d.stopped() {
+				d.OnListFailed(err)
+			}
 			return
 		}
+		results := response.Messages
+		if pending != nil {
+			// The rest of the page was saved before the download was interrupted
+			results = nil
+			for _, result := range response.Messages {
+				if pending[result.Id] {
+					results = append(results, result)
+				}
+			}
+			pending = nil
+		}
+		if d.OnPage != nil {
+			ids := make([]string, len(results))
+			for i, result := range results {
+				ids[i] = result.Id
+			}
+			d.OnPage(pageToken, totalMessages, ids)
+		}
 		pageToken = response.NextPageToken
-		for _, result := range response.Messages {
-			d.SearchChan <- result
+		for _, result := range results {
+			select {
+			case d.SearchChan <- result:
+			case <-d.done():
+				log.Printf("Stopped listing messages after %v\n", totalMessages)
+				return
+			}
 		}
 		totalMessages += int64(len(response.Messages))
 		log.Printf("NextPageToken: %v\nEstimate: %v\nMessages found this page: %v\n\n", pageToken, response.ResultSizeEstimate, len(response.Messages))
-		if pageToken == "" || totalMessages >= d.Options.Limit {
-			break
+		if pageToken == "" || d.Options.Limit > 0 && totalMessages >= d.Options.Limit {
+			return
+		}
+	}
+}
+
+// ListMessageIds lists the id of every message in the mailbox, not counting spam and trash.
+// Unlike SearchMessages it returns an error rather than a partial list if any page fails.
+func ListMessageIds(d Downloader) ([]string, error) {
+	var ids []string
+	request := d.Svc.Users.Messages.List("me").MaxResults(500)
+	pageToken := ""
+	for {
+		if pageToken != "" {
+			request = request.PageToken(pageToken)
+		}
+		response, err := d.doListWrapper(request)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range response.Messages {
+			ids = append(ids, result.Id)
+		}
+		log.Printf("Listed %v message ids\n", len(ids))
+		pageToken = response.NextPageToken
+		if pageToken == "" {
+			return ids, nil
 		}
 	}
-	close(d.SearchChan)
 }
 
 func (d *Downloader) doListWrapper(request *gmail.UsersMessagesListCall) (*gmail.ListMessagesResponse, error) {
 	var response *gmail.ListMessagesResponse
 	fn := func() error {
-		r, err := doList(request)
+		r, err := d.doList(request)
 		response = r
 		return err
 	}
-	err := d.tryThrice(fn)
+	err := d.retry(MethodListMessages, fn)
 	return response, err
 }
 
@@ -142,35 +307,64 @@ func doList(request *gmail.UsersMessagesListCall) (*gmail.ListMessagesResponse,
 	return request.Do()
 }
 
-func DownloadFullMessages(d Downloader) {
+// DownloadFullMessages fetches each message listed on SearchChan and sends it on MessageChan. Once
+// ctx is cancelled no more messages are fetched, and MessageChan is closed when the ones already
+// being fetched have been sent.
+func DownloadFullMessages(ctx context.Context, d Downloader) {
 	defer func() {
 		close(d.MessageChan)
 	}()
+	d.ctx = ctx
 	var i int
+	threads := make(map[string]*listedThread)
 	for searchResult := range d.SearchChan {
+		if d.stopped() {
+			break
+		}
+		if d.Options.Threads && searchResult.ThreadId != "" {
+			if thread := threads[searchResult.ThreadId]; thread != nil {
+				if errMsg := thread.add(searchResult.Id); errMsg != "" {
+					d.MessageChan <- d.partialMessageWithError(searchResult.Id, errMsg)
+				}
+				continue
+			}
+			thread := &listedThread{id: searchResult.ThreadId, ids: []string{searchResult.Id}}
+			threads[searchResult.ThreadId] = thread
+			d.WorkersQueue <- true
+			go downloadThread(d, thread)
+			continue
+		}
 		d.WorkersQueue <- true
 		i++
 		go DownloadFullMessage(d, searchResult.Id)
 	}
 	d.NoNewWorkers()
+	if d.batcher != nil {
+		d.batcher.Close()
+	}
 }
 
-func HasMatchingHeader(excludeHeaders map[string][]string, message gmail.Message) (string, string) {
-	// If header matches, returns first matching header; otherwise returns empty strings
-	for header, excludeValues := range excludeHeaders {
-		value := strings.ToLower(ExtractHeader(message, header))
-		if value == "" {
-			continue // No matching header
+// RulesMessage is what the download rules see of a message. labelNames maps label ids to names.
+func RulesMessage(msg gmail.Message, body string, labelNames map[string]string) rules.Message {
+	m := rules.Message{
+		Headers:  make(map[string][]string),
+		LabelIds: msg.LabelIds,
+		Size:     msg.SizeEstimate,
+		Date:     time.Unix(msg.InternalDate/1000, 0).UTC(),
+		Body:     body,
+	}
+	if msg.Payload != nil {
+		for _, header := range msg.Payload.Headers {
+			name := strings.ToLower(header.Name)
+			m.Headers[name] = append(m.Headers[name], header.Value)
 		}
-		for _, excludeValue := range excludeValues {
-			excludeValue = strings.ToLower(excludeValue)
-			if strings.Contains(value, excludeValue) {
-				return header, value
-			}
+	}
+	for _, id := range msg.LabelIds {
+		if name, ok := labelNames[id]; ok {
+			m.LabelNames = append(m.LabelNames, name)
 		}
 	}
-
-	return "", ""
+	return m
 }
 
 func DownloadFullMessage(d Downloader, id string) {
@@ -178,39 +372,81 @@ func DownloadFullMessage(d Downloader, id string) {
 		<-d.WorkersQueue
 	}()
 
-	partialMessageWithError := func(errMsg string) *store.Message {
-		return &store.Message{
-			Id:                  id,
-			DownloadedStartedAt: d.StartedAt,
-			Subject:             errMsg,
-		}
-	}
-
 	//TODO: Can't call this because it triggers oauth. need to be able to stub it out, too
-	gmailMsg, err := d.DoGetWrapper(id)
+	var gmailMsg *gmail.Message
+	var err error
+	if d.Options.DryRun {
+		gmailMsg, err = d.doGetFormatWrapper(id, "metadata")
+	} else {
+		gmailMsg, err = d.DoGetWrapper(id)
+	}
 	log.Println("Fetching message id:", id)
+	if err != nil && d.stopped() {
+		// Not saved, so it will be fetched again if the download is resumed
+		log.Printf("Gave up on message %v because the download was stopped: %v\n", id, err)
+		return
+	}
 	if err != nil {
 		errMsg := fmt.Sprintf("Unable to retrieve message %v: %v", id, err)
-		d.MessageChan <- partialMessageWithError(errMsg)
+		d.MessageChan <- d.partialMessageWithError(id, errMsg)
 		return
 	}
+	if d.OnFetched != nil {
+		d.OnFetched(id)
+	}
+	d.sendMessage(gmailMsg)
+}
+
+func (d Downloader) partialMessageWithError(id, errMsg string) *store.Message {
+	return &store.Message{
+		Id:                  id,
+		Account:             d.Options.Account,
+		DownloadedStartedAt: d.StartedAt,
+		Subject:             errMsg,
+		FetchError:          errMsg,
+		Content:             store.Content{Source: store.SourceGmail},
+	}
+}
+
+// sendMessage converts a downloaded message and sends it on to be saved, unless it is excluded.
+func (d Downloader) sendMessage(gmailMsg *gmail.Message) {
+	id := gmailMsg.Id
 	message, err := d.GmailToMessage(*gmailMsg, d.Options.InboxUrl, d.StartedAt)
 	if err != nil {
 		errMsg := fmt.Sprintf("Unable to decode message %v: %v", id, err)
-		d.MessageChan <- partialMessageWithError(errMsg)
+		d.MessageChan <- d.partialMessageWithError(id, errMsg)
 		return
 	}
-	header, value := HasMatchingHeader(d.Options.ExcludeHeaders, *gmailMsg)
-	if header == "" {
+	message.Account = d.Options.Account
+	match, skip := d.Options.Rules.Skip(RulesMessage(*gmailMsg, message.Body, d.labelNames))
+	if !skip {
+		if d.Blobs != nil && !d.Options.DryRun {
+			d.downloadAttachments(gmailMsg, &message)
+		}
+		if d.Options.Raw && !d.Options.DryRun {
+			if err := d.downloadRaw(&message); err != nil {
+				if d.stopped() {
+					log.Printf("Gave up on message %v because the download was stopped: %v\n", id, err)
+					return
+				}
+				// Sent as a failure so that it's reported and downloaded again by --resume or the next sync
+				errMsg := fmt.Sprintf("Unable to retrieve raw source of message %v: %v", id, err)
+				d.MessageChan <- d.partialMessageWithError(id, errMsg)
+				return
+			}
+		}
 		log.Printf("Downloaded message %v\n  Subject: %v\n", id, message.Subject)
 		d.MessageChan <- &message
 	} else {
-		log.Printf("Skipping message: \n  Subject: %s\n  Matching header: %v: %v\n", message.Subject, header, value)
+		log.Printf("Skipping message: \n  Subject: %s\n  Matching rule: %v (%v)\n", message.Subject, match.Rule, match.Reason)
+		if d.OnSkip != nil {
+			d.OnSkip(Skipped{Id: id, Subject: message.Subject, From: message.From, Rule: match.Rule, Reason: match.Reason})
+		}
 	}
 }
 
 func (d *Downloader) DoGetWrapper(id string) (*gmail.Message, error) {
-	// This method exists mostly so tryThrice doesn't have to be implemented twice:
+	// This method exists mostly so retry doesn't have to be implemented twice:
 	// once for list and once for message (since they have different signatures).
 	// Could have been part of DownloadFullMessage but that's long enough already.
 	// Almost the same as DoListWrapper except for the type in closure.
@@ -220,7 +456,7 @@ func (d *Downloader) DoGetWrapper(id string) (*gmail.Message, error) {
 		gmailMsg = r
 		return err
 	}
-	err := d.tryThrice(fn)
+	err := d.retry(MethodGetMessage, fn)
 	return gmailMsg, err
 }
 
@@ -228,17 +464,46 @@ func doGet(d *Downloader, id string) (*gmail.Message, error) {
 	return d.Svc.Users.Messages.Get("me", id).Do()
 }
 
-func BodyText(msg gmail.Message, mimeType string) string {
-	// TODO: We might want to see if there are other places the body can be located.
-	if msg.Payload.Body.Data != "" {
-		// TODO: when there is no body
-		body, _ := base64.URLEncoding.DecodeString(msg.Payload.Body.Data)
-		return string(body)
-	} else {
-		encodedBody := GetBodyPartByMimeType(msg, mimeType)
-		body, _ := base64.URLEncoding.DecodeString(encodedBody)
-		return string(body)
+// doGetFormatWrapper gets a message in a format other than full: "minimal" (just ids and labels)
+// or "metadata" (headers too, but no body).
+func (d *Downloader) doGetFormatWrapper(id, format string) (*gmail.Message, error) {
+	var gmailMsg *gmail.Message
+	fn := func() error {
+		r, err := d.doGetFormat(d, id, format)
+		gmailMsg = r
+		return err
+	}
+	err := d.retry(MethodGetMessage, fn)
+	return gmailMsg, err
+}
+
+func doGetFormat(d *Downloader, id, format string) (*gmail.Message, error) {
+	return d.Svc.Users.Messages.Get("me", id).Format(format).Do()
+}
+
+// downloadRaw adds the original source of the message.
+func (d Downloader) downloadRaw(message *store.Message) error {
+	var rawMsg *gmail.Message
+	err := d.retry(MethodGetMessage, func() error {
+		r, err := d.doGetRaw(&d, message.Id)
+		rawMsg = r
+		return err
+	})
+	if err != nil {
+		return err
 	}
+	message.Raw, err = DecodeBase64Url(rawMsg.Raw)
+	return err
+}
+
+func doGetRaw(d *Downloader, id string) (*gmail.Message, error) {
+	return d.Svc.Users.Messages.Get("me", id).Format("raw").Do()
+}
+
+// BodyText returns the first part of the message with the mime type, decoded to UTF-8.
+func BodyText(msg gmail.Message, mimeType string) (string, error) {
+	bodies, err := MessageBodies(msg)
+	return bodies.First(mimeType), err
 }
 
 func GetBodyPartByMimeType(msg gmail.Message, mimeType string) string {
@@ -246,24 +511,24 @@ func GetBodyPartByMimeType(msg gmail.Message, mimeType string) string {
 	return GetPartByMimeType(parts, mimeType)
 }
 
+// GetPartByMimeType returns the still encoded data of the first part with the mime type.
 func GetPartByMimeType(parts []*gmail.MessagePart, mimeType string) string {
 	for _, part := range parts {
 		if part.MimeType == mimeType {
 			return part.Body.Data
 		}
 		if strings.Contains(part.MimeType, "multipart") {
-			return GetPartByMimeType(part.Parts, mimeType)
+			if data := GetPartByMimeType(part.Parts, mimeType); data != "" {
+				return data
+			}
 		}
 	}
 	return ""
 }
 
+// ExtractHeader returns the first value of the header. Every value of every header is kept in
+// the message's Headers.
 func ExtractHeader(gmail gmail.Message, field string) string {
-	// TODO: For now, we just grab the first one, but really we should probably
-	// figure out which one is the significant one, or if they should be merged, etc.
-	// This probably doesn't apply to all headers, but some might repeat (or maybe
-	// that's only in original, and Gmail makes some decision about which one should
-	// win)
 	for _, header := range gmail.Payload.Headers {
 		if strings.ToLower(header.Name) == strings.ToLower(field) {
 			return header.Value
@@ -273,9 +538,13 @@ func ExtractHeader(gmail gmail.Message, field string) string {
 }
 
 func GmailToMessage(gmail gmail.Message, inboxUrl string, downloaded time.Time) (store.Message, error) {
-	// TODO: decode all of the fields, not just plain-text body
 	date := time.Unix(gmail.InternalDate/1000, 0)
-	body := BodyText(gmail, "text/plain")
+	parts, err := MessageParts(gmail)
+	if err != nil {
+		// Keep whatever could be decoded rather than losing the whole message
+		log.Printf("Unable to decode all of the body of message %v: %v\n", gmail.Id, err)
+	}
+	body := PartBodies(parts).PlainText()
 	message := store.Message{
 		Id:                  gmail.Id,
 		Url:                 fmt.Sprintf("%v#inbox/%v", inboxUrl, gmail.ThreadId),
@@ -283,36 +552,26 @@ func GmailToMessage(gmail gmail.Message, inboxUrl string, downloaded time.Time)
 		DownloadedStartedAt: downloaded,
 		To:                  ExtractHeader(gmail, "To"),
 		Cc:                  ExtractHeader(gmail, "Cc"),
+		Bcc:                 ExtractHeader(gmail, "Bcc"),
 		From:                ExtractHeader(gmail, "From"),
+		ReplyTo:             ExtractHeader(gmail, "Reply-To"),
 		Subject:             ExtractHeader(gmail, "Subject"),
 		Body:                body,
+		Attachments:         Attachments(gmail),
 		ThreadId:            gmail.ThreadId,
 		LabelIds:            gmail.LabelIds,
+		Starred:             store.HasLabel(gmail.LabelIds, "STARRED"),
+		Unread:              store.HasLabel(gmail.LabelIds, "UNREAD"),
 		Snippet:             gmail.Snippet,
-		Source:              gmail,
+		Content:             store.Content{Source: store.SourceGmail, Parts: parts},
 	}
-	return message, nil
-}
-
-func (d *Downloader) tryThrice(fn func() error) error {
-	var err error
-	for count := 1; count <= 3; count++ {
-		err = fn()
-		if err == nil {
-			break
-		}
-		code := err.(*googleapi.Error).Code
-		// If we have exceeded API usage, API will return 429 or 403.
-		if code == 429 || code == 403 {
-			if count == 3 {
-				return err
-			}
-			secs := time.Duration(count) * time.Second * RetryWaitInterval
-			d.clock.Sleep(secs)
-		} else {
-			// If it's something else, we don't know how to deal with it, so just pass on the error
-			return err
-		}
+	message.Addresses = ParseAddressHeaders(func(name string) string {
+		return ExtractHeader(gmail, name)
+	})
+	split := SplitBody(body)
+	message.NewContent, message.QuotedContent, message.Signature = split.New, split.Quoted, split.Signature
+	for _, header := range gmail.Payload.Headers {
+		message.Headers.Add(header.Name, header.Value)
 	}
-	return err
+	return message, nil
 }
@@ -1,6 +1,7 @@
 package gmailservice
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/jonboulle/clockwork"
 	"github.com/oaktown/calliope/store"
@@ -9,9 +10,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -45,7 +48,11 @@ func TestBodyText(t *testing.T) {
 	emailJson := getEmailJson()
 	gmailMsg, _ := JsonToGmail(emailJson)
 
-	if body := BodyText(gmailMsg); !strings.Contains(body, expectedBody) {
+	body, err := BodyText(gmailMsg, "text/plain")
+	if err != nil {
+		t.Errorf("Unexpected error decoding body: %v", err)
+	}
+	if !strings.Contains(body, expectedBody) {
 		t.Errorf("Body is incorrect. Should have been:\n\n%v\n\nInstead, got:\n\n%v\n\n", expectedBody, body)
 	}
 }
@@ -140,7 +147,7 @@ func TestDownloadFullMessages(t *testing.T) {
 		var wg sync.WaitGroup
 		wg.Add(1)
 		go func() {
-			DownloadFullMessages(downloader)
+			DownloadFullMessages(context.Background(), downloader)
 			wg.Done()
 		}()
 		wg.Add(1)
@@ -237,3 +244,180 @@ func TestDownloadFullMessages(t *testing.T) {
 		tt.verify()
 	}
 }
+
+func TestDownloadFullMessages_stopped(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	downloader := New(nil, Options{}, 2)
+	downloader.clock = fakeClock
+	var calls int32
+	downloader.doGet = func(d *Downloader, id string) (*gmail.Message, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, &googleapi.Error{Code: 429, Header: make(http.Header)}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go DownloadFullMessages(ctx, downloader)
+
+	downloader.SearchChan <- &gmail.Message{Id: "1"}
+	// Waiting to retry
+	fakeClock.BlockUntil(1)
+	cancel()
+	downloader.SearchChan <- &gmail.Message{Id: "2"}
+	close(downloader.SearchChan)
+
+	var messages []*store.Message
+	for m := range downloader.MessageChan {
+		messages = append(messages, m)
+	}
+	if len(messages) != 0 {
+		t.Errorf("got %v messages after the download was stopped, want none: %+v", len(messages), messages[0])
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("got %v calls to Gmail, want 1", calls)
+	}
+}
+
+func TestSearchMessages_noLimit(t *testing.T) {
+	svc, _ := gmail.New(http.DefaultClient)
+	downloader := New(svc, Options{}, 1)
+	pages := []*gmail.ListMessagesResponse{
+		{Messages: []*gmail.Message{{Id: "1"}, {Id: "2"}}, NextPageToken: "p2"},
+		{Messages: []*gmail.Message{{Id: "3"}}, NextPageToken: "p3"},
+		{Messages: []*gmail.Message{{Id: "4"}}},
+	}
+	downloader.doList = func(request *gmail.UsersMessagesListCall) (*gmail.ListMessagesResponse, error) {
+		page := pages[0]
+		pages = pages[1:]
+		return page, nil
+	}
+	go SearchMessages(context.Background(), downloader)
+
+	var ids []string
+	for m := range downloader.SearchChan {
+		ids = append(ids, m.Id)
+	}
+	if want := []string{"1", "2", "3", "4"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("listed %v, want every page: %v", ids, want)
+	}
+}
+
+func TestSearchMessages_resumed(t *testing.T) {
+	svc, _ := gmail.New(http.DefaultClient)
+	downloader := New(svc, Options{PageToken: "p2", Listed: 2, PendingIds: map[string]bool{"4": true}, RetryIds: []string{"1"}}, 1)
+	pages := []*gmail.ListMessagesResponse{
+		{Messages: []*gmail.Message{{Id: "3"}, {Id: "4"}, {Id: "5"}}, NextPageToken: "p3"},
+		{Messages: []*gmail.Message{{Id: "6"}}},
+	}
+	var tokens []string
+	downloader.doList = func(request *gmail.UsersMessagesListCall) (*gmail.ListMessagesResponse, error) {
+		page := pages[0]
+		pages = pages[1:]
+		return page, nil
+	}
+	var listed []int64
+	downloader.OnPage = func(pageToken string, n int64, ids []string) {
+		tokens = append(tokens, pageToken)
+		listed = append(listed, n)
+	}
+	go SearchMessages(context.Background(), downloader)
+
+	var ids []string
+	for m := range downloader.SearchChan {
+		ids = append(ids, m.Id)
+	}
+	if want := []string{"1", "4", "6"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("listed %v, want the id to retry, the pending id on the first page and everything after it: %v", ids, want)
+	}
+	if !reflect.DeepEqual(tokens, []string{"p2", "p3"}) || !reflect.DeepEqual(listed, []int64{2, 5}) {
+		t.Errorf("pages %v listed after %v, want [p2 p3] after [2 5]", tokens, listed)
+	}
+}
+
+func TestDownloadFullMessages_threadFailed(t *testing.T) {
+	downloader := New(nil, Options{Threads: true}, 2)
+	downloader.doGetThread = func(d *Downloader, id string) (*gmail.Thread, error) {
+		if id == "t1" {
+			return nil, &googleapi.Error{Code: 404, Header: make(http.Header)}
+		}
+		return &gmail.Thread{Id: id, Messages: []*gmail.Message{
+			{Id: "3", ThreadId: id, Payload: &gmail.MessagePart{}},
+			{Id: "4", ThreadId: id, Payload: &gmail.MessagePart{}},
+		}}, nil
+	}
+	go DownloadFullMessages(context.Background(), downloader)
+	go func() {
+		downloader.SearchChan <- &gmail.Message{Id: "1", ThreadId: "t1"}
+		downloader.SearchChan <- &gmail.Message{Id: "3", ThreadId: "t2"}
+		downloader.SearchChan <- &gmail.Message{Id: "2", ThreadId: "t1"}
+		close(downloader.SearchChan)
+	}()
+
+	failed := make(map[string]bool)
+	saved := make(map[string]bool)
+	for m := range downloader.MessageChan {
+		if m.FetchError != "" {
+			failed[m.Id] = true
+		} else {
+			saved[m.Id] = true
+		}
+	}
+	if want := map[string]bool{"1": true, "2": true}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed %v, want every listed message in the thread: %v", failed, want)
+	}
+	if want := map[string]bool{"3": true, "4": true}; !reflect.DeepEqual(saved, want) {
+		t.Errorf("downloaded %v, want %v", saved, want)
+	}
+}
+
+func TestDownloadFullMessages_rawFailed(t *testing.T) {
+	downloader := New(nil, Options{Raw: true}, 2)
+	downloader.doGet = func(d *Downloader, id string) (*gmail.Message, error) {
+		return &gmail.Message{Id: id, Payload: &gmail.MessagePart{}}, nil
+	}
+	downloader.doGetRaw = func(d *Downloader, id string) (*gmail.Message, error) {
+		if id == "1" {
+			return nil, &googleapi.Error{Code: 404, Header: make(http.Header)}
+		}
+		return &gmail.Message{Id: id, Raw: "U3ViamVjdDogSGkNCg0KSGkNCg"}, nil
+	}
+	go DownloadFullMessages(context.Background(), downloader)
+	go func() {
+		downloader.SearchChan <- &gmail.Message{Id: "1"}
+		downloader.SearchChan <- &gmail.Message{Id: "2"}
+		close(downloader.SearchChan)
+	}()
+
+	messages := make(map[string]*store.Message)
+	for m := range downloader.MessageChan {
+		messages[m.Id] = m
+	}
+	if m := messages["1"]; m == nil || m.FetchError == "" {
+		t.Errorf("message 1 = %+v, want it sent as a failure", m)
+	}
+	if m := messages["2"]; m == nil || m.FetchError != "" || string(m.Raw) != "Subject: Hi\r\n\r\nHi\r\n" {
+		t.Errorf("message 2 = %+v, want it with its raw source", m)
+	}
+}
+
+func TestSearchMessages_listFailed(t *testing.T) {
+	svc, _ := gmail.New(http.DefaultClient)
+	downloader := New(svc, Options{MaxAttempts: 1}, 1)
+	calls := 0
+	downloader.doList = func(request *gmail.UsersMessagesListCall) (*gmail.ListMessagesResponse, error) {
+		calls++
+		if calls > 1 {
+			return nil, &googleapi.Error{Code: 500, Header: make(http.Header)}
+		}
+		return &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "1"}}, NextPageToken: "p2"}, nil
+	}
+	var listErr error
+	downloader.OnListFailed = func(err error) { listErr = err }
+	go SearchMessages(context.Background(), downloader)
+
+	var ids []string
+	for m := range downloader.SearchChan {
+		ids = append(ids, m.Id)
+	}
+	if !reflect.DeepEqual(ids, []string{"1"}) || listErr == nil {
+		t.Errorf("listed %v with error %v, want [1] and the error listing the second page", ids, listErr)
+	}
+}
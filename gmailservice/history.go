@@ -0,0 +1,186 @@
+package gmailservice
+
+import (
+	"context"
+	"errors"
+	"github.com/oaktown/calliope/store"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	"log"
+	"sort"
+)
+
+// ErrHistoryExpired is returned by ListHistory when Gmail no longer has history going back to
+// the requested id (history is typically kept for about a week). Callers should fall back to
+// a full download.
+var ErrHistoryExpired = errors.New("history id is too old; a full download is required")
+
+// HistoryChanges is everything that happened to the mailbox since a history id, folded down
+// so that each message appears at most once (e.g. a message added then deleted is only deleted).
+type HistoryChanges struct {
+	HistoryId     uint64
+	Added         []string
+	Deleted       []string
+	LabelsAdded   map[string][]string
+	LabelsRemoved map[string][]string
+}
+
+// Sync is the incremental counterpart of Download: only messages added since startHistoryId
+// are fetched. Deletions and label changes are returned for the caller to apply to the store.
+// Cancelling ctx stops the download as it does for Download.
+func Sync(ctx context.Context, d Downloader, startHistoryId uint64) ([]*store.Label, HistoryChanges, error) {
+	changes, err := ListHistory(d, startHistoryId)
+	if err != nil {
+		return nil, changes, err
+	}
+	labels := DownloadLabels(d)
+	d.labelNames = labelNames(labels)
+	go QueueMessages(ctx, d, changes.Added)
+	go DownloadFullMessages(ctx, d)
+	return labels, changes, nil
+}
+
+// GetProfile returns the account's email address and current history id.
+func GetProfile(d Downloader) (*gmail.Profile, error) {
+	var profile *gmail.Profile
+	err := d.retry(MethodGetProfile, func() error {
+		p, err := d.Svc.Users.GetProfile("me").Do()
+		profile = p
+		return err
+	})
+	return profile, err
+}
+
+// QueueMessages feeds message ids into the download pipeline in place of SearchMessages.
+func QueueMessages(ctx context.Context, d Downloader, ids []string) {
+	defer close(d.SearchChan)
+	for _, id := range ids {
+		select {
+		case d.SearchChan <- &gmail.Message{Id: id}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func ListHistory(d Downloader, startHistoryId uint64) (HistoryChanges, error) {
+	var records []*gmail.History
+	changes := HistoryChanges{HistoryId: startHistoryId}
+	request := d.Svc.Users.History.List("me").
+		StartHistoryId(startHistoryId).
+		HistoryTypes("messageAdded", "messageDeleted", "labelAdded", "labelRemoved")
+	pageToken := ""
+	for {
+		if pageToken != "" {
+			request = request.PageToken(pageToken)
+		}
+		response, err := d.doListHistoryWrapper(request)
+		if err != nil {
+			if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+				return changes, ErrHistoryExpired
+			}
+			log.Printf("Error calling history API. \n  Start history id: %v \n  Page token: %v\n  Error: %v", startHistoryId, pageToken, err)
+			return changes, err
+		}
+		records = append(records, response.History...)
+		if response.HistoryId > changes.HistoryId {
+			changes.HistoryId = response.HistoryId
+		}
+		pageToken = response.NextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+	foldHistory(records, &changes)
+	log.Printf("History since %v: %v added, %v deleted, %v with labels added, %v with labels removed\n",
+		startHistoryId, len(changes.Added), len(changes.Deleted), len(changes.LabelsAdded), len(changes.LabelsRemoved))
+	return changes, nil
+}
+
+func (d *Downloader) doListHistoryWrapper(request *gmail.UsersHistoryListCall) (*gmail.ListHistoryResponse, error) {
+	var response *gmail.ListHistoryResponse
+	fn := func() error {
+		r, err := d.doListHistory(request)
+		response = r
+		return err
+	}
+	err := d.retry(MethodListHistory, fn)
+	return response, err
+}
+
+func doListHistory(request *gmail.UsersHistoryListCall) (*gmail.ListHistoryResponse, error) {
+	return request.Do()
+}
+
+// foldHistory applies history records in order. Label changes on newly added messages are
+// dropped because the full download will pick up their current labels anyway.
+func foldHistory(records []*gmail.History, changes *HistoryChanges) {
+	added := make(map[string]bool)
+	deleted := make(map[string]bool)
+	labelsAdded := make(map[string]map[string]bool)
+	labelsRemoved := make(map[string]map[string]bool)
+
+	setLabels := func(labels map[string]map[string]bool, opposite map[string]map[string]bool, id string, labelIds []string) {
+		if added[id] || deleted[id] {
+			return
+		}
+		if labels[id] == nil {
+			labels[id] = make(map[string]bool)
+		}
+		for _, label := range labelIds {
+			labels[id][label] = true
+			delete(opposite[id], label)
+		}
+	}
+
+	for _, record := range records {
+		for _, m := range record.MessagesAdded {
+			id := m.Message.Id
+			added[id] = true
+			delete(deleted, id)
+			delete(labelsAdded, id)
+			delete(labelsRemoved, id)
+		}
+		for _, m := range record.MessagesDeleted {
+			id := m.Message.Id
+			if added[id] {
+				// Added and deleted within the same window; never made it into the store.
+				delete(added, id)
+			} else {
+				deleted[id] = true
+			}
+			delete(labelsAdded, id)
+			delete(labelsRemoved, id)
+		}
+		for _, l := range record.LabelsAdded {
+			setLabels(labelsAdded, labelsRemoved, l.Message.Id, l.LabelIds)
+		}
+		for _, l := range record.LabelsRemoved {
+			setLabels(labelsRemoved, labelsAdded, l.Message.Id, l.LabelIds)
+		}
+	}
+
+	changes.Added = sortedKeys(added)
+	changes.Deleted = sortedKeys(deleted)
+	changes.LabelsAdded = flattenLabels(labelsAdded)
+	changes.LabelsRemoved = flattenLabels(labelsRemoved)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func flattenLabels(labels map[string]map[string]bool) map[string][]string {
+	flattened := make(map[string][]string)
+	for id, set := range labels {
+		if len(set) > 0 {
+			flattened[id] = sortedKeys(set)
+		}
+	}
+	return flattened
+}
@@ -0,0 +1,86 @@
+package gmailservice
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func Test_foldHistory(t *testing.T) {
+	msg := func(id string) *gmail.Message {
+		return &gmail.Message{Id: id}
+	}
+	added := func(id string) *gmail.History {
+		return &gmail.History{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: msg(id)}}}
+	}
+	deleted := func(id string) *gmail.History {
+		return &gmail.History{MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: msg(id)}}}
+	}
+	labelAdded := func(id string, labels ...string) *gmail.History {
+		return &gmail.History{LabelsAdded: []*gmail.HistoryLabelAdded{{Message: msg(id), LabelIds: labels}}}
+	}
+	labelRemoved := func(id string, labels ...string) *gmail.History {
+		return &gmail.History{LabelsRemoved: []*gmail.HistoryLabelRemoved{{Message: msg(id), LabelIds: labels}}}
+	}
+
+	tests := []struct {
+		name    string
+		records []*gmail.History
+		want    HistoryChanges
+	}{
+		{
+			name:    "Added and deleted",
+			records: []*gmail.History{added("b"), added("a"), deleted("c")},
+			want: HistoryChanges{
+				Added:         []string{"a", "b"},
+				Deleted:       []string{"c"},
+				LabelsAdded:   map[string][]string{},
+				LabelsRemoved: map[string][]string{},
+			},
+		},
+		{
+			name:    "Added then deleted is dropped",
+			records: []*gmail.History{added("a"), labelAdded("a", "STARRED"), deleted("a")},
+			want: HistoryChanges{
+				Added:         []string{},
+				Deleted:       []string{},
+				LabelsAdded:   map[string][]string{},
+				LabelsRemoved: map[string][]string{},
+			},
+		},
+		{
+			name: "Label changes cancel out",
+			records: []*gmail.History{
+				labelAdded("a", "STARRED", "INBOX"),
+				labelRemoved("a", "STARRED"),
+				labelRemoved("b", "UNREAD"),
+			},
+			want: HistoryChanges{
+				Added:         []string{},
+				Deleted:       []string{},
+				LabelsAdded:   map[string][]string{"a": {"INBOX"}},
+				LabelsRemoved: map[string][]string{"a": {"STARRED"}, "b": {"UNREAD"}},
+			},
+		},
+		{
+			name:    "Label changes on added messages are ignored",
+			records: []*gmail.History{added("a"), labelRemoved("a", "UNREAD")},
+			want: HistoryChanges{
+				Added:         []string{"a"},
+				Deleted:       []string{},
+				LabelsAdded:   map[string][]string{},
+				LabelsRemoved: map[string][]string{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got HistoryChanges
+			foldHistory(tt.records, &got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("foldHistory() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
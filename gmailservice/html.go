@@ -0,0 +1,255 @@
+package gmailservice
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Elements whose content isn't part of the text
+var skippedElements = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Object:   true,
+	atom.Iframe:   true,
+}
+
+// The line breaks around block elements: 2 for those that are paragraphs of their own, 1 for
+// the rest. Everything else is inline.
+var blockBreaks = map[atom.Atom]int{
+	atom.P: 2, atom.H1: 2, atom.H2: 2, atom.H3: 2, atom.H4: 2, atom.H5: 2, atom.H6: 2,
+	atom.Blockquote: 2, atom.Hr: 2,
+	atom.Div: 1, atom.Section: 1, atom.Article: 1, atom.Header: 1, atom.Footer: 1, atom.Nav: 1,
+	atom.Aside: 1, atom.Main: 1, atom.Center: 1, atom.Form: 1, atom.Fieldset: 1, atom.Address: 1,
+	atom.Figure: 1, atom.Figcaption: 1, atom.Details: 1, atom.Summary: 1, atom.Pre: 1,
+	atom.Table: 1, atom.Caption: 1, atom.Tr: 1, atom.Ul: 1, atom.Ol: 1, atom.Li: 1,
+	atom.Dl: 1, atom.Dt: 1, atom.Dd: 1,
+}
+
+// Characters that newsletters pad their preview text with so that it isn't followed by the
+// start of the body
+var invisible = strings.NewReplacer("\u200b", "", "\u200c", "", "\u200d", "", "\u2060", "", "\ufeff", "", "\u034f", "", "\u00ad", "")
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// HtmlToText makes a plain text rendition of an HTML body, for searching messages that don't
+// have a text/plain alternative. Scripts, styles and hidden elements are left out. Paragraphs,
+// list items and table rows go on lines of their own (with table cells separated by tabs), list
+// items are marked with "-" or their number, quotes are marked with ">", and links are followed
+// by their URL in brackets.
+func HtmlToText(source string) string {
+	doc, err := html.Parse(strings.NewReader(source))
+	if err != nil {
+		// The parser copes with any input, so this only happens if reading a string fails
+		return ""
+	}
+	w := &textWriter{}
+	w.walk(doc, false)
+	lines := strings.Split(w.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.Trim(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"), "\n")
+}
+
+type list struct {
+	ordered bool
+	count   int
+}
+
+type textWriter struct {
+	b strings.Builder
+	// Line breaks to write before the next text
+	breaks int
+	// What to write between the last text and the next on the same line: " ", "\t" or ""
+	separator string
+	// Set after a list item's marker, so that a block at the start of the item doesn't move its
+	// text onto the next line
+	marked bool
+	lists  []list
+	quotes int
+}
+
+func (w *textWriter) lineBreak(n int) {
+	if n == 0 || w.marked {
+		return
+	}
+	if n > w.breaks {
+		w.breaks = n
+	}
+	w.separator = ""
+}
+
+func (w *textWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	prefix := strings.Repeat("> ", w.quotes)
+	switch {
+	case w.b.Len() == 0:
+		w.b.WriteString(prefix)
+	case w.breaks > 0:
+		for i := 0; i < w.breaks; i++ {
+			w.b.WriteString("\n")
+			if i < w.breaks-1 {
+				w.b.WriteString(strings.TrimSpace(prefix))
+			}
+		}
+		w.b.WriteString(prefix)
+	default:
+		w.b.WriteString(w.separator)
+	}
+	w.b.WriteString(s)
+	w.breaks = 0
+	w.separator = ""
+	w.marked = false
+}
+
+// text writes the content of a text node. Outside of <pre>, runs of whitespace are a single space.
+func (w *textWriter) text(s string, pre bool) {
+	s = invisible.Replace(s)
+	if pre {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				w.breaks++
+				w.separator = ""
+			}
+			w.write(strings.TrimRight(line, " \t\r"))
+		}
+		return
+	}
+	fields := strings.Fields(s)
+	if len(fields) > 0 && !strings.HasPrefix(s, fields[0]) && w.separator == "" {
+		w.separator = " "
+	}
+	w.write(strings.Join(fields, " "))
+	if len(fields) == 0 && s != "" || len(fields) > 0 && !strings.HasSuffix(s, fields[len(fields)-1]) {
+		if w.separator == "" {
+			w.separator = " "
+		}
+	}
+}
+
+func (w *textWriter) walk(n *html.Node, pre bool) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data, pre)
+		return
+	case html.ElementNode:
+		if skippedElements[n.DataAtom] || hidden(n) {
+			return
+		}
+	case html.DocumentNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		w.breaks++
+		w.separator = ""
+		return
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			w.text(" "+alt+" ", false)
+		}
+		return
+	case atom.Td, atom.Th:
+		for sibling := n.PrevSibling; sibling != nil; sibling = sibling.PrevSibling {
+			if sibling.DataAtom == atom.Td || sibling.DataAtom == atom.Th {
+				w.separator = "\t"
+				break
+			}
+		}
+	}
+
+	breaks := blockBreaks[n.DataAtom]
+	if breaks > 1 && len(w.lists) > 0 {
+		// Keep list items together
+		breaks = 1
+	}
+	w.lineBreak(breaks)
+	start := w.b.Len()
+	switch n.DataAtom {
+	case atom.Pre:
+		pre = true
+	case atom.Blockquote:
+		w.quotes++
+		defer func() { w.quotes-- }()
+	case atom.Ul, atom.Ol:
+		w.lists = append(w.lists, list{ordered: n.DataAtom == atom.Ol})
+		defer func() { w.lists = w.lists[:len(w.lists)-1] }()
+	case atom.Li:
+		w.write(w.listMarker())
+		w.separator = " "
+		w.marked = true
+	}
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		w.walk(child, pre)
+	}
+
+	if n.DataAtom == atom.A {
+		w.link(attr(n, "href"), w.b.String()[start:])
+	}
+	w.marked = false
+	w.lineBreak(breaks)
+}
+
+// listMarker returns the marker for the next item of the innermost list, indented by how deeply
+// the list is nested.
+func (w *textWriter) listMarker() string {
+	if len(w.lists) == 0 {
+		return "-"
+	}
+	l := &w.lists[len(w.lists)-1]
+	l.count++
+	indent := strings.Repeat("  ", len(w.lists)-1)
+	if l.ordered {
+		return indent + strconv.Itoa(l.count) + "."
+	}
+	return indent + "-"
+}
+
+// link writes a link's URL after its text, unless the text is the URL or there is no text (which
+// is usually a tracking image).
+func (w *textWriter) link(href, text string) {
+	href = strings.TrimSpace(href)
+	lower := strings.ToLower(href)
+	if !strings.HasPrefix(lower, "http:") && !strings.HasPrefix(lower, "https:") && !strings.HasPrefix(lower, "mailto:") {
+		return
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || text == href || "mailto:"+text == href {
+		return
+	}
+	w.separator = " "
+	w.write("(" + href + ")")
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// hidden reports whether an element isn't shown, as with the preview text at the top of many
+// newsletters.
+func hidden(n *html.Node) bool {
+	for _, a := range n.Attr {
+		if a.Key == "hidden" {
+			return true
+		}
+	}
+	style := strings.ToLower(strings.Replace(attr(n, "style"), " ", "", -1))
+	return strings.Contains(style, "display:none")
+}
@@ -0,0 +1,73 @@
+package gmailservice
+
+import "testing"
+
+func TestHtmlToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			"paragraphs",
+			`<html><head><title>Newsletter</title><style>p { color: red }</style></head>
+<body><p>Hello  <b>Amy</b>,</p><p>Line one<br>line&nbsp;two</p><script>track()</script></body></html>`,
+			"Hello Amy,\n\nLine one\nline two",
+		},
+		{
+			"hidden preview text",
+			`<div style="display: none; max-height: 0">Preview&#8204; &#8204;</div><div>Body</div>`,
+			"Body",
+		},
+		{
+			"links",
+			`<p>Read <a href="https://example.com/post">the post</a>, mail <a href="mailto:amy@example.com">amy@example.com</a>
+or see <a href="https://example.com">https://example.com</a>.<a href="https://example.com/open"><img src="x.gif"></a></p>`,
+			"Read the post (https://example.com/post), mail amy@example.com or see https://example.com.",
+		},
+		{
+			"lists",
+			`<ul><li>Eggs</li><li><p>Milk</p><ol><li>Whole</li><li>Skim</li></ol></li></ul>`,
+			"- Eggs\n- Milk\n  1. Whole\n  2. Skim",
+		},
+		{
+			"tables",
+			`<table><tr><th>Item</th><th>Price</th></tr><tr><td>Tea</td><td>$2</td></tr></table>`,
+			"Item\tPrice\nTea\t$2",
+		},
+		{
+			"quotes",
+			`<div>Sounds good</div><blockquote><div>Lunch?</div><div>Amy</div></blockquote>`,
+			"Sounds good\n>\n> Lunch?\n> Amy",
+		},
+		{
+			"pre",
+			`<pre>  indented
+line</pre>`,
+			"  indented\nline",
+		},
+		{"images", `<img alt="Calliope logo"> Welcome`, "Calliope logo Welcome"},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		if got := HtmlToText(test.html); got != test.want {
+			t.Errorf("%v: HtmlToText = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBodies_PlainText(t *testing.T) {
+	tests := []struct {
+		bodies Bodies
+		want   string
+	}{
+		{Bodies{Text: []string{"Plain", "Text"}, Html: []string{"<p>Html</p>"}}, "Plain\n\nText"},
+		{Bodies{Html: []string{"<p>Html</p>"}}, "Html"},
+		{Bodies{}, ""},
+	}
+	for _, test := range tests {
+		if got := test.bodies.PlainText(); got != test.want {
+			t.Errorf("PlainText of %+v = %q, want %q", test.bodies, got, test.want)
+		}
+	}
+}
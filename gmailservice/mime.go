@@ -0,0 +1,388 @@
+package gmailservice
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/oaktown/calliope/store"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+	"google.golang.org/api/gmail/v1"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+)
+
+// Bodies holds every text and HTML alternative in a message, decoded to UTF-8, in the order
+// they appear in the message.
+type Bodies struct {
+	Text []string
+	Html []string
+}
+
+// First returns the first alternative of the mime type ("text/plain" or "text/html"), or "".
+func (b Bodies) First(mimeType string) string {
+	var alternatives []string
+	switch mimeType {
+	case "text/plain":
+		alternatives = b.Text
+	case "text/html":
+		alternatives = b.Html
+	}
+	if len(alternatives) == 0 {
+		return ""
+	}
+	return alternatives[0]
+}
+
+// PlainText returns the text/plain alternatives, or if there aren't any, text made from the
+// text/html ones (see HtmlToText).
+func (b Bodies) PlainText() string {
+	if len(b.Text) > 0 {
+		return strings.Join(b.Text, "\n\n")
+	}
+	var texts []string
+	for _, html := range b.Html {
+		if text := HtmlToText(html); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+func (b *Bodies) add(mimeType, content string) {
+	switch mimeType {
+	case "text/plain":
+		b.Text = append(b.Text, content)
+	case "text/html":
+		b.Html = append(b.Html, content)
+	}
+}
+
+// WalkParts calls visit for the part and every part nested in it, depth first.
+func WalkParts(part *gmail.MessagePart, visit func(*gmail.MessagePart)) {
+	if part == nil {
+		return
+	}
+	visit(part)
+	for _, child := range part.Parts {
+		WalkParts(child, visit)
+	}
+}
+
+// PartBodies returns the text/plain and text/html parts that aren't attachments.
+func PartBodies(parts []store.Part) Bodies {
+	var bodies Bodies
+	for _, part := range parts {
+		if part.Filename == "" && part.Text != "" {
+			bodies.add(part.MimeType, part.Text)
+		}
+	}
+	return bodies
+}
+
+// MessageBodies decodes every text/plain and text/html part of the message that isn't an
+// attachment (see MessageParts).
+func MessageBodies(msg gmail.Message) (Bodies, error) {
+	parts, err := MessageParts(msg)
+	return PartBodies(parts), err
+}
+
+// MessageParts returns the parts of the message's body that aren't made of other parts, with
+// the text/plain and text/html ones that aren't attachments decoded. Parts in a charset that
+// can't be converted are kept as they are, and parts that can't be decoded at all are left
+// without text; the first error is returned along with the parts.
+func MessageParts(msg gmail.Message) ([]store.Part, error) {
+	var parts []store.Part
+	var firstErr error
+	WalkParts(msg.Payload, func(part *gmail.MessagePart) {
+		if len(part.Parts) > 0 || strings.HasPrefix(strings.ToLower(part.MimeType), "multipart/") {
+			return
+		}
+		p := store.Part{MimeType: strings.ToLower(part.MimeType), Filename: part.Filename}
+		if part.Body != nil {
+			p.Size = part.Body.Size
+		}
+		if part.Filename == "" && part.Body != nil && part.Body.Data != "" && (p.MimeType == "text/plain" || p.MimeType == "text/html") {
+			content, err := DecodePart(part)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("part %v (%v): %v", part.PartId, part.MimeType, err)
+			}
+			p.Text = content
+		}
+		parts = append(parts, p)
+	})
+	return parts, firstErr
+}
+
+// DecodePart returns the content of a part as UTF-8. Gmail has already undone the
+// Content-Transfer-Encoding, but the content is still in the part's original charset.
+func DecodePart(part *gmail.MessagePart) (string, error) {
+	data, err := DecodeBase64Url(part.Body.Data)
+	if err != nil {
+		return "", err
+	}
+	_, params, _ := mime.ParseMediaType(partHeader(part, "Content-Type"))
+	return DecodeCharset(params["charset"], data)
+}
+
+func partHeader(part *gmail.MessagePart, name string) string {
+	for _, header := range part.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// DecodeBase64Url decodes Gmail's base64url data, with or without padding.
+func DecodeBase64Url(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// DecodeTransferEncoding undoes a Content-Transfer-Encoding of a part of a raw message.
+func DecodeTransferEncoding(transferEncoding string, data []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+	case "base64":
+		// Line breaks (and sometimes other junk) are allowed in base64 bodies
+		cleaned := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, string(data))
+		return base64.StdEncoding.DecodeString(cleaned)
+	default:
+		// 7bit, 8bit, binary or nothing at all
+		return data, nil
+	}
+}
+
+var charsets = map[string]encoding.Encoding{
+	"iso-8859-1":   charmap.ISO8859_1,
+	"latin1":       charmap.ISO8859_1,
+	"iso-8859-2":   charmap.ISO8859_2,
+	"latin2":       charmap.ISO8859_2,
+	"iso-8859-3":   charmap.ISO8859_3,
+	"iso-8859-4":   charmap.ISO8859_4,
+	"iso-8859-5":   charmap.ISO8859_5,
+	"iso-8859-6":   charmap.ISO8859_6,
+	"iso-8859-7":   charmap.ISO8859_7,
+	"iso-8859-8":   charmap.ISO8859_8,
+	"iso-8859-8-i": charmap.ISO8859_8,
+	"iso-8859-9":   charmap.ISO8859_9,
+	"iso-8859-10":  charmap.ISO8859_10,
+	"iso-8859-13":  charmap.ISO8859_13,
+	"iso-8859-14":  charmap.ISO8859_14,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"iso-8859-16":  charmap.ISO8859_16,
+	"windows-874":  charmap.Windows874,
+	"windows-1250": charmap.Windows1250,
+	"windows-1251": charmap.Windows1251,
+	"windows-1252": charmap.Windows1252,
+	"windows-1253": charmap.Windows1253,
+	"windows-1254": charmap.Windows1254,
+	"windows-1255": charmap.Windows1255,
+	"windows-1256": charmap.Windows1256,
+	"windows-1257": charmap.Windows1257,
+	"windows-1258": charmap.Windows1258,
+	"koi8-r":       charmap.KOI8R,
+	"koi8-u":       charmap.KOI8U,
+	"macintosh":    charmap.Macintosh,
+	"ibm437":       charmap.CodePage437,
+	"ibm850":       charmap.CodePage850,
+	"shift_jis":    japanese.ShiftJIS,
+	"shift-jis":    japanese.ShiftJIS,
+	"sjis":         japanese.ShiftJIS,
+	"x-sjis":       japanese.ShiftJIS,
+	"ms_kanji":     japanese.ShiftJIS,
+	"windows-31j":  japanese.ShiftJIS,
+	"cp932":        japanese.ShiftJIS,
+	"euc-jp":       japanese.EUCJP,
+	"iso-2022-jp":  japanese.ISO2022JP,
+	// GBK is a superset of GB2312, and mail that says it's GB2312 often uses GBK characters
+	"gb2312":         simplifiedchinese.GBK,
+	"euc-cn":         simplifiedchinese.GBK,
+	"gbk":            simplifiedchinese.GBK,
+	"x-gbk":          simplifiedchinese.GBK,
+	"cp936":          simplifiedchinese.GBK,
+	"gb18030":        simplifiedchinese.GB18030,
+	"hz-gb-2312":     simplifiedchinese.HZGB2312,
+	"big5":           traditionalchinese.Big5,
+	"x-big5":         traditionalchinese.Big5,
+	"big5-hkscs":     traditionalchinese.Big5,
+	"cp950":          traditionalchinese.Big5,
+	"euc-kr":         korean.EUCKR,
+	"ks_c_5601-1987": korean.EUCKR,
+	"ks_c_5601":      korean.EUCKR,
+	"cp949":          korean.EUCKR,
+	"utf-16":         unicode.UTF16(unicode.BigEndian, unicode.UseBOM),
+	"utf-16be":       unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"utf-16le":       unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+}
+
+func charsetEncoding(charset string) (encoding.Encoding, bool) {
+	name := strings.ToLower(strings.Trim(charset, "\" "))
+	if e, ok := charsets[name]; ok {
+		return e, true
+	}
+	// Common spellings without the dash, e.g. iso8859-1, cp1252, windows1252
+	for _, prefix := range []string{"iso8859-", "iso8859_", "iso_8859-"} {
+		if strings.HasPrefix(name, prefix) {
+			e, ok := charsets["iso-8859-"+strings.TrimPrefix(name, prefix)]
+			return e, ok
+		}
+	}
+	for _, prefix := range []string{"cp", "windows"} {
+		if strings.HasPrefix(name, prefix+"125") {
+			e, ok := charsets["windows-"+strings.TrimPrefix(name, prefix)]
+			return e, ok
+		}
+	}
+	return nil, false
+}
+
+// DecodeCharset converts text in the named charset to UTF-8. Text that claims to be ASCII or
+// UTF-8 but isn't valid UTF-8 is assumed to be Windows-1252, which is what it usually turns out
+// to be. Unknown charsets are returned unconverted along with an error.
+func DecodeCharset(charset string, data []byte) (string, error) {
+	name := strings.ToLower(strings.Trim(charset, "\" "))
+	switch name {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		if utf8.Valid(data) {
+			return string(data), nil
+		}
+		name = "windows-1252"
+	}
+	e, ok := charsetEncoding(name)
+	if !ok {
+		return string(data), fmt.Errorf("unsupported charset %q", charset)
+	}
+	decoded, err := e.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data), err
+	}
+	return string(decoded), nil
+}
+
+// CharsetReader converts input in the named charset to UTF-8. It can be used as the
+// CharsetReader of a mime.WordDecoder to decode RFC 2047 headers.
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	}
+	e, ok := charsetEncoding(charset)
+	if !ok {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return e.NewDecoder().Reader(input), nil
+}
+
+// RawMessageBodies decodes every text/plain and text/html part of a raw RFC 822 message that
+// isn't an attachment (see RawMessageParts).
+func RawMessageBodies(r io.Reader) (Bodies, error) {
+	parts, err := RawMessageParts(r)
+	return PartBodies(parts), err
+}
+
+// RawMessageParts returns the parts of the body of a raw RFC 822 message that aren't made of
+// other parts, with the text/plain and text/html ones that aren't attachments decoded: the
+// Content-Transfer-Encoding is undone and charsets are converted to UTF-8. The first error is
+// returned along with whatever could be read.
+func RawMessageParts(r io.Reader) ([]store.Part, error) {
+	return WalkRawMessage(r, nil)
+}
+
+// WalkRawMessage returns the parts of a raw RFC 822 message as RawMessageParts does, and calls
+// attachment (if it isn't nil) with each part that has a filename and its decoded content.
+func WalkRawMessage(r io.Reader, attachment func(part store.Part, data []byte)) ([]store.Part, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	var parts []store.Part
+	var firstErr error
+	walkRawPart(textproto.MIMEHeader(msg.Header), msg.Body, &parts, &firstErr, attachment)
+	return parts, firstErr
+}
+
+func walkRawPart(header textproto.MIMEHeader, body io.Reader, parts *[]store.Part, firstErr *error, attachment func(store.Part, []byte)) {
+	setErr := func(err error) {
+		if *firstErr == nil {
+			*firstErr = err
+		}
+	}
+	contentType := header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// RFC 2045 says messages without a (valid) Content-Type are plain text
+		mediaType = "text/plain"
+		params = map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				setErr(err)
+				return
+			}
+			walkRawPart(part.Header, part, parts, firstErr, attachment)
+		}
+	}
+	if mediaType == "message/rfc822" {
+		nested, err := mail.ReadMessage(body)
+		if err != nil {
+			setErr(err)
+			return
+		}
+		walkRawPart(textproto.MIMEHeader(nested.Header), nested.Body, parts, firstErr, attachment)
+		return
+	}
+	part := store.Part{MimeType: mediaType, Filename: params["name"]}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if dispositionParams["filename"] != "" {
+		part.Filename = dispositionParams["filename"]
+	}
+	isAttachment := disposition == "attachment" || part.Filename != ""
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		setErr(err)
+		return
+	}
+	data, err = DecodeTransferEncoding(header.Get("Content-Transfer-Encoding"), data)
+	if err != nil {
+		setErr(err)
+		*parts = append(*parts, part)
+		return
+	}
+	part.Size = int64(len(data))
+	if !isAttachment && (mediaType == "text/plain" || mediaType == "text/html") {
+		content, err := DecodeCharset(params["charset"], data)
+		if err != nil {
+			setErr(err)
+		}
+		part.Text = content
+	}
+	if attachment != nil && part.Filename != "" {
+		attachment(part, data)
+	}
+	*parts = append(*parts, part)
+}
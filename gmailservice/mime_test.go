@@ -0,0 +1,160 @@
+package gmailservice
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/oaktown/calliope/store"
+	"google.golang.org/api/gmail/v1"
+)
+
+func textPart(mimeType, charset string, data []byte) *gmail.MessagePart {
+	return &gmail.MessagePart{
+		MimeType: mimeType,
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "Content-Type", Value: mimeType + "; charset=" + charset},
+		},
+		Body: &gmail.MessagePartBody{Data: base64.RawURLEncoding.EncodeToString(data)},
+	}
+}
+
+func TestMessageBodies(t *testing.T) {
+	msg := gmail.Message{
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Body:     &gmail.MessagePartBody{},
+			Parts: []*gmail.MessagePart{
+				{
+					// An empty multipart part first used to stop the search
+					MimeType: "multipart/related",
+					Body:     &gmail.MessagePartBody{},
+				},
+				{
+					MimeType: "multipart/alternative",
+					Body:     &gmail.MessagePartBody{},
+					Parts: []*gmail.MessagePart{
+						textPart("text/plain", "ISO-8859-1", []byte("Caf\xe9 cr\xe8me")),
+						textPart("text/html", "windows-1252", []byte("<p>\x93Caf\xe9\x94</p>")),
+					},
+				},
+				textPart("text/plain", "Shift_JIS", []byte("\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd")),
+				{
+					MimeType: "text/plain",
+					Filename: "notes.txt",
+					Body:     &gmail.MessagePartBody{Data: base64.RawURLEncoding.EncodeToString([]byte("attachment"))},
+				},
+			},
+		},
+	}
+	bodies, err := MessageBodies(msg)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	want := Bodies{
+		Text: []string{"Café crème", "こんにちは"},
+		Html: []string{"<p>“Café”</p>"},
+	}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("MessageBodies() = %q, want %q", bodies, want)
+	}
+}
+
+func TestMessageParts(t *testing.T) {
+	msg := gmail.Message{
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Body:     &gmail.MessagePartBody{},
+			Parts: []*gmail.MessagePart{
+				textPart("text/html", "utf-8", []byte("<p>Hi</p>")),
+				{
+					MimeType: "text/plain",
+					Filename: "notes.txt",
+					Body:     &gmail.MessagePartBody{Data: base64.RawURLEncoding.EncodeToString([]byte("notes")), Size: 5},
+				},
+				{MimeType: "image/png", Filename: "logo.png", Body: &gmail.MessagePartBody{AttachmentId: "a1", Size: 2048}},
+			},
+		},
+	}
+	parts, err := MessageParts(msg)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	want := []store.Part{
+		{MimeType: "text/html", Text: "<p>Hi</p>"},
+		{MimeType: "text/plain", Filename: "notes.txt", Size: 5},
+		{MimeType: "image/png", Filename: "logo.png", Size: 2048},
+	}
+	if !reflect.DeepEqual(parts, want) {
+		t.Errorf("MessageParts() = %+v, want %+v", parts, want)
+	}
+}
+
+func TestMessageBodies_unknownCharset(t *testing.T) {
+	msg := gmail.Message{Payload: textPart("text/plain", "x-klingon", []byte("nuqneH"))}
+	bodies, err := MessageBodies(msg)
+	if err == nil {
+		t.Errorf("Expected an error for an unknown charset")
+	}
+	if !reflect.DeepEqual(bodies.Text, []string{"nuqneH"}) {
+		t.Errorf("Expected the part to be kept unconverted, got %q", bodies.Text)
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		charset string
+		data    string
+		want    string
+	}{
+		{"GB2312", "\xc4\xe3\xba\xc3", "你好"},
+		{"gb18030", "\xc4\xe3\xba\xc3", "你好"},
+		{"big5", "\xa7\x41\xa6\x6e", "你好"},
+		{"ks_c_5601-1987", "\xbe\xc8\xb3\xe7", "안녕"},
+		{"euc-kr", "\xbe\xc8\xb3\xe7", "안녕"},
+		{"utf-16", "\xff\xfeH\x00i\x00", "Hi"},
+		{"utf-16", "\x00H\x00i", "Hi"},
+		{"utf-16le", "H\x00i\x00", "Hi"},
+	}
+	for _, test := range tests {
+		got, err := DecodeCharset(test.charset, []byte(test.data))
+		if err != nil || got != test.want {
+			t.Errorf("DecodeCharset(%q, %q) = %q, %v, want %q", test.charset, test.data, got, err, test.want)
+		}
+	}
+}
+
+func TestRawMessageBodies(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: alice@example.com",
+		"Subject: Test",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/alternative; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/plain; charset=iso-8859-1",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Caf=E9 with a very long line that has been wrapped by a soft line break =",
+		"here.",
+		"--b1",
+		"Content-Type: text/html; charset=utf-8",
+		"Content-Transfer-Encoding: base64",
+		"",
+		base64.StdEncoding.EncodeToString([]byte("<b>Café</b>")),
+		"--b1--",
+		"",
+	}, "\r\n")
+	bodies, err := RawMessageBodies(strings.NewReader(raw))
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	want := Bodies{
+		Text: []string{"Café with a very long line that has been wrapped by a soft line break here."},
+		Html: []string{"<b>Café</b>"},
+	}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("RawMessageBodies() = %q, want %q", bodies, want)
+	}
+}
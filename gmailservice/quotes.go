@@ -0,0 +1,161 @@
+package gmailservice
+
+import (
+	"regexp"
+	"strings"
+)
+
+// BodyParts is a plain text body split up by who wrote it.
+type BodyParts struct {
+	// What the sender wrote
+	New string
+	// The messages they replied to or forwarded, without the "> " quoting
+	Quoted string
+	// Their signature, without the "-- " line
+	Signature string
+}
+
+var (
+	// "On Mon, Mar 4, 2019 at 10:00 AM Amy <amy@example.com> wrote:", in some of the languages
+	// mail clients write it in
+	attributionStart = regexp.MustCompile(`(?i)^(on|le|am|el|il|op)\s`)
+	attribution      = regexp.MustCompile(`(?i)^(on|le|am|el|il|op)\s.*\b(wrote|a écrit|schrieb|escribió|ha scritto|schreef)\s*:$`)
+	// Outlook's and Gmail's markers for the message being replied to or forwarded
+	originalMessage = regexp.MustCompile(`(?i)^-{2,}\s*(original message|forwarded message)\s*-{2,}$|^begin forwarded message:$`)
+	// Outlook puts a line of underscores and then the headers of the original message
+	underscores       = regexp.MustCompile(`^_{10,}$`)
+	headerFrom        = regexp.MustCompile(`^\*?From:\*?\s`)
+	headerSentOrDate  = regexp.MustCompile(`^\*?(Sent|Date):\*?\s`)
+	headerToOrSubject = regexp.MustCompile(`^\*?(To|Subject):\*?\s`)
+	// Signatures that mail apps add without a "-- " line
+	appSignature = regexp.MustCompile(`(?i)^(sent from my .+|sent from (mail|yahoo mail|outlook) for .+|get outlook for .+)$`)
+	quotePrefix  = regexp.MustCompile(`^\s*(>\s?)+`)
+)
+
+// SplitBody splits a plain text body into what the sender wrote, what they quoted and their
+// signature. Quoted text is anything quoted with ">", the "On ... wrote:" line before it, and
+// everything from an Outlook "Original Message" separator or header block (or a forwarded
+// message) on. Text between quotes (an inline reply) is the sender's. The signature is what
+// the sender wrote after a "-- " line, or a "Sent from my iPhone" at the end.
+func SplitBody(body string) BodyParts {
+	lines := strings.Split(strings.Replace(body, "\r\n", "\n", -1), "\n")
+	quoted := make([]bool, len(lines))
+	for i := 0; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), ">") {
+			quoted[i] = true
+			continue
+		}
+		if n := attributionLines(lines, i); n > 0 {
+			for j := i; j < i+n; j++ {
+				quoted[j] = true
+			}
+			if next := nextNonBlank(lines, i+n); next >= 0 && strings.HasPrefix(strings.TrimSpace(lines[next]), ">") {
+				// Only the quoted lines that follow are the original; there may be replies in between
+				i += n - 1
+				continue
+			}
+			markRest(quoted, i)
+			break
+		}
+		if historyStarts(lines, i) {
+			markRest(quoted, i)
+			break
+		}
+	}
+
+	signature := -1
+	last := -1
+	for i, line := range lines {
+		if quoted[i] {
+			continue
+		}
+		if signature < 0 && strings.TrimRight(line, " \t") == "--" {
+			signature = i
+		}
+		if strings.TrimSpace(line) != "" {
+			last = i
+		}
+	}
+	var newLines, quotedLines, signatureLines []string
+	for i, line := range lines {
+		switch {
+		case quoted[i]:
+			quotedLines = append(quotedLines, quotePrefix.ReplaceAllString(line, ""))
+		case signature >= 0 && i > signature:
+			signatureLines = append(signatureLines, line)
+		case i == signature:
+			// The "-- " line itself
+		case signature < 0 && i == last && appSignature.MatchString(strings.TrimSpace(line)):
+			signatureLines = append(signatureLines, line)
+		default:
+			newLines = append(newLines, line)
+		}
+	}
+	return BodyParts{New: joinLines(newLines), Quoted: joinLines(quotedLines), Signature: joinLines(signatureLines)}
+}
+
+// attributionLines returns how many lines (1 or 2, as it's often wrapped) the "On ... wrote:"
+// line starting at lines[i] takes up, or 0 if there isn't one.
+func attributionLines(lines []string, i int) int {
+	line := strings.TrimSpace(lines[i])
+	if !attributionStart.MatchString(line) {
+		return 0
+	}
+	// A date or an address, so that "On the other hand, I wrote:" isn't taken for one
+	isAttribution := func(s string) bool {
+		return attribution.MatchString(s) && strings.ContainsAny(s, "0123456789@")
+	}
+	if isAttribution(line) {
+		return 1
+	}
+	if i+1 < len(lines) && isAttribution(line+" "+strings.TrimSpace(lines[i+1])) {
+		return 2
+	}
+	return 0
+}
+
+// historyStarts reports whether lines[i] starts a message that was replied to or forwarded in
+// the style of Outlook, where it isn't quoted with ">".
+func historyStarts(lines []string, i int) bool {
+	line := strings.TrimSpace(lines[i])
+	switch {
+	case originalMessage.MatchString(line):
+		return true
+	case underscores.MatchString(line):
+		next := nextNonBlank(lines, i+1)
+		return next >= 0 && headerFrom.MatchString(strings.TrimSpace(lines[next]))
+	case headerFrom.MatchString(line):
+		var sent, to bool
+		for j := i + 1; j < len(lines) && j <= i+5; j++ {
+			header := strings.TrimSpace(lines[j])
+			sent = sent || headerSentOrDate.MatchString(header)
+			to = to || headerToOrSubject.MatchString(header)
+		}
+		return sent && to
+	}
+	return false
+}
+
+func nextNonBlank(lines []string, i int) int {
+	for ; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != "" {
+			return i
+		}
+	}
+	return -1
+}
+
+func markRest(quoted []bool, from int) {
+	for i := from; i < len(quoted); i++ {
+		quoted[i] = true
+	}
+}
+
+// joinLines joins lines back together, without trailing spaces or runs of blank lines.
+func joinLines(lines []string) string {
+	trimmed := make([]string, len(lines))
+	for i, line := range lines {
+		trimmed[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.Trim(blankLines.ReplaceAllString(strings.Join(trimmed, "\n"), "\n\n"), "\n")
+}
@@ -0,0 +1,69 @@
+package gmailservice
+
+import "testing"
+
+func TestSplitBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want BodyParts
+	}{
+		{"empty", "", BodyParts{}},
+		{"not a reply", "Lunch at noon?\r\n\r\nAmy", BodyParts{New: "Lunch at noon?\n\nAmy"}},
+		{
+			"top posted",
+			"Sure.\r\n\r\nOn Mon, Mar 4, 2019 at 10:00 AM Amy Smith <amy@example.com> wrote:\r\n> Lunch at noon?\r\n>\r\n> Amy\r\n",
+			BodyParts{New: "Sure.", Quoted: "On Mon, Mar 4, 2019 at 10:00 AM Amy Smith <amy@example.com> wrote:\nLunch at noon?\n\nAmy"},
+		},
+		{
+			"wrapped attribution",
+			"Sure.\n\nOn Mon, Mar 4, 2019 at 10:00 AM Amy Smith <\namy@example.com> wrote:\n\n> Lunch?",
+			BodyParts{New: "Sure.", Quoted: "On Mon, Mar 4, 2019 at 10:00 AM Amy Smith <\namy@example.com> wrote:\nLunch?"},
+		},
+		{
+			"inline",
+			"On 3/4/19, Amy wrote:\n> Lunch?\nSure.\n>> Earlier\n> Where?\nThe usual.\n",
+			BodyParts{New: "Sure.\nThe usual.", Quoted: "On 3/4/19, Amy wrote:\nLunch?\nEarlier\nWhere?"},
+		},
+		{
+			"attribution without quoting",
+			"Sure.\n\nLe lun. 4 mars 2019 à 10:00, Amy <amy@example.com> a écrit :\nLunch?",
+			BodyParts{New: "Sure.", Quoted: "Le lun. 4 mars 2019 à 10:00, Amy <amy@example.com> a écrit :\nLunch?"},
+		},
+		{
+			"not an attribution",
+			"On the other hand, I wrote:\nsomething else",
+			BodyParts{New: "On the other hand, I wrote:\nsomething else"},
+		},
+		{
+			"outlook",
+			"Sure.\n\n-----Original Message-----\nFrom: Amy\nSent: Monday\nLunch?",
+			BodyParts{New: "Sure.", Quoted: "-----Original Message-----\nFrom: Amy\nSent: Monday\nLunch?"},
+		},
+		{
+			"outlook headers",
+			"Sure.\n________________________________\nFrom: Amy Smith <amy@example.com>\nSent: Monday, March 4, 2019 10:00 AM\nTo: Bob\nSubject: Lunch\n\nLunch?",
+			BodyParts{New: "Sure.", Quoted: "________________________________\nFrom: Amy Smith <amy@example.com>\nSent: Monday, March 4, 2019 10:00 AM\nTo: Bob\nSubject: Lunch\n\nLunch?"},
+		},
+		{
+			"forwarded",
+			"FYI\n\n---------- Forwarded message ---------\nFrom: Amy\nLunch?",
+			BodyParts{New: "FYI", Quoted: "---------- Forwarded message ---------\nFrom: Amy\nLunch?"},
+		},
+		{
+			"signature",
+			"Sure.\n\n-- \nBob Jones\nAcme Corp\n\nOn Mon, Mar 4, 2019, Amy <amy@example.com> wrote:\n> Lunch?",
+			BodyParts{New: "Sure.", Quoted: "On Mon, Mar 4, 2019, Amy <amy@example.com> wrote:\nLunch?", Signature: "Bob Jones\nAcme Corp"},
+		},
+		{
+			"app signature",
+			"Sure.\n\nSent from my iPhone\n\n> On Mar 4, 2019, at 10:00 AM, Amy <amy@example.com> wrote:\n> Lunch?",
+			BodyParts{New: "Sure.", Quoted: "On Mar 4, 2019, at 10:00 AM, Amy <amy@example.com> wrote:\nLunch?", Signature: "Sent from my iPhone"},
+		},
+	}
+	for _, test := range tests {
+		if got := SplitBody(test.body); got != test.want {
+			t.Errorf("%v: SplitBody = %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
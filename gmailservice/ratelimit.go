@@ -0,0 +1,291 @@
+package gmailservice
+
+import (
+	"context"
+	"fmt"
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/googleapi"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gmail API methods and how many quota units each call costs. See
+// https://developers.google.com/gmail/api/v1/reference/quota
+const (
+	MethodListMessages  = "messages.list"
+	MethodGetMessage    = "messages.get"
+	MethodGetAttachment = "messages.attachments.get"
+	MethodListHistory   = "history.list"
+	MethodGetThread     = "threads.get"
+	MethodListLabels    = "labels.list"
+	MethodGetProfile    = "getProfile"
+)
+
+var QuotaUnits = map[string]int{
+	MethodListMessages:  5,
+	MethodGetMessage:    5,
+	MethodGetAttachment: 5,
+	MethodListHistory:   2,
+	MethodGetThread:     10,
+	MethodListLabels:    1,
+	MethodGetProfile:    1,
+}
+
+// Gmail allows 250 quota units per user per second
+const DefaultUnitsPerSecond = 250
+
+// Default number of attempts for each call, including the first one
+const DefaultMaxAttempts = 3
+
+// Longest time to wait before retrying, however many attempts there have been
+const MaxRetryWait = 10 * time.Minute
+
+// Limiter is a token bucket shared by all of a Downloader's goroutines that keeps calls within
+// the Gmail quota. It also keeps track of throttling for the end of run summary.
+type Limiter struct {
+	mu             sync.Mutex
+	clock          clockwork.Clock
+	unitsPerSecond float64
+	tokens         float64
+	last           time.Time
+	stats          map[string]*MethodStats
+}
+
+// MethodStats counts calls and throttling for one API method.
+type MethodStats struct {
+	Calls     int64
+	Units     int64
+	Throttled int64 // responses saying we have exceeded quota
+	Retries   int64
+	Waited    time.Duration // time spent waiting for the limiter or backing off
+}
+
+func NewLimiter(clock clockwork.Clock, unitsPerSecond int) *Limiter {
+	return &Limiter{
+		clock:          clock,
+		unitsPerSecond: float64(unitsPerSecond),
+		tokens:         float64(unitsPerSecond),
+		last:           clock.Now(),
+		stats:          make(map[string]*MethodStats),
+	}
+}
+
+// Wait blocks until the call to method can be made without exceeding the quota, and returns
+// true. If done is closed first it stops waiting and returns false.
+func (l *Limiter) Wait(method string, done <-chan struct{}) bool {
+	units, ok := QuotaUnits[method]
+	if !ok {
+		units = 5
+	}
+	l.mu.Lock()
+	now := l.clock.Now()
+	l.tokens = math.Min(l.unitsPerSecond, l.tokens+now.Sub(l.last).Seconds()*l.unitsPerSecond)
+	l.last = now
+	// Take the units now, going into debt if need be, so that waiting callers are served in order.
+	l.tokens -= float64(units)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.unitsPerSecond * float64(time.Second))
+	}
+	stats := l.methodStats(method)
+	stats.Calls++
+	stats.Units += int64(units)
+	stats.Waited += wait
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-l.clock.After(wait):
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (l *Limiter) record(method string, update func(*MethodStats)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	update(l.methodStats(method))
+}
+
+func (l *Limiter) methodStats(method string) *MethodStats {
+	stats, ok := l.stats[method]
+	if !ok {
+		stats = &MethodStats{}
+		l.stats[method] = stats
+	}
+	return stats
+}
+
+// Stats returns a copy of the stats for each method called so far.
+func (l *Limiter) Stats() map[string]MethodStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make(map[string]MethodStats, len(l.stats))
+	for method, s := range l.stats {
+		stats[method] = *s
+	}
+	return stats
+}
+
+// Summary describes the calls made and any throttling, one line per method.
+func (l *Limiter) Summary() string {
+	stats := l.Stats()
+	methods := make([]string, 0, len(stats))
+	for method := range stats {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	var b strings.Builder
+	for _, method := range methods {
+		s := stats[method]
+		fmt.Fprintf(&b, "%-26s calls: %-7d quota units: %-8d throttled: %-5d retries: %-5d waited: %v\n",
+			method, s.Calls, s.Units, s.Throttled, s.Retries, s.Waited.Round(time.Millisecond))
+	}
+	return b.String()
+}
+
+// retry calls fn, which makes one call to method, until it succeeds, fails with an error that
+// isn't worth retrying, or runs out of attempts. Waits between attempts back off exponentially
+// with jitter, unless the API says how long to wait with Retry-After.
+func (d *Downloader) retry(method string, fn func() error) error {
+	maxAttempts := d.Options.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if d.Limiter != nil && !d.Limiter.Wait(method, d.done()) {
+			if err == nil {
+				err = d.ctx.Err()
+			}
+			return err
+		}
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		retryable, throttled, retryAfter := classifyError(err, d.clock.Now())
+		if d.Limiter != nil && throttled {
+			d.Limiter.record(method, func(s *MethodStats) { s.Throttled++ })
+		}
+		if d.OnThrottled != nil && throttled {
+			d.OnThrottled(method)
+		}
+		if !retryable || attempt == maxAttempts {
+			return err
+		}
+		wait := retryAfter
+		if wait == 0 {
+			wait = d.backoff(attempt)
+		}
+		if d.stopped() {
+			return err
+		}
+		log.Printf("%v failed (attempt %v of %v), retrying in %v: %v\n", method, attempt, maxAttempts, wait, err)
+		if d.Limiter != nil {
+			d.Limiter.record(method, func(s *MethodStats) {
+				s.Retries++
+				s.Waited += wait
+			})
+		}
+		select {
+		case <-d.clock.After(wait):
+		case <-d.done():
+			// Don't keep the download waiting to finish for a retry that may be minutes away
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns RetryWaitInterval doubled for each attempt after the first, less up to 20%
+// jitter so that workers that were throttled together don't all retry at the same moment.
+func (d *Downloader) backoff(attempt int) time.Duration {
+	wait := time.Duration(RetryWaitInterval) * time.Second
+	for i := 1; i < attempt && wait < MaxRetryWait; i++ {
+		wait *= 2
+	}
+	if wait > MaxRetryWait {
+		wait = MaxRetryWait
+	}
+	return wait - time.Duration(rand.Int63n(int64(wait/5)+1))
+}
+
+// classifyError says whether a failed call is worth retrying, whether it failed because we're
+// over quota, and how long after now the API asked us to wait (0 if it didn't say).
+func classifyError(err error, now time.Time) (retryable bool, throttled bool, retryAfter time.Duration) {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false, false, 0
+	}
+	if e, ok := err.(*googleapi.Error); ok {
+		retryAfter = parseRetryAfter(e.Header.Get("Retry-After"), now)
+		switch {
+		case e.Code == 429:
+			return true, true, retryAfter
+		case e.Code == 403 && isRateLimitReason(e):
+			return true, true, retryAfter
+		case e.Code >= 500:
+			return true, false, retryAfter
+		}
+		return false, false, 0
+	}
+	if e, ok := err.(*url.Error); ok {
+		if e.Err == context.Canceled || e.Err == context.DeadlineExceeded {
+			return false, false, 0
+		}
+		return true, false, 0
+	}
+	if _, ok := err.(net.Error); ok {
+		return true, false, 0
+	}
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return true, false, 0
+	}
+	return false, false, 0
+}
+
+// 403s are also used for permission problems, which won't go away by retrying. If the API
+// doesn't give a reason, assume it's rate limiting (as we always used to).
+func isRateLimitReason(e *googleapi.Error) bool {
+	if len(e.Errors) == 0 {
+		return true
+	}
+	for _, item := range e.Errors {
+		reason := strings.ToLower(item.Reason)
+		if strings.Contains(reason, "ratelimit") || strings.Contains(reason, "quota") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or a date,
+// into how long to wait after now. Waits longer than MaxRetryWait are cut down to it.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	var wait time.Duration
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		wait = time.Duration(secs) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = date.Sub(now)
+	}
+	if wait <= 0 {
+		return 0
+	}
+	if wait > MaxRetryWait {
+		return MaxRetryWait
+	}
+	return wait
+}
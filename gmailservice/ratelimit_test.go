@@ -0,0 +1,132 @@
+package gmailservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/googleapi"
+)
+
+func Test_classifyError(t *testing.T) {
+	withHeader := func(code int, retryAfter string, reasons ...string) *googleapi.Error {
+		e := &googleapi.Error{Code: code, Header: make(http.Header)}
+		if retryAfter != "" {
+			e.Header.Set("Retry-After", retryAfter)
+		}
+		for _, reason := range reasons {
+			e.Errors = append(e.Errors, googleapi.ErrorItem{Reason: reason})
+		}
+		return e
+	}
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		err        error
+		retryable  bool
+		throttled  bool
+		retryAfter time.Duration
+	}{
+		{"429", withHeader(429, ""), true, true, 0},
+		{"429 with Retry-After", withHeader(429, "7"), true, true, 7 * time.Second},
+		{"429 with Retry-After date", withHeader(429, "Fri, 01 Mar 2019 12:00:30 GMT"), true, true, 30 * time.Second},
+		{"429 with Retry-After date gone by", withHeader(429, "Fri, 01 Mar 2019 11:59:00 GMT"), true, true, 0},
+		{"429 with long Retry-After", withHeader(429, "86400"), true, true, MaxRetryWait},
+		{"403 rate limit", withHeader(403, "", "userRateLimitExceeded"), true, true, 0},
+		{"403 forbidden", withHeader(403, "", "forbidden"), false, false, 0},
+		{"404", withHeader(404, ""), false, false, 0},
+		{"503", withHeader(503, ""), true, false, 0},
+		{"Transport error", &url.Error{Op: "Get", URL: "https://www.googleapis.com", Err: errors.New("connection reset")}, true, false, 0},
+		{"Cancelled", context.Canceled, false, false, 0},
+		{"Cancelled request", &url.Error{Op: "Get", URL: "https://www.googleapis.com", Err: context.Canceled}, false, false, 0},
+		{"Something else", errors.New("oops"), false, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryable, throttled, retryAfter := classifyError(tt.err, now)
+			if retryable != tt.retryable || throttled != tt.throttled || retryAfter != tt.retryAfter {
+				t.Errorf("classifyError() = %v, %v, %v, want %v, %v, %v",
+					retryable, throttled, retryAfter, tt.retryable, tt.throttled, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	d := New(nil, Options{MaxAttempts: 2}, 1)
+	d.clock = fakeClock
+	d.Limiter = NewLimiter(fakeClock, DefaultUnitsPerSecond)
+
+	throttled := &googleapi.Error{Code: 429, Header: http.Header{"Retry-After": []string{"5"}}}
+	calls := 0
+	var err error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err = d.retry(MethodGetMessage, func() error {
+			calls++
+			if calls == 1 {
+				return throttled
+			}
+			return nil
+		})
+		wg.Done()
+	}()
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(5 * time.Second)
+	wg.Wait()
+
+	if err != nil || calls != 2 {
+		t.Errorf("Expected success on the second call, got %v after %v calls", err, calls)
+	}
+	stats := d.Limiter.Stats()[MethodGetMessage]
+	if stats.Calls != 2 || stats.Units != 10 || stats.Throttled != 1 || stats.Retries != 1 || stats.Waited != 5*time.Second {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestLimiterWaitsWhenQuotaIsUsedUp(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	limiter := NewLimiter(fakeClock, 10)
+	limiter.Wait(MethodGetMessage, nil)
+	limiter.Wait(MethodGetMessage, nil)
+
+	done := make(chan bool)
+	go func() {
+		done <- limiter.Wait(MethodGetThread, nil)
+	}()
+	fakeClock.BlockUntil(1)
+	select {
+	case <-done:
+		t.Fatal("Expected to wait for quota")
+	default:
+	}
+	// threads.get costs 10 units, which takes a second to earn at 10 units per second
+	fakeClock.Advance(time.Second)
+	if !<-done {
+		t.Error("Wait() = false, want true once the quota is earned")
+	}
+}
+
+func TestLimiterStopsWaitingWhenDone(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	limiter := NewLimiter(fakeClock, 10)
+	limiter.Wait(MethodGetThread, nil)
+
+	stop := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		done <- limiter.Wait(MethodGetThread, stop)
+	}()
+	fakeClock.BlockUntil(1)
+	close(stop)
+	if <-done {
+		t.Error("Wait() = true, want false when stopped before the quota is earned")
+	}
+}
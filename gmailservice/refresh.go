@@ -0,0 +1,48 @@
+package gmailservice
+
+import (
+	"context"
+	"log"
+)
+
+// MessageLabels is the current labels of a message, fetched without the rest of it. Err is set
+// if they couldn't be fetched.
+type MessageLabels struct {
+	Id       string
+	LabelIds []string
+	Err      error
+}
+
+// RefreshLabels fetches the labels of each message with format=MINIMAL, which is much cheaper
+// than downloading the message again. Results are sent on the returned channel, which is closed
+// when every message has been fetched, or when the fetches under way finish after ctx is cancelled.
+func RefreshLabels(ctx context.Context, d Downloader, ids []string) <-chan MessageLabels {
+	d.ctx = ctx
+	results := make(chan MessageLabels)
+	go func() {
+		for _, id := range ids {
+			if d.stopped() {
+				break
+			}
+			d.WorkersQueue <- true
+			go func(id string) {
+				defer func() {
+					<-d.WorkersQueue
+				}()
+				msg, err := d.doGetFormatWrapper(id, "minimal")
+				if err != nil {
+					log.Printf("Unable to retrieve labels of message %v: %v\n", id, err)
+					results <- MessageLabels{Id: id, Err: err}
+					return
+				}
+				results <- MessageLabels{Id: id, LabelIds: msg.LabelIds}
+			}(id)
+		}
+		d.NoNewWorkers()
+		if d.batcher != nil {
+			d.batcher.Close()
+		}
+		close(results)
+	}()
+	return results
+}
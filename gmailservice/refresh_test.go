@@ -0,0 +1,40 @@
+package gmailservice
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRefreshLabels(t *testing.T) {
+	d := New(nil, Options{MaxAttempts: 1}, 2)
+	d.doGetFormat = func(d *Downloader, id, format string) (*gmail.Message, error) {
+		if format != "minimal" {
+			t.Errorf("message %v downloaded with format %v", id, format)
+		}
+		if id == "gone" {
+			return nil, &googleapi.Error{Code: 404}
+		}
+		return &gmail.Message{Id: id, LabelIds: []string{"INBOX", id}}, nil
+	}
+
+	got := make(map[string][]string)
+	var failed []string
+	for result := range RefreshLabels(context.Background(), d, []string{"1", "gone", "2"}) {
+		if result.Err != nil {
+			failed = append(failed, result.Id)
+			continue
+		}
+		got[result.Id] = result.LabelIds
+	}
+	want := map[string][]string{"1": {"INBOX", "1"}, "2": {"INBOX", "2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RefreshLabels() = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(failed, []string{"gone"}) {
+		t.Errorf("RefreshLabels() failed for %v, want [gone]", failed)
+	}
+}
@@ -0,0 +1,79 @@
+package gmailservice
+
+import (
+	"fmt"
+	"google.golang.org/api/gmail/v1"
+	"log"
+	"sync"
+)
+
+// listedThread is a thread that is downloaded because one of its messages was listed. It keeps
+// the ids of the thread's messages that were listed so they can all be reported as failed if the
+// thread can't be downloaded.
+type listedThread struct {
+	id     string
+	mu     sync.Mutex
+	ids    []string
+	errMsg string
+}
+
+// add records another listed message in the thread, and returns the error the thread failed
+// with if it has already failed.
+func (t *listedThread) add(id string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ids = append(t.ids, id)
+	return t.errMsg
+}
+
+// fail records that the thread couldn't be downloaded, and returns the ids listed so far.
+func (t *listedThread) fail(errMsg string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.errMsg = errMsg
+	return append([]string(nil), t.ids...)
+}
+
+// downloadThread downloads every message in a thread with a single request and sends each
+// one on as if it had been downloaded with DownloadFullMessage. If it can't be downloaded, each
+// listed message in it is sent with the error.
+func downloadThread(d Downloader, thread *listedThread) {
+	defer func() {
+		<-d.WorkersQueue
+	}()
+
+	gmailThread, err := d.doGetThreadWrapper(thread.id)
+	log.Println("Fetching thread id:", thread.id)
+	if err != nil && d.stopped() {
+		log.Printf("Gave up on thread %v because the download was stopped: %v\n", thread.id, err)
+		return
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Unable to retrieve thread %v: %v", thread.id, err)
+		for _, id := range thread.fail(errMsg) {
+			d.MessageChan <- d.partialMessageWithError(id, errMsg)
+		}
+		return
+	}
+	for _, gmailMsg := range gmailThread.Messages {
+		if d.OnFetched != nil {
+			d.OnFetched(gmailMsg.Id)
+		}
+		d.sendMessage(gmailMsg)
+	}
+}
+
+func (d *Downloader) doGetThreadWrapper(id string) (*gmail.Thread, error) {
+	var thread *gmail.Thread
+	fn := func() error {
+		r, err := d.doGetThread(d, id)
+		thread = r
+		return err
+	}
+	err := d.retry(MethodGetThread, fn)
+	return thread, err
+}
+
+func doGetThread(d *Downloader, id string) (*gmail.Thread, error) {
+	return d.Svc.Users.Threads.Get("me", id).Do()
+}
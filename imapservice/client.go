@@ -0,0 +1,522 @@
+package imapservice
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// How long to wait for the server to connect and to answer each response before giving up
+const (
+	dialTimeout     = 30 * time.Second
+	responseTimeout = 5 * time.Minute
+)
+
+// Literals bigger than this are refused rather than read into memory
+const maxLiteral = 256 << 20
+
+// Client is a minimal IMAP4rev1 client (RFC 3501): just enough to log in, list the folders and
+// fetch messages from them without changing anything on the server.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// Mailbox is a folder listed by the server.
+type Mailbox struct {
+	// As the server names it (in modified UTF-7), e.g. "INBOX" or "Archive/2019"
+	Name string
+	// Separates the levels of the folder hierarchy, e.g. "/" or "."; "" if it's flat
+	Delimiter string
+	// e.g. \Noselect, \HasChildren, and special uses (RFC 6154) like \Sent and \Trash
+	Attributes []string
+}
+
+// Folder is what the server says about a folder when it is selected.
+type Folder struct {
+	Name        string
+	Exists      uint32
+	UidValidity uint32
+	UidNext     uint32
+}
+
+// Fetched is a message fetched by UidFetch.
+type Fetched struct {
+	Uid          uint32
+	Flags        []string
+	InternalDate time.Time
+	Body         []byte
+}
+
+// Dial connects to the server at addr ("host:port"), with TLS unless insecure, and reads its
+// greeting.
+func Dial(addr string, insecure bool) (*Client, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if insecure {
+		conn, err = dialer.Dial("tcp", addr)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn)
+}
+
+// NewClient reads the greeting from a connection to a server and returns a client using it.
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{conn: conn, r: bufio.NewReaderSize(conn, 64*1024)}
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if greeting.tag != "*" || greeting.status != "OK" && greeting.status != "PREAUTH" {
+		conn.Close()
+		return nil, fmt.Errorf("imap: server refused the connection: %v %v", greeting.status, greeting.text)
+	}
+	return c, nil
+}
+
+func (c *Client) Login(user, password string) error {
+	_, err := c.command(nil, "LOGIN %v %v", quote(user), quote(password))
+	return err
+}
+
+// Logout ends the session and closes the connection.
+func (c *Client) Logout() error {
+	_, err := c.command(nil, "LOGOUT")
+	c.conn.Close()
+	return err
+}
+
+func (c *Client) List() ([]Mailbox, error) {
+	var mailboxes []Mailbox
+	_, err := c.command(func(resp *response) error {
+		// * LIST (\HasNoChildren \Sent) "/" "Sent Items"
+		if len(resp.fields) != 4 || !isAtom(resp.fields[0], "LIST") {
+			return nil
+		}
+		mailbox := Mailbox{Name: asString(resp.fields[3])}
+		if delimiter, ok := resp.fields[2].(string); ok {
+			mailbox.Delimiter = delimiter
+		}
+		attributes, _ := resp.fields[1].([]interface{})
+		for _, attribute := range attributes {
+			mailbox.Attributes = append(mailbox.Attributes, asString(attribute))
+		}
+		mailboxes = append(mailboxes, mailbox)
+		return nil
+	}, `LIST "" "*"`)
+	return mailboxes, err
+}
+
+// Examine selects the folder read-only, so that fetching messages doesn't mark them as read.
+func (c *Client) Examine(name string) (Folder, error) {
+	folder := Folder{Name: name}
+	_, err := c.command(func(resp *response) error {
+		switch {
+		case resp.status == "OK":
+			// * OK [UIDVALIDITY 3857529045] UIDs valid
+			code, value := responseCode(resp.text)
+			n, _ := strconv.ParseUint(value, 10, 32)
+			switch code {
+			case "UIDVALIDITY":
+				folder.UidValidity = uint32(n)
+			case "UIDNEXT":
+				folder.UidNext = uint32(n)
+			}
+		case len(resp.fields) == 2 && isAtom(resp.fields[1], "EXISTS"):
+			// * 172 EXISTS
+			n, _ := strconv.ParseUint(asString(resp.fields[0]), 10, 32)
+			folder.Exists = uint32(n)
+		}
+		return nil
+	}, "EXAMINE %v", quote(name))
+	return folder, err
+}
+
+// UidSearch returns the UIDs of the messages in the selected folder that match the criteria,
+// e.g. "ALL" or "UID 101:*".
+func (c *Client) UidSearch(criteria string) ([]uint32, error) {
+	var uids []uint32
+	_, err := c.command(func(resp *response) error {
+		// * SEARCH 2 84 882
+		if len(resp.fields) == 0 || !isAtom(resp.fields[0], "SEARCH") {
+			return nil
+		}
+		for _, field := range resp.fields[1:] {
+			uid, err := strconv.ParseUint(asString(field), 10, 32)
+			if err != nil {
+				return fmt.Errorf("imap: bad UID in search results: %v", asString(field))
+			}
+			uids = append(uids, uint32(uid))
+		}
+		return nil
+	}, "UID SEARCH %v", criteria)
+	return uids, err
+}
+
+// The format of INTERNALDATE
+const internalDate = "_2-Jan-2006 15:04:05 -0700"
+
+// UidFetch fetches the flags, date and whole source of the messages with the UIDs from the
+// selected folder and calls each with every one, in the order the server sends them. If each
+// returns an error, the rest of the messages are read but not passed to it, and the error is
+// returned.
+func (c *Client) UidFetch(uids []uint32, each func(Fetched) error) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	_, err := c.command(func(resp *response) error {
+		// * 12 FETCH (UID 5 FLAGS (\Seen) INTERNALDATE "17-Jul-1996 02:44:25 -0700" BODY[] {342}
+		if len(resp.fields) != 3 || !isAtom(resp.fields[1], "FETCH") {
+			return nil
+		}
+		items, _ := resp.fields[2].([]interface{})
+		var message Fetched
+		for i := 0; i+1 < len(items); i += 2 {
+			value := items[i+1]
+			switch strings.ToUpper(asString(items[i])) {
+			case "UID":
+				uid, _ := strconv.ParseUint(asString(value), 10, 32)
+				message.Uid = uint32(uid)
+			case "FLAGS":
+				flags, _ := value.([]interface{})
+				for _, flag := range flags {
+					message.Flags = append(message.Flags, asString(flag))
+				}
+			case "INTERNALDATE":
+				message.InternalDate, _ = time.Parse(internalDate, asString(value))
+			case "BODY[]":
+				message.Body = asBytes(value)
+			}
+		}
+		if message.Uid == 0 || message.Body == nil {
+			// Servers can send flag changes of other messages at any time
+			return nil
+		}
+		return each(message)
+	}, "UID FETCH %v (UID FLAGS INTERNALDATE BODY.PEEK[])", uidSet(uids))
+	return err
+}
+
+// response is a line from the server. Status responses ("* OK ...", "a1 NO ...") have status
+// and text; the others (e.g. "* 3 EXISTS") have fields, which are atoms, strings (from quoted
+// strings), []byte (from literals) and []interface{} (from parenthesized lists).
+type response struct {
+	tag    string
+	status string
+	text   string
+	fields []interface{}
+}
+
+// atom is a bare word in a response, e.g. FLAGS, \Seen or NIL.
+type atom string
+
+var statuses = map[string]bool{"OK": true, "NO": true, "BAD": true, "BYE": true, "PREAUTH": true}
+
+// command sends a command (which is formatted like fmt.Sprintf) and calls untagged with each
+// untagged response until the server says the command is done. Returns an error if the command
+// failed or untagged returned one.
+func (c *Client) command(untagged func(*response) error, format string, args ...interface{}) (string, error) {
+	c.tag++
+	tag := "c" + strconv.Itoa(c.tag)
+	name := strings.Fields(format)[0]
+	c.conn.SetDeadline(time.Now().Add(responseTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%v %v\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return "", err
+	}
+	var failed error
+	for {
+		c.conn.SetDeadline(time.Now().Add(responseTimeout))
+		resp, err := c.readResponse()
+		if err != nil {
+			return "", err
+		}
+		switch resp.tag {
+		case tag:
+			if resp.status != "OK" {
+				return resp.text, fmt.Errorf("imap: %v failed: %v %v", name, resp.status, resp.text)
+			}
+			return resp.text, failed
+		case "*":
+			if untagged != nil && failed == nil {
+				failed = untagged(resp)
+			}
+		default:
+			return "", fmt.Errorf("imap: unexpected response to %v: %v %v", name, resp.tag, resp.text)
+		}
+	}
+}
+
+func (c *Client) readResponse() (*response, error) {
+	tag, err := c.readAtom()
+	if err != nil {
+		return nil, err
+	}
+	resp := &response{tag: string(tag)}
+	if resp.tag == "+" {
+		// A continuation request, which the commands we send never need
+		resp.text, err = c.readText()
+		return resp, err
+	}
+	if err := c.skipSpace(); err != nil {
+		return nil, err
+	}
+	first, err := c.readValue()
+	if err != nil {
+		return nil, err
+	}
+	if word, ok := first.(atom); ok && statuses[strings.ToUpper(string(word))] {
+		resp.status = strings.ToUpper(string(word))
+		resp.text, err = c.readText()
+		return resp, err
+	}
+	rest, err := c.readFields('\n')
+	resp.fields = append([]interface{}{first}, rest...)
+	return resp, err
+}
+
+// readFields reads values up to the end of a list (')') or of the line ('\n').
+func (c *Client) readFields(end byte) ([]interface{}, error) {
+	var fields []interface{}
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case b == end:
+			return fields, nil
+		case b == ' ' || b == '\r' && end == '\n':
+			continue
+		case b == '\r' || b == '\n':
+			return nil, errors.New("imap: unexpected end of line in list")
+		}
+		c.r.UnreadByte()
+		value, err := c.readValue()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, value)
+	}
+}
+
+func (c *Client) readValue() (interface{}, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch b {
+	case '(':
+		return c.readFields(')')
+	case '"':
+		return c.readQuoted()
+	case '{':
+		return c.readLiteral()
+	}
+	c.r.UnreadByte()
+	return c.readAtom()
+}
+
+// readAtom reads a word, including anything in square brackets, e.g. BODY[HEADER.FIELDS (TO)].
+func (c *Client) readAtom() (atom, error) {
+	var word []byte
+	depth := 0
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if depth == 0 && strings.IndexByte(" ()\r\n", b) >= 0 {
+			c.r.UnreadByte()
+			break
+		}
+		switch b {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		}
+		word = append(word, b)
+	}
+	if len(word) == 0 {
+		return "", errors.New("imap: expected an atom")
+	}
+	return atom(word), nil
+}
+
+func (c *Client) readQuoted() (string, error) {
+	var s []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '"':
+			return string(s), nil
+		case '\\':
+			if b, err = c.r.ReadByte(); err != nil {
+				return "", err
+			}
+		case '\r', '\n':
+			return "", errors.New("imap: unexpected end of line in quoted string")
+		}
+		s = append(s, b)
+	}
+}
+
+// readLiteral reads a literal, "{5}\r\nhello", after the opening brace.
+func (c *Client) readLiteral() ([]byte, error) {
+	count, err := c.r.ReadString('}')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(count, "}"))
+	if err != nil || n < 0 || n > maxLiteral {
+		return nil, fmt.Errorf("imap: bad literal size {%v", count)
+	}
+	if crlf, err := c.r.ReadString('\n'); err != nil || strings.TrimRight(crlf, "\r\n") != "" {
+		return nil, errors.New("imap: expected a new line after literal size")
+	}
+	literal := make([]byte, n)
+	if _, err := io.ReadFull(c.r, literal); err != nil {
+		return nil, err
+	}
+	return literal, nil
+}
+
+// readText reads the rest of the line.
+func (c *Client) readText() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func (c *Client) skipSpace() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != ' ' {
+		return fmt.Errorf("imap: expected a space, got %q", b)
+	}
+	return nil
+}
+
+func isAtom(value interface{}, word string) bool {
+	a, ok := value.(atom)
+	return ok && strings.EqualFold(string(a), word)
+}
+
+func asString(value interface{}) string {
+	switch v := value.(type) {
+	case atom:
+		return string(v)
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// asBytes returns a string or literal value, or nil for NIL.
+func asBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	}
+	return nil
+}
+
+// responseCode returns the code and its value from the start of the text of a status response,
+// e.g. "UIDVALIDITY" and "3857529045" from "[UIDVALIDITY 3857529045] UIDs valid".
+func responseCode(text string) (string, string) {
+	end := strings.IndexByte(text, ']')
+	if !strings.HasPrefix(text, "[") || end < 0 {
+		return "", ""
+	}
+	fields := strings.SplitN(text[1:end], " ", 2)
+	if len(fields) == 1 {
+		return strings.ToUpper(fields[0]), ""
+	}
+	return strings.ToUpper(fields[0]), fields[1]
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// uidSet writes UIDs as an IMAP sequence set, with runs as ranges: "1:3,7,9:10".
+func uidSet(uids []uint32) string {
+	var b strings.Builder
+	for i := 0; i < len(uids); i++ {
+		j := i
+		for j+1 < len(uids) && uids[j+1] == uids[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatUint(uint64(uids[i]), 10))
+		if j > i {
+			b.WriteByte(':')
+			b.WriteString(strconv.FormatUint(uint64(uids[j]), 10))
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// decodeMailboxName decodes the modified UTF-7 that IMAP uses for folder names with non-ASCII
+// characters in them ("&AOk-t&AOk-" is "été", and "&-" is "&"). Names that aren't valid are
+// kept as they are.
+func decodeMailboxName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '&' {
+			b.WriteByte(name[i])
+			continue
+		}
+		end := strings.IndexByte(name[i:], '-')
+		if end < 0 {
+			return name
+		}
+		encoded := name[i+1 : i+end]
+		i += end
+		if encoded == "" {
+			b.WriteByte('&')
+			continue
+		}
+		utf16be, err := base64.RawStdEncoding.DecodeString(strings.Replace(encoded, ",", "/", -1))
+		if err != nil || len(utf16be)%2 != 0 {
+			return name
+		}
+		units := make([]uint16, len(utf16be)/2)
+		for j := range units {
+			units[j] = uint16(utf16be[2*j])<<8 | uint16(utf16be[2*j+1])
+		}
+		b.WriteString(string(utf16.Decode(units)))
+	}
+	return b.String()
+}
@@ -0,0 +1,296 @@
+// Package imapservice downloads messages from IMAP servers (e.g. Fastmail or Exchange) into the
+// same store.Message documents that gmailservice downloads from Gmail.
+package imapservice
+
+import (
+	"context"
+	"fmt"
+	"github.com/oaktown/calliope/importer"
+	"github.com/oaktown/calliope/store"
+	"log"
+	"strings"
+)
+
+// Number of messages fetched with each command
+const fetchBatch = 100
+
+type Options struct {
+	// Name of the account being downloaded, saved on every message
+	Account string
+	// Folders to download, as the server names them (e.g. "INBOX" or "Archive/2019"). If empty,
+	// every folder is downloaded except virtual ones (like "All Mail") that repeat the others.
+	Folders []string
+	// Download every message again, ignoring the checkpoints
+	Full bool
+}
+
+// Downloader downloads from an IMAP account and sends the messages on MessageChan, the way
+// gmailservice.Downloader does for Gmail. Only messages with UIDs above a folder's checkpoint
+// are downloaded, unless the folder's UIDVALIDITY has changed since.
+type Downloader struct {
+	MessageChan chan *store.Message
+	Options     Options
+	// Converts the messages, and keeps track of the labels made from folder names
+	Importer *importer.Importer
+	// Connects to the server and logs in
+	Dial func() (*Client, error)
+	// GetState, if set, returns the checkpoint of a folder from an earlier download.
+	GetState func(folder string) (store.ImapState, bool, error)
+	// OnFolder, if set, is called with the new checkpoint of each folder once all of its new
+	// messages have been sent on MessageChan. Save it once they have been saved.
+	OnFolder func(store.ImapState)
+	// OnListed, if set, is called with the number of new messages found in each folder.
+	OnListed func(count int)
+	// OnFailed, if set, is called for each message that can't be read. The folder's checkpoint
+	// stops below the first one, so it's tried again next time.
+	OnFailed func(origin string, err error)
+	// OnSent, if set, is called with the folder and UID of each message before it is sent on
+	// MessageChan.
+	OnSent func(folder string, uid uint32, id string)
+}
+
+func New(dial func() (*Client, error), im *importer.Importer, options Options) Downloader {
+	return Downloader{
+		MessageChan: make(chan *store.Message),
+		Options:     options,
+		Importer:    im,
+		Dial:        dial,
+	}
+}
+
+// Download sends the new messages in every folder on MessageChan, and closes it when done.
+// Cancelling ctx stops the download after the message being sent. A folder that can't be
+// downloaded is logged and skipped, and counted in the error returned once the others are done.
+func Download(ctx context.Context, d Downloader) error {
+	defer close(d.MessageChan)
+	c, err := d.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+	mailboxes, err := d.mailboxes(c)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, mailbox := range mailboxes {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := d.downloadFolder(ctx, c, mailbox); err != nil {
+			log.Printf("Unable to download IMAP folder %v: %v\n", mailbox.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v folders could not be downloaded", failed, len(mailboxes))
+	}
+	return nil
+}
+
+// Attributes of folders that only show messages that are in other folders too
+var virtualFolders = map[string]bool{`\all`: true, `\flagged`: true, `\important`: true}
+
+// mailboxes returns the folders to download.
+func (d Downloader) mailboxes(c *Client) ([]Mailbox, error) {
+	all, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, name := range d.Options.Folders {
+		wanted[name] = true
+	}
+	var mailboxes []Mailbox
+	for _, mailbox := range all {
+		if len(wanted) > 0 {
+			if wanted[mailbox.Name] || wanted[decodeMailboxName(mailbox.Name)] {
+				mailboxes = append(mailboxes, mailbox)
+				delete(wanted, mailbox.Name)
+				delete(wanted, decodeMailboxName(mailbox.Name))
+			}
+			continue
+		}
+		selectable := true
+		for _, attribute := range mailbox.Attributes {
+			attribute = strings.ToLower(attribute)
+			if attribute == `\noselect` || attribute == `\nonexistent` || virtualFolders[attribute] {
+				selectable = false
+			}
+		}
+		if selectable {
+			mailboxes = append(mailboxes, mailbox)
+		}
+	}
+	for name := range wanted {
+		log.Printf("There is no IMAP folder %v\n", name)
+	}
+	return mailboxes, nil
+}
+
+func (d Downloader) downloadFolder(ctx context.Context, c *Client, mailbox Mailbox) error {
+	folder, err := c.Examine(mailbox.Name)
+	if err != nil {
+		return err
+	}
+	state := store.ImapState{Account: d.Options.Account, Folder: mailbox.Name, UidValidity: folder.UidValidity}
+	criteria := "ALL"
+	if d.GetState != nil && !d.Options.Full {
+		saved, ok, err := d.GetState(mailbox.Name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ok && saved.UidValidity == folder.UidValidity:
+			state.LastUid = saved.LastUid
+			criteria = fmt.Sprintf("UID %d:*", saved.LastUid+1)
+		case ok:
+			log.Printf("The UIDs of IMAP folder %v have changed, so all of it is downloaded again\n", mailbox.Name)
+		}
+	}
+	var uids []uint32
+	if folder.Exists > 0 {
+		found, err := c.UidSearch(criteria)
+		if err != nil {
+			return err
+		}
+		for _, uid := range found {
+			// "UID n:*" always matches the last message, even if its UID is below n
+			if uid > state.LastUid {
+				uids = append(uids, uid)
+			}
+		}
+	}
+	if d.OnListed != nil {
+		d.OnListed(len(uids))
+	}
+	label := folderLabel(mailbox)
+	var firstFailed uint32
+	for start := 0; start < len(uids) && ctx.Err() == nil; start += fetchBatch {
+		end := start + fetchBatch
+		if end > len(uids) {
+			end = len(uids)
+		}
+		err := c.UidFetch(uids[start:end], func(fetched Fetched) error {
+			message, err := d.message(mailbox.Name, label, fetched)
+			if err != nil {
+				if firstFailed == 0 || fetched.Uid < firstFailed {
+					firstFailed = fetched.Uid
+				}
+				return nil
+			}
+			if message == nil {
+				return nil
+			}
+			if d.OnSent != nil {
+				d.OnSent(mailbox.Name, fetched.Uid, message.Id)
+			}
+			select {
+			case d.MessageChan <- message:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if uids[end-1] > state.LastUid {
+			state.LastUid = uids[end-1]
+		}
+	}
+	if firstFailed > 0 && firstFailed-1 < state.LastUid {
+		state.LastUid = firstFailed - 1
+	}
+	if ctx.Err() == nil && d.OnFolder != nil {
+		d.OnFolder(state)
+	}
+	return nil
+}
+
+// message converts a fetched message, labelled with the folder and its flags. Messages that are
+// marked as deleted (but haven't been expunged yet) are left out, and nil is returned for them.
+func (d Downloader) message(folder, label string, fetched Fetched) (*store.Message, error) {
+	labels, deleted := flagLabels(fetched.Flags)
+	if deleted {
+		return nil, nil
+	}
+	raw := importer.Raw{
+		Data:   fetched.Body,
+		Date:   fetched.InternalDate,
+		Labels: append([]string{label}, labels...),
+		Origin: fmt.Sprintf("%v UID %v", decodeMailboxName(folder), fetched.Uid),
+		Source: store.SourceImap,
+	}
+	message, err := d.Importer.Message(raw)
+	if err != nil {
+		log.Printf("Unable to read message %v: %v\n", raw.Origin, err)
+		if d.OnFailed != nil {
+			d.OnFailed(raw.Origin, err)
+		}
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Special uses of folders (RFC 6154), and the names Exchange and others give them when the
+// server doesn't say, as the names of labels
+var specialUses = map[string]string{
+	`\sent`:            "Sent",
+	`\drafts`:          "Drafts",
+	`\trash`:           "Trash",
+	`\junk`:            "Spam",
+	`\archive`:         "Archived",
+	"sent items":       "Sent",
+	"sent messages":    "Sent",
+	"deleted items":    "Trash",
+	"deleted messages": "Trash",
+	"junk":             "Spam",
+	"junk email":       "Spam",
+}
+
+// folderLabel returns the name of the label for messages in the folder: Inbox, what it is used
+// for if it's special (e.g. Sent), or otherwise its name with "/" between levels.
+func folderLabel(mailbox Mailbox) string {
+	if strings.EqualFold(mailbox.Name, "INBOX") {
+		return "Inbox"
+	}
+	for _, attribute := range mailbox.Attributes {
+		if label, ok := specialUses[strings.ToLower(attribute)]; ok {
+			return label
+		}
+	}
+	name := decodeMailboxName(mailbox.Name)
+	if label, ok := specialUses[strings.ToLower(name)]; ok {
+		return label
+	}
+	if mailbox.Delimiter != "" && mailbox.Delimiter != "/" {
+		name = strings.Replace(name, mailbox.Delimiter, "/", -1)
+	}
+	return name
+}
+
+// flagLabels returns the labels for a message's flags, and whether it is marked as deleted.
+func flagLabels(flags []string) ([]string, bool) {
+	var labels []string
+	seen, deleted := false, false
+	for _, flag := range flags {
+		switch strings.ToLower(flag) {
+		case `\seen`:
+			seen = true
+		case `\flagged`:
+			labels = append(labels, "Starred")
+		case `\draft`:
+			labels = append(labels, "Draft")
+		case `\deleted`:
+			deleted = true
+		}
+	}
+	if !seen {
+		labels = append(labels, "Unread")
+	}
+	return labels, deleted
+}
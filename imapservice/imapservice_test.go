@@ -0,0 +1,378 @@
+package imapservice
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/oaktown/calliope/importer"
+	"github.com/oaktown/calliope/source"
+	"github.com/oaktown/calliope/store"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testMessage struct {
+	uid     uint32
+	flags   string
+	subject string
+	// The whole message, if not one made from the subject
+	body string
+}
+
+type testFolder struct {
+	name        string
+	attributes  string
+	uidValidity uint32
+	messages    []testMessage
+}
+
+// testServer is an in-process IMAP server with just enough of the protocol for Client.
+type testServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	folders  []*testFolder
+}
+
+func newTestServer(t *testing.T, folders ...*testFolder) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{listener: listener, folders: folders}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) dial() (*Client, error) {
+	c, err := Dial(s.listener.Addr().String(), true)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Login("user", `pa"ss`)
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "* OK [CAPABILITY IMAP4rev1] Test server (not a real one) ready\r\n")
+	var selected *testFolder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+		tag, command, args := fields[0], strings.ToUpper(fields[1]), ""
+		if len(fields) == 3 {
+			args = fields[2]
+		}
+		s.mu.Lock()
+		switch command {
+		case "LOGIN":
+			if args != `"user" "pa\"ss"` {
+				fmt.Fprintf(conn, "%v NO [AUTHENTICATIONFAILED] Invalid credentials\r\n", tag)
+				break
+			}
+			fmt.Fprintf(conn, "%v OK Logged in\r\n", tag)
+		case "LIST":
+			fmt.Fprint(conn, "* LIST (\\Noselect) \"/\" \"[Gmail]\"\r\n")
+			for _, folder := range s.folders {
+				fmt.Fprintf(conn, "* LIST (%v) \"/\" %v\r\n", folder.attributes, quote(folder.name))
+			}
+			fmt.Fprintf(conn, "%v OK List completed\r\n", tag)
+		case "EXAMINE":
+			selected = nil
+			for _, folder := range s.folders {
+				if quote(folder.name) == args {
+					selected = folder
+				}
+			}
+			if selected == nil {
+				fmt.Fprintf(conn, "%v NO No such folder\r\n", tag)
+				break
+			}
+			fmt.Fprintf(conn, "* %d EXISTS\r\n* FLAGS (\\Seen \\Flagged \\Deleted \\Draft)\r\n", len(selected.messages))
+			fmt.Fprintf(conn, "* OK [UIDVALIDITY %d] UIDs valid\r\n", selected.uidValidity)
+			fmt.Fprintf(conn, "%v OK [READ-ONLY] Examine completed\r\n", tag)
+		case "UID":
+			sub := strings.SplitN(args, " ", 2)
+			switch strings.ToUpper(sub[0]) {
+			case "SEARCH":
+				fmt.Fprintf(conn, "* SEARCH%v\r\n", selected.search(sub[1]))
+			case "FETCH":
+				fmt.Fprint(conn, "* 1 FETCH (FLAGS (\\Seen))\r\n")
+				selected.fetch(conn, sub[1])
+			}
+			fmt.Fprintf(conn, "%v OK UID completed\r\n", tag)
+		case "LOGOUT":
+			fmt.Fprintf(conn, "* BYE Logging out\r\n%v OK Logout completed\r\n", tag)
+			s.mu.Unlock()
+			return
+		default:
+			fmt.Fprintf(conn, "%v BAD Unknown command\r\n", tag)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// search does "ALL" and "UID n:*", which (like on real servers) always matches the last message.
+func (f *testFolder) search(criteria string) string {
+	var from uint64
+	if strings.HasPrefix(criteria, "UID ") {
+		from, _ = strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(criteria, "UID "), ":*"), 10, 32)
+	}
+	var found string
+	for i, m := range f.messages {
+		if uint64(m.uid) >= from || i == len(f.messages)-1 {
+			found += fmt.Sprintf(" %d", m.uid)
+		}
+	}
+	return found
+}
+
+func (f *testFolder) fetch(conn net.Conn, set string) {
+	wanted := make(map[uint32]bool)
+	for _, part := range strings.Split(strings.Fields(set)[0], ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		first, _ := strconv.ParseUint(bounds[0], 10, 32)
+		last := first
+		if len(bounds) == 2 {
+			last, _ = strconv.ParseUint(bounds[1], 10, 32)
+		}
+		for uid := first; uid <= last; uid++ {
+			wanted[uint32(uid)] = true
+		}
+	}
+	for i, m := range f.messages {
+		if !wanted[m.uid] {
+			continue
+		}
+		body := fmt.Sprintf("Message-Id: <%v@example.com>\r\nSubject: %v\r\n\r\nHello\r\n", m.subject, m.subject)
+		if m.body != "" {
+			body = m.body
+		}
+		fmt.Fprintf(conn, "* %d FETCH (UID %d FLAGS (%v) INTERNALDATE \"17-Jul-1996 02:44:25 -0700\" BODY[] {%d}\r\n%v)\r\n",
+			i+1, m.uid, m.flags, len(body), body)
+	}
+}
+
+// download runs a download and returns the labels of the messages by subject, and the new checkpoints.
+func download(t *testing.T, server *testServer, states map[string]store.ImapState) (map[string][]string, map[string]store.ImapState) {
+	d := New(server.dial, importer.New("work", nil), Options{Account: "work"})
+	d.GetState = func(folder string) (store.ImapState, bool, error) {
+		state, ok := states[folder]
+		return state, ok, nil
+	}
+	saved := make(map[string]store.ImapState)
+	d.OnFolder = func(state store.ImapState) {
+		saved[state.Folder] = state
+	}
+	done := make(chan error)
+	go func() {
+		done <- Download(context.Background(), d)
+	}()
+	labels := make(map[string][]string)
+	for message := range d.MessageChan {
+		sort.Strings(message.LabelIds)
+		labels[message.Subject] = message.LabelIds
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return labels, saved
+}
+
+func TestDownload(t *testing.T) {
+	inbox := &testFolder{name: "INBOX", uidValidity: 7, messages: []testMessage{
+		{uid: 3, subject: "new"},
+		{uid: 5, flags: `\Seen \Flagged`, subject: "starred"},
+		{uid: 6, flags: `\Seen \Deleted`, subject: "deleted"},
+	}}
+	server := newTestServer(t,
+		inbox,
+		&testFolder{name: "Sent Items", uidValidity: 1, messages: []testMessage{{uid: 1, flags: `\Seen`, subject: "sent"}}},
+		&testFolder{name: "Archive/&AOk-t&AOk-", uidValidity: 1, messages: []testMessage{{uid: 2, flags: `\Seen`, subject: "summer"}}},
+		&testFolder{name: "[Gmail]/All Mail", attributes: `\HasNoChildren \All`, uidValidity: 1, messages: []testMessage{{uid: 1, subject: "all"}}},
+		&testFolder{name: "Empty", uidValidity: 9},
+	)
+	defer server.listener.Close()
+
+	labels, states := download(t, server, nil)
+	want := map[string][]string{
+		"new":     {"INBOX", "UNREAD"},
+		"starred": {"INBOX", "STARRED"},
+		"sent":    {"SENT"},
+		"summer":  {"Imported_Archive/été"},
+	}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("Expected labels %v, got %v", want, labels)
+	}
+	if state := states["INBOX"]; state.UidValidity != 7 || state.LastUid != 6 || state.Account != "work" {
+		t.Errorf("Expected INBOX checkpoint at UID 6 of UIDVALIDITY 7, got %+v", state)
+	}
+	if state, ok := states["Empty"]; !ok || state.UidValidity != 9 || state.LastUid != 0 {
+		t.Errorf("Expected a checkpoint for the empty folder, got %+v", state)
+	}
+
+	server.mu.Lock()
+	inbox.messages = append(inbox.messages, testMessage{uid: 8, subject: "newer"})
+	server.mu.Unlock()
+	labels, states = download(t, server, states)
+	if want := map[string][]string{"newer": {"INBOX", "UNREAD"}}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("Expected only the new message after the checkpoint, got %v", labels)
+	}
+	if states["INBOX"].LastUid != 8 {
+		t.Errorf("Expected INBOX checkpoint at UID 8, got %+v", states["INBOX"])
+	}
+
+	labels, _ = download(t, server, states)
+	if len(labels) != 0 {
+		t.Errorf("Expected no messages when nothing is new, got %v", labels)
+	}
+
+	server.mu.Lock()
+	inbox.uidValidity = 8
+	server.mu.Unlock()
+	labels, _ = download(t, server, states)
+	if len(labels) != 3 {
+		t.Errorf("Expected the whole INBOX again when UIDVALIDITY changes, got %v", labels)
+	}
+}
+
+func TestSource(t *testing.T) {
+	server := newTestServer(t,
+		&testFolder{name: "INBOX", uidValidity: 1, messages: []testMessage{{uid: 4, subject: "hi"}}},
+		&testFolder{name: "Receipts", uidValidity: 2, messages: []testMessage{{uid: 9, flags: `\Seen`, subject: "receipt"}}},
+		&testFolder{name: "Broken", uidValidity: 3, messages: []testMessage{
+			{uid: 2, subject: "read"},
+			{uid: 3, body: "Not a header\r\n\r\nHello\r\n"},
+			{uid: 4, subject: "later"},
+		}},
+		&testFolder{name: "Unsaved", uidValidity: 4, messages: []testMessage{{uid: 5, subject: "saved"}, {uid: 6, subject: "unsaved"}}},
+	)
+	defer server.listener.Close()
+	saved := make(map[string]uint32)
+	var src source.Source = NewSource(New(server.dial, importer.New("work", nil), Options{Account: "work"}),
+		func(state store.ImapState) error {
+			saved[state.Folder] = state.LastUid
+			return nil
+		})
+	messages, err := src.Download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for message := range messages {
+		if message.Content.Source != store.SourceImap {
+			t.Errorf("Content.Source = %v, want imap", message.Content.Source)
+		}
+		src.Finished(message.Id, message.Subject != "unsaved")
+		count++
+	}
+	if err := src.Err(); err != nil || count != 6 {
+		t.Fatalf("Expected 6 messages, got %v (error %v)", count, err)
+	}
+	var labelIds []string
+	for _, label := range src.Labels() {
+		labelIds = append(labelIds, label.Id)
+	}
+	sort.Strings(labelIds)
+	if want := []string{"Imported_Broken", "Imported_Receipts", "Imported_Unsaved"}; !reflect.DeepEqual(labelIds, want) {
+		t.Errorf("Expected labels %v to be added, got %v", want, labelIds)
+	}
+	if len(saved) != 0 {
+		t.Errorf("Expected no checkpoints before Commit, got %v", saved)
+	}
+	if err := src.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// Stopped below the message that couldn't be read and the one that wasn't saved
+	if want := map[string]uint32{"INBOX": 4, "Receipts": 9, "Broken": 2, "Unsaved": 5}; !reflect.DeepEqual(saved, want) {
+		t.Errorf("Expected checkpoints %v, got %v", want, saved)
+	}
+}
+
+func TestDownload_badLogin(t *testing.T) {
+	server := newTestServer(t)
+	defer server.listener.Close()
+	d := New(func() (*Client, error) {
+		c, err := Dial(server.listener.Addr().String(), true)
+		if err != nil {
+			return nil, err
+		}
+		return c, c.Login("user", "wrong")
+	}, importer.New("work", nil), Options{})
+	go func() {
+		for range d.MessageChan {
+		}
+	}()
+	err := Download(context.Background(), d)
+	if err == nil || !strings.Contains(err.Error(), "AUTHENTICATIONFAILED") {
+		t.Errorf("Expected the login to fail, got %v", err)
+	}
+}
+
+func TestUidSet(t *testing.T) {
+	tests := []struct {
+		uids []uint32
+		want string
+	}{
+		{[]uint32{1}, "1"},
+		{[]uint32{1, 2, 3, 7, 9, 10}, "1:3,7,9:10"},
+		{[]uint32{4, 6, 8}, "4,6,8"},
+	}
+	for _, test := range tests {
+		if got := uidSet(test.uids); got != test.want {
+			t.Errorf("uidSet(%v) = %q, want %q", test.uids, got, test.want)
+		}
+	}
+}
+
+func TestDecodeMailboxName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"INBOX", "INBOX"},
+		{"&AOk-t&AOk-", "été"},
+		{"Tom &- Jerry", "Tom & Jerry"},
+		{"&ZeVnLIqe-", "日本語"},
+		{"broken &AOk", "broken &AOk"},
+	}
+	for _, test := range tests {
+		if got := decodeMailboxName(test.name); got != test.want {
+			t.Errorf("decodeMailboxName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFolderLabel(t *testing.T) {
+	tests := []struct {
+		mailbox Mailbox
+		want    string
+	}{
+		{Mailbox{Name: "INBOX", Delimiter: "/"}, "Inbox"},
+		{Mailbox{Name: "Sent", Delimiter: "/", Attributes: []string{`\HasNoChildren`, `\Sent`}}, "Sent"},
+		{Mailbox{Name: "Junk Email", Delimiter: "/"}, "Spam"},
+		{Mailbox{Name: "INBOX.Work.Projects", Delimiter: "."}, "INBOX/Work/Projects"},
+		{Mailbox{Name: "Receipts"}, "Receipts"},
+	}
+	for _, test := range tests {
+		if got := folderLabel(test.mailbox); got != test.want {
+			t.Errorf("folderLabel(%+v) = %q, want %q", test.mailbox, got, test.want)
+		}
+	}
+}
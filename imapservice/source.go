@@ -0,0 +1,104 @@
+package imapservice
+
+import (
+	"context"
+	"github.com/oaktown/calliope/store"
+	"sync"
+)
+
+// Source is a Downloader as a source.Source. The checkpoints of the folders that were
+// downloaded to the end are saved with save when the download is committed, each stopping below
+// the first message in the folder that wasn't saved.
+type Source struct {
+	d      Downloader
+	save   func(store.ImapState) error
+	states []store.ImapState
+	err    error
+	done   chan struct{}
+	mu     sync.Mutex
+	// Messages sent that haven't been saved yet, by id
+	unsaved map[string][]sentMessage
+}
+
+type sentMessage struct {
+	folder string
+	uid    uint32
+}
+
+func NewSource(d Downloader, save func(store.ImapState) error) *Source {
+	return &Source{d: d, save: save, done: make(chan struct{}), unsaved: make(map[string][]sentMessage)}
+}
+
+func (s *Source) Download(ctx context.Context) (<-chan *store.Message, error) {
+	d := s.d
+	onFolder := d.OnFolder
+	d.OnFolder = func(state store.ImapState) {
+		s.states = append(s.states, state)
+		if onFolder != nil {
+			onFolder(state)
+		}
+	}
+	onSent := d.OnSent
+	d.OnSent = func(folder string, uid uint32, id string) {
+		s.mu.Lock()
+		s.unsaved[id] = append(s.unsaved[id], sentMessage{folder: folder, uid: uid})
+		s.mu.Unlock()
+		if onSent != nil {
+			onSent(folder, uid, id)
+		}
+	}
+	go func() {
+		defer close(s.done)
+		s.err = Download(ctx, d)
+	}()
+	return d.MessageChan, nil
+}
+
+// Finished records that a message was saved; the checkpoint of its folder can then go past it.
+func (s *Source) Finished(id string, saved bool) {
+	if !saved {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sent := s.unsaved[id]; len(sent) > 1 {
+		s.unsaved[id] = sent[1:]
+	} else {
+		delete(s.unsaved, id)
+	}
+}
+
+func (s *Source) Err() error {
+	<-s.done
+	return s.err
+}
+
+func (s *Source) Labels() []*store.Label {
+	labels, _ := s.d.Importer.Labels()
+	return labels
+}
+
+func (s *Source) Commit() error {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, state := range s.states {
+		for _, sent := range s.unsaved {
+			for _, m := range sent {
+				if m.folder == state.Folder && m.uid-1 < state.LastUid {
+					state.LastUid = m.uid - 1
+				}
+			}
+		}
+		if err := s.save(state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint saves nothing: a folder's checkpoint is only saved once all of it has been, so the
+// next download starts the folders that didn't finish again.
+func (s *Source) Checkpoint() error {
+	return nil
+}
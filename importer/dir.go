@@ -0,0 +1,145 @@
+package importer
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStopped is returned by WalkMaildir, WalkEml and ReadMbox when visit stopped them.
+var ErrStopped = errors.New("import stopped")
+
+// WalkMaildir calls visit with each message in the Maildir tree at root, from workers goroutines
+// at once, until visit returns false. Each message is labelled with its folder ("Inbox" for the
+// top level, which is the INBOX label, and e.g. "Work/Projects" for the Maildir++ folder
+// .Work.Projects) and with what its Maildir flags say (Unread, Starred, Trash, Draft).
+func WalkMaildir(root string, workers int, visit func(Raw) bool) error {
+	return walk(root, workers, visit, func(path string) (string, []string, bool) {
+		dir, file := filepath.Split(path)
+		dir = filepath.Clean(dir)
+		sub := filepath.Base(dir)
+		if sub != "cur" && sub != "new" || strings.HasPrefix(file, ".") {
+			return "", nil, false
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(dir))
+		if err != nil {
+			return "", nil, false
+		}
+		folder := maildirFolder(rel)
+		return folder, append([]string{folder}, maildirFlags(sub, file)...), true
+	})
+}
+
+// maildirFolder turns the path of a folder relative to the top of the Maildir into a label name.
+func maildirFolder(folder string) string {
+	if folder == "." {
+		return "Inbox"
+	}
+	folder = filepath.ToSlash(folder)
+	if strings.HasPrefix(folder, ".") && !strings.Contains(folder, "/") {
+		// Maildir++ keeps subfolders at the top level, separated by dots
+		return strings.Replace(strings.TrimPrefix(folder, "."), ".", "/", -1)
+	}
+	return folder
+}
+
+// maildirFlags returns the labels for the flags at the end of the name of a message file
+// ("1234.host:2,FS"). Messages in new haven't been seen by a mail client yet.
+func maildirFlags(sub, file string) []string {
+	var flags string
+	if i := strings.LastIndex(file, ":2,"); i >= 0 {
+		flags = file[i+3:]
+	}
+	var labels []string
+	if sub == "new" || !strings.Contains(flags, "S") {
+		labels = append(labels, "Unread")
+	}
+	if strings.Contains(flags, "F") {
+		labels = append(labels, "Starred")
+	}
+	if strings.Contains(flags, "T") {
+		labels = append(labels, "Trash")
+	}
+	if strings.Contains(flags, "D") {
+		labels = append(labels, "Draft")
+	}
+	return labels
+}
+
+// WalkEml calls visit with each .eml file in the directory tree at root, from workers
+// goroutines at once, until visit returns false. Each message is labelled with the directory it
+// is in, relative to root (e.g. "Production 3/Custodian A"); messages at the top have no label.
+func WalkEml(root string, workers int, visit func(Raw) bool) error {
+	return walk(root, workers, visit, func(path string) (string, []string, bool) {
+		if !strings.EqualFold(filepath.Ext(path), ".eml") || strings.HasPrefix(filepath.Base(path), ".") {
+			return "", nil, false
+		}
+		folder, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil || folder == "." {
+			return "", nil, err == nil
+		}
+		folder = filepath.ToSlash(folder)
+		return folder, []string{folder}, true
+	})
+}
+
+type messageFile struct {
+	path    string
+	folder  string
+	labels  []string
+	modTime time.Time
+}
+
+// walk finds the files under root that match says are messages (and gives the folder and labels
+// of), reads them and calls visit with them from workers goroutines. Files that can't be read are
+// logged and skipped.
+func walk(root string, workers int, visit func(Raw) bool, match func(path string) (string, []string, bool)) error {
+	files := make(chan messageFile)
+	stopped := make(chan struct{})
+	var stopOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				data, err := ioutil.ReadFile(f.path)
+				if err != nil {
+					log.Printf("Unable to read %v: %v\n", f.path, err)
+					continue
+				}
+				if !visit(Raw{Data: data, Date: f.modTime, Labels: f.labels, Folder: f.folder, Origin: f.path}) {
+					stopOnce.Do(func() { close(stopped) })
+					return
+				}
+			}
+		}()
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("Unable to read %v: %v\n", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		folder, labels, ok := match(path)
+		if !ok {
+			return nil
+		}
+		select {
+		case files <- messageFile{path: path, folder: folder, labels: labels, modTime: info.ModTime()}:
+			return nil
+		case <-stopped:
+			return ErrStopped
+		}
+	})
+	close(files)
+	wg.Wait()
+	return err
+}
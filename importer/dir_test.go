@@ -0,0 +1,106 @@
+package importer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func writeFiles(t *testing.T, root string, paths ...string) {
+	for _, path := range paths {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("Subject: "+filepath.Base(path)+"\n\nHi\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// walkLabels returns the labels of each message found by walk, by file name. The folder has to be
+// the first label.
+func walkLabels(t *testing.T, walk func(string, int, func(Raw) bool) error, root string) map[string][]string {
+	var mu sync.Mutex
+	found := make(map[string][]string)
+	err := walk(root, 3, func(raw Raw) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		found[filepath.Base(raw.Origin)] = raw.Labels
+		var folder string
+		if len(raw.Labels) > 0 {
+			folder = raw.Labels[0]
+		}
+		if raw.Folder != folder {
+			t.Errorf("%v: Folder = %q, want %q", raw.Origin, raw.Folder, folder)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestWalkMaildir(t *testing.T) {
+	root, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeFiles(t, root,
+		"cur/1.host:2,S",
+		"cur/2.host:2,FS",
+		"new/3.host",
+		"tmp/4.host",
+		".Work.Projects/cur/5.host:2,ST",
+		"Archive/2019/cur/6.host:2,DS",
+	)
+
+	got := walkLabels(t, WalkMaildir, root)
+	want := map[string][]string{
+		"1.host:2,S":  {"Inbox"},
+		"2.host:2,FS": {"Inbox", "Starred"},
+		"3.host":      {"Inbox", "Unread"},
+		"5.host:2,ST": {"Work/Projects", "Trash"},
+		"6.host:2,DS": {"Archive/2019", "Draft"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WalkMaildir() labels = %v, want %v", got, want)
+	}
+}
+
+func TestWalkEml(t *testing.T) {
+	root, err := ioutil.TempDir("", "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeFiles(t, root, "top.eml", "Production 3/Custodian A/a.EML", "Production 3/notes.txt", ".hidden.eml")
+
+	got := walkLabels(t, WalkEml, root)
+	want := map[string][]string{
+		"top.eml": nil,
+		"a.EML":   {"Production 3/Custodian A"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WalkEml() labels = %v, want %v", got, want)
+	}
+}
+
+func TestWalk_stopped(t *testing.T) {
+	root, err := ioutil.TempDir("", "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeFiles(t, root, "1.eml", "2.eml", "3.eml", "4.eml", "5.eml")
+
+	err = WalkEml(root, 1, func(raw Raw) bool { return false })
+	if err != ErrStopped {
+		t.Errorf("WalkEml() = %v, want ErrStopped", err)
+	}
+}
@@ -0,0 +1,273 @@
+// Package importer turns messages from files (e.g. Google Takeout mbox exports) into the same
+// store.Message documents that Gmail downloads are saved as.
+package importer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"github.com/oaktown/calliope/blob"
+	"github.com/oaktown/calliope/gmailservice"
+	"github.com/oaktown/calliope/store"
+	"log"
+	"mime"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Raw is a message to import, along with what is known about it from outside the message
+// itself (e.g. from the "From " line of an mbox file).
+type Raw struct {
+	Data []byte
+	// Gmail message id, if known; otherwise one is made up from the message
+	Id string
+	// Used if the message has no Date header
+	Date time.Time
+	// Names of labels to add to any in X-Gmail-Labels, e.g. the folder the message was in
+	Labels []string
+	// Folder the message was in, if a copy of it could be in another folder too (e.g. in a
+	// Maildir). It's part of the made up id, so that each copy is kept with its folder's label.
+	Folder string
+	// Where the message came from (e.g. the file), for error messages
+	Origin string
+	// Kind of source it came from, for Content.Source; store.SourceFile if ""
+	Source string
+}
+
+// Length of the snippet made from the body, which Gmail would otherwise provide
+const snippetLength = 200
+
+// Gmail's names for its system labels, as they appear in X-Gmail-Labels, and their ids.
+// "Opened" and "Archived" say that a message isn't UNREAD or in the INBOX, so they have no id.
+var systemLabels = map[string]string{
+	"inbox":               "INBOX",
+	"sent":                "SENT",
+	"important":           "IMPORTANT",
+	"starred":             "STARRED",
+	"unread":              "UNREAD",
+	"trash":               "TRASH",
+	"spam":                "SPAM",
+	"drafts":              "DRAFT",
+	"draft":               "DRAFT",
+	"chat":                "CHAT",
+	"category personal":   "CATEGORY_PERSONAL",
+	"category social":     "CATEGORY_SOCIAL",
+	"category promotions": "CATEGORY_PROMOTIONS",
+	"category updates":    "CATEGORY_UPDATES",
+	"category forums":     "CATEGORY_FORUMS",
+	"opened":              "",
+	"archived":            "",
+}
+
+// Importer converts raw messages for an account. Labels that the account doesn't have yet are
+// added as they are found; save them with Labels afterwards. Message can be called from many
+// goroutines at once.
+type Importer struct {
+	Account   string
+	InboxUrl  string
+	StartedAt time.Time
+	// Keep the original source of each message, as download --raw does
+	Raw bool
+	// Where to save the content of attachments; if nil, only their metadata is kept
+	Blobs  *blob.Store
+	mu     sync.Mutex
+	labels map[string]*store.Label // by name
+	added  bool
+}
+
+// New returns an Importer for the account, which already has the labels.
+func New(account string, labels []*store.Label) *Importer {
+	im := &Importer{
+		Account:   account,
+		StartedAt: time.Now(),
+		labels:    make(map[string]*store.Label),
+	}
+	for _, label := range labels {
+		im.labels[label.Name] = label
+	}
+	return im
+}
+
+// Labels returns the account's labels, including any added by imported messages, and whether
+// any were added.
+func (im *Importer) Labels() ([]*store.Label, bool) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	labels := make([]*store.Label, 0, len(im.labels))
+	for _, label := range im.labels {
+		labels = append(labels, label)
+	}
+	return labels, im.added
+}
+
+// labelId returns the id of the label with the name, adding it if it's new. User labels made
+// by an import have ids like "Imported_Receipts" (Gmail's own are like "Label_12").
+func (im *Importer) labelId(name string) string {
+	if id, ok := systemLabels[strings.ToLower(name)]; ok {
+		return id
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if label, ok := im.labels[name]; ok {
+		return label.Id
+	}
+	label := &store.Label{Id: "Imported_" + name, Name: name, Account: im.Account}
+	im.labels[name] = label
+	im.added = true
+	return label.Id
+}
+
+// Message converts a raw message. Gmail's X-GM-THRID and X-Gmail-Labels headers (which Takeout
+// adds) become the ThreadId and LabelIds. Messages without X-GM-THRID have no ThreadId, and are
+// put in a conversation from their references when they're saved.
+func (im *Importer) Message(raw Raw) (store.Message, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw.Data))
+	if err != nil {
+		return store.Message{}, err
+	}
+	header := msg.Header
+	id := raw.Id
+	if id == "" {
+		id = messageId(header, raw.Data, raw.Folder)
+	}
+	var threadId string
+	if thrid, err := strconv.ParseUint(header.Get("X-GM-THRID"), 10, 64); err == nil {
+		threadId = strconv.FormatUint(thrid, 16)
+	}
+	date, err := mail.ParseDate(header.Get("Date"))
+	if err != nil {
+		date = raw.Date
+	}
+	var labelIds []string
+	for _, name := range append(splitLabels(header.Get("X-Gmail-Labels")), raw.Labels...) {
+		if id := im.labelId(name); id != "" && !store.HasLabel(labelIds, id) {
+			labelIds = append(labelIds, id)
+		}
+	}
+	var attachments []store.Attachment
+	parts, err := gmailservice.WalkRawMessage(bytes.NewReader(raw.Data), func(part store.Part, data []byte) {
+		attachments = append(attachments, im.attachment(id, part, data))
+	})
+	if err != nil {
+		// Keep whatever could be decoded rather than losing the whole message
+		log.Printf("Unable to decode all of the body of message %v: %v\n", id, err)
+	}
+	body := gmailservice.PartBodies(parts).PlainText()
+	message := store.Message{
+		Id:                  id,
+		Account:             im.Account,
+		ThreadId:            threadId,
+		LabelIds:            labelIds,
+		Starred:             store.HasLabel(labelIds, "STARRED"),
+		Unread:              store.HasLabel(labelIds, "UNREAD"),
+		Date:                date,
+		DownloadedStartedAt: im.StartedAt,
+		To:                  decodeHeader(header.Get("To")),
+		Cc:                  decodeHeader(header.Get("Cc")),
+		Bcc:                 decodeHeader(header.Get("Bcc")),
+		From:                decodeHeader(header.Get("From")),
+		ReplyTo:             decodeHeader(header.Get("Reply-To")),
+		Subject:             decodeHeader(header.Get("Subject")),
+		Snippet:             snippet(body),
+		Body:                body,
+		Addresses:           gmailservice.ParseAddressHeaders(header.Get),
+		Attachments:         attachments,
+		Content:             store.Content{Source: raw.Source, Parts: parts},
+	}
+	split := gmailservice.SplitBody(body)
+	message.NewContent, message.QuotedContent, message.Signature = split.New, split.Quoted, split.Signature
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			message.Headers.Add(name, decodeHeader(value))
+		}
+	}
+	if message.Content.Source == "" {
+		message.Content.Source = store.SourceFile
+	}
+	if im.InboxUrl != "" && header.Get("X-GM-THRID") != "" {
+		message.Url = fmt.Sprintf("%v#inbox/%v", im.InboxUrl, threadId)
+	}
+	if im.Raw {
+		message.Raw = raw.Data
+	}
+	return message, nil
+}
+
+// attachment returns the metadata of an attachment of the message, saving its content to Blobs
+// if there is one. Attachments that can't be saved are logged and left without a hash.
+func (im *Importer) attachment(messageId string, part store.Part, data []byte) store.Attachment {
+	attachment := store.Attachment{Filename: part.Filename, MimeType: part.MimeType, Size: part.Size}
+	if im.Blobs == nil {
+		return attachment
+	}
+	hash, err := im.Blobs.Put(data)
+	if err != nil {
+		log.Printf("Unable to save attachment %v of message %v: %v\n", part.Filename, messageId, err)
+		return attachment
+	}
+	attachment.Sha256 = hash
+	return attachment
+}
+
+// messageId makes up a stable id for a message that didn't come from Gmail, so that importing
+// it again updates it rather than adding a copy. The same Message-ID in the same folder gets the
+// same id; copies in other folders get their own, so none of them lose their folder's label.
+func messageId(header mail.Header, data []byte, folder string) string {
+	key := []byte(strings.TrimSpace(header.Get("Message-Id")))
+	if len(key) == 0 {
+		key = data
+	}
+	if folder != "" {
+		key = append([]byte(folder+"\x00"), key...)
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// splitLabels splits X-Gmail-Labels, which is comma separated with names that have commas in
+// them quoted.
+func splitLabels(value string) []string {
+	if value == "" {
+		return nil
+	}
+	r := csv.NewReader(strings.NewReader(decodeHeader(value)))
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+	names, err := r.Read()
+	if err != nil {
+		return strings.Split(value, ",")
+	}
+	return names
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: gmailservice.CharsetReader}
+
+// decodeHeader decodes RFC 2047 encoded words (=?UTF-8?Q?...?=), which Gmail would otherwise
+// have done. Headers that can't be decoded are kept as they are.
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func snippet(body string) string {
+	words := strings.Fields(body)
+	s := strings.Join(words, " ")
+	if runes := []rune(s); len(runes) > snippetLength {
+		return string(runes[:snippetLength])
+	}
+	return s
+}
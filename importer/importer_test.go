@@ -0,0 +1,152 @@
+package importer
+
+import (
+	"github.com/oaktown/calliope/blob"
+	"github.com/oaktown/calliope/store"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestImporter_Message(t *testing.T) {
+	data := "Received: from b.example.com\r\n" +
+		"Received: from a.example.com\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"From: =?UTF-8?Q?Jos=C3=A9?= <jose@example.com>\r\n" +
+		"To: amy@example.com\r\n" +
+		"Reply-To: Orders <orders@shop.example.com>\r\n" +
+		"Subject: =?ISO-8859-1?Q?Caf=E9?=\r\n" +
+		"Date: Tue, 21 Apr 2020 11:37:26 -0700\r\n" +
+		"X-GM-THRID: 1664789251236541568\r\n" +
+		"X-Gmail-Labels: Inbox,Unread,Category Updates,\"Receipts, 2020\",Travel\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Your   order\r\nhas shipped.\r\n"
+	im := New("home", []*store.Label{{Id: "Label_7", Name: "Travel"}})
+
+	message, err := im.Message(Raw{Data: []byte(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Account != "home" || message.From != "José <jose@example.com>" || message.Subject != "Café" {
+		t.Errorf("message = %+v", message)
+	}
+	wantFrom := []store.Address{{Name: "José", Address: "jose@example.com", Domain: "example.com"}}
+	if !reflect.DeepEqual(message.Addresses.From, wantFrom) || message.ReplyTo != "Orders <orders@shop.example.com>" ||
+		len(message.Addresses.ReplyTo) != 1 || message.Addresses.ReplyTo[0].Domain != "shop.example.com" {
+		t.Errorf("Addresses = %+v, ReplyTo = %q", message.Addresses, message.ReplyTo)
+	}
+	if received := message.Headers.Values("received"); !reflect.DeepEqual(received, []string{"from b.example.com", "from a.example.com"}) ||
+		message.Headers.Get("Subject") != "Café" {
+		t.Errorf("Headers = %v", message.Headers)
+	}
+	if message.ThreadId != "171a8500e9d7b480" {
+		t.Errorf("ThreadId = %v, want X-GM-THRID in hex", message.ThreadId)
+	}
+	wantLabels := []string{"INBOX", "UNREAD", "CATEGORY_UPDATES", "Imported_Receipts, 2020", "Label_7"}
+	if !reflect.DeepEqual(message.LabelIds, wantLabels) || !message.Unread {
+		t.Errorf("LabelIds = %v, want %v", message.LabelIds, wantLabels)
+	}
+	if want := time.Date(2020, 4, 21, 18, 37, 26, 0, time.UTC); !message.Date.Equal(want) {
+		t.Errorf("Date = %v, want %v", message.Date, want)
+	}
+	if message.Body != "Your   order\r\nhas shipped.\r\n" || message.Snippet != "Your order has shipped." {
+		t.Errorf("Body = %q, Snippet = %q", message.Body, message.Snippet)
+	}
+	if message.NewContent != "Your   order\nhas shipped." || message.QuotedContent != "" {
+		t.Errorf("NewContent = %q, QuotedContent = %q", message.NewContent, message.QuotedContent)
+	}
+	if labels, added := im.Labels(); !added || len(labels) != 2 {
+		t.Errorf("Labels() = %v, %v; want Travel and the new label", labels, added)
+	}
+
+	again, _ := im.Message(Raw{Data: []byte(data)})
+	if again.Id != message.Id || len(message.Id) != 16 {
+		t.Errorf("ids %v and %v, want the same made up id each time", message.Id, again.Id)
+	}
+	read, _ := im.Message(Raw{Data: []byte(data), Folder: "Travel", Labels: []string{"Travel"}})
+	reread, _ := im.Message(Raw{Data: []byte(data), Folder: "Travel"})
+	other, _ := im.Message(Raw{Data: []byte(data), Folder: "Archive"})
+	if read.Id != reread.Id || read.Id == message.Id || other.Id == read.Id {
+		t.Errorf("ids %v, %v and %v, want the same id for each folder and different ids in different folders", read.Id, reread.Id, other.Id)
+	}
+	takeout, _ := im.Message(Raw{Data: []byte(data), Id: "171a8500e9d7b480"})
+	if takeout.Id != "171a8500e9d7b480" {
+		t.Errorf("Id = %v, want the one given", takeout.Id)
+	}
+}
+
+func TestImporter_MessageContent(t *testing.T) {
+	data := "Subject: Hi\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>Hello</p>\r\n" +
+		"--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=\"notes.txt\"\r\n\r\nNotes\r\n" +
+		"--b--\r\n"
+	im := New("home", nil)
+	message, err := im.Message(Raw{Data: []byte(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := store.Content{Source: store.SourceFile, Parts: []store.Part{
+		{MimeType: "text/plain", Text: "Hello", Size: 5},
+		{MimeType: "text/html", Text: "<p>Hello</p>", Size: 12},
+		{MimeType: "text/plain", Filename: "notes.txt", Size: 5},
+	}}
+	if !reflect.DeepEqual(message.Content, want) {
+		t.Errorf("Content = %+v, want %+v", message.Content, want)
+	}
+	message, _ = im.Message(Raw{Data: []byte(data), Source: store.SourceImap})
+	if message.Content.Source != store.SourceImap {
+		t.Errorf("Content.Source = %v, want %v", message.Content.Source, store.SourceImap)
+	}
+}
+
+func TestImporter_MessageAttachments(t *testing.T) {
+	data := "Subject: Hi\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n" +
+		"--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=\"notes.txt\"\r\n\r\nNotes\r\n" +
+		"--b\r\nContent-Type: image/png; name=\"dot.png\"\r\nContent-Transfer-Encoding: base64\r\n\r\niVBORw==\r\n" +
+		"--b--\r\n"
+	dir, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobs, err := blob.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := New("home", nil)
+	message, err := im.Message(Raw{Data: []byte(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []store.Attachment{
+		{Filename: "notes.txt", MimeType: "text/plain", Size: 5},
+		{Filename: "dot.png", MimeType: "image/png", Size: 4},
+	}
+	if !reflect.DeepEqual(message.Attachments, want) {
+		t.Errorf("without Blobs, Attachments = %+v, want %+v", message.Attachments, want)
+	}
+	im.Blobs = blobs
+	message, err = im.Message(Raw{Data: []byte(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want[0].Sha256 = blob.Hash([]byte("Notes"))
+	want[1].Sha256 = blob.Hash([]byte("\x89PNG"))
+	if !reflect.DeepEqual(message.Attachments, want) {
+		t.Errorf("with Blobs, Attachments = %+v, want %+v", message.Attachments, want)
+	}
+	f, err := blobs.Open(want[1].Sha256)
+	if err != nil {
+		t.Fatalf("attachment wasn't saved: %v", err)
+	}
+	f.Close()
+}
@@ -0,0 +1,121 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MboxReader reads the messages in an mbox file (e.g. from Google Takeout or Thunderbird) one
+// at a time, so that files much bigger than memory can be imported.
+type MboxReader struct {
+	r    *bufio.Reader
+	from string // the "From " line of the next message, once it has been read
+	err  error
+}
+
+func NewMboxReader(r io.Reader) *MboxReader {
+	return &MboxReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next message, or io.EOF when there are no more.
+func (m *MboxReader) Next() (Raw, error) {
+	if m.from == "" {
+		// Skip anything before the first message
+		for {
+			line, err := m.readLine()
+			if err != nil {
+				return Raw{}, err
+			}
+			if isFromLine(line) {
+				m.from = string(bytes.TrimRight(line, "\r\n"))
+				break
+			}
+		}
+	}
+	if m.err != nil {
+		return Raw{}, m.err
+	}
+	raw := envelope(m.from)
+	var data bytes.Buffer
+	for {
+		line, err := m.readLine()
+		if err != nil {
+			// The last message ends at the end of the file
+			m.err = err
+			break
+		}
+		if isFromLine(line) {
+			m.from = string(bytes.TrimRight(line, "\r\n"))
+			break
+		}
+		data.Write(unquoteFrom(line))
+	}
+	raw.Data = trimSeparator(data.Bytes())
+	return raw, nil
+}
+
+func (m *MboxReader) readLine() ([]byte, error) {
+	line, err := m.r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		return line, nil
+	}
+	return line, err
+}
+
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// unquoteFrom undoes the quoting of lines in the message that would otherwise look like the
+// start of the next one (">From " is written for "From ", ">>From " for ">From " and so on).
+func unquoteFrom(line []byte) []byte {
+	unquoted := bytes.TrimLeft(line, ">")
+	if len(unquoted) < len(line) && isFromLine(unquoted) {
+		return line[1:]
+	}
+	return line
+}
+
+// trimSeparator removes the blank line that separates a message from the next "From " line.
+func trimSeparator(data []byte) []byte {
+	if bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+		return data[:len(data)-2]
+	}
+	if bytes.HasSuffix(data, []byte("\n\n")) {
+		return data[:len(data)-1]
+	}
+	return data
+}
+
+// The dates on "From " lines are usually like time.ANSIC, sometimes with a zone as well.
+var fromLineDates = []string{
+	"Mon Jan _2 15:04:05 -0700 2006",
+	"Mon Jan _2 15:04:05 2006",
+	"Mon Jan _2 15:04:05 MST 2006",
+}
+
+// envelope gets what it can from the "From " line of a message. Google Takeout puts the Gmail
+// message id (in decimal) where the sender usually goes: "From 1234567890123456789@xxx Tue ...".
+func envelope(fromLine string) Raw {
+	var raw Raw
+	fields := strings.SplitN(strings.TrimPrefix(fromLine, "From "), " ", 2)
+	if at := strings.Index(fields[0], "@"); at > 0 && strings.HasSuffix(fields[0], "@xxx") {
+		if id, err := strconv.ParseUint(fields[0][:at], 10, 64); err == nil {
+			raw.Id = strconv.FormatUint(id, 16)
+		}
+	}
+	if len(fields) == 2 {
+		date := strings.TrimSpace(fields[1])
+		for _, layout := range fromLineDates {
+			if t, err := time.Parse(layout, date); err == nil {
+				raw.Date = t
+				break
+			}
+		}
+	}
+	return raw
+}
@@ -0,0 +1,52 @@
+package importer
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMboxReader(t *testing.T) {
+	mbox := "From 1618033988749894848@xxx Tue Apr 21 18:37:26 +0000 2020\n" +
+		"Subject: one\n" +
+		"\n" +
+		"Hello\n" +
+		">From the top\n" +
+		">>From here\n" +
+		"\n" +
+		"From someone@example.com Wed Apr 22 09:00:00 2020\r\n" +
+		"Subject: two\r\n" +
+		"\r\n" +
+		"Bye\r\n"
+	r := NewMboxReader(strings.NewReader(mbox))
+
+	first, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Subject: one\n\nHello\nFrom the top\n>From here\n"; string(first.Data) != want {
+		t.Errorf("first message = %q, want %q", first.Data, want)
+	}
+	if first.Id != "167469570df224c0" {
+		t.Errorf("first message id = %q, want the Takeout id in hex", first.Id)
+	}
+	if want := time.Date(2020, 4, 21, 18, 37, 26, 0, time.UTC); !first.Date.Equal(want) {
+		t.Errorf("first message date = %v, want %v", first.Date, want)
+	}
+
+	second, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Subject: two\r\n\r\nBye\r\n"; string(second.Data) != want {
+		t.Errorf("second message = %q, want %q", second.Data, want)
+	}
+	if second.Id != "" {
+		t.Errorf("second message id = %q, want none", second.Id)
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("after the last message, err = %v, want EOF", err)
+	}
+}
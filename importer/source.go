@@ -0,0 +1,144 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"github.com/oaktown/calliope/store"
+	"io"
+	"log"
+	"os"
+)
+
+// Source imports files (or directories of them) as a source.Source, reading each one with read
+// and converting the messages with an Importer. Imports aren't checkpointed: importing the same
+// files again updates the messages that were imported before rather than adding copies.
+type Source struct {
+	im    *Importer
+	paths []string
+	read  func(path string, visit func(Raw) bool) error
+	// Called when starting on each file or directory, with every message read, and with each
+	// message that can't be converted. Any of them can be nil.
+	OnOpen   func(path string)
+	OnListed func(n int)
+	OnFailed func(origin string, err error)
+	err      error
+	done     chan struct{}
+}
+
+// NewSource returns a Source that calls read for each of the paths, which calls visit with each
+// message it finds until visit returns false (and then returns ErrStopped).
+func NewSource(im *Importer, paths []string, read func(path string, visit func(Raw) bool) error) *Source {
+	return &Source{im: im, paths: paths, read: read, done: make(chan struct{})}
+}
+
+// MboxSource imports every message in the mbox files.
+func MboxSource(im *Importer, paths []string) *Source {
+	return NewSource(im, paths, ReadMbox)
+}
+
+// MaildirSource imports every message in the Maildir trees (see WalkMaildir), reading workers
+// files at once.
+func MaildirSource(im *Importer, dirs []string, workers int) *Source {
+	return NewSource(im, dirs, func(dir string, visit func(Raw) bool) error {
+		return WalkMaildir(dir, workers, visit)
+	})
+}
+
+// EmlSource imports every .eml file in the directory trees (see WalkEml), reading workers files
+// at once.
+func EmlSource(im *Importer, dirs []string, workers int) *Source {
+	return NewSource(im, dirs, func(dir string, visit func(Raw) bool) error {
+		return WalkEml(dir, workers, visit)
+	})
+}
+
+// ReadMbox calls visit with each message in the mbox file until visit returns false.
+func ReadMbox(path string, visit func(Raw) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mbox := NewMboxReader(f)
+	for n := 1; ; n++ {
+		raw, err := mbox.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		raw.Origin = fmt.Sprintf("%v (message %v)", path, n)
+		if !visit(raw) {
+			return ErrStopped
+		}
+	}
+}
+
+// Download reads the files in the background. A file that can't be read is logged and the rest
+// are still imported; Err returns the first such error.
+func (s *Source) Download(ctx context.Context) (<-chan *store.Message, error) {
+	messages := make(chan *store.Message)
+	visit := func(raw Raw) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		if s.OnListed != nil {
+			s.OnListed(1)
+		}
+		message, err := s.im.Message(raw)
+		if err != nil {
+			log.Printf("Unable to read message in %v: %v\n", raw.Origin, err)
+			if s.OnFailed != nil {
+				s.OnFailed(raw.Origin, err)
+			}
+			return true
+		}
+		select {
+		case messages <- &message:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		defer close(s.done)
+		defer close(messages)
+		for _, path := range s.paths {
+			if s.OnOpen != nil {
+				s.OnOpen(path)
+			}
+			err := s.read(path, visit)
+			if err == ErrStopped {
+				return
+			}
+			if err != nil {
+				log.Printf("Error reading %v: %v\n", path, err)
+				if s.err == nil {
+					s.err = fmt.Errorf("%v: %v", path, err)
+				}
+			}
+		}
+	}()
+	return messages, nil
+}
+
+func (s *Source) Finished(id string, saved bool) {}
+
+func (s *Source) Err() error {
+	<-s.done
+	return s.err
+}
+
+func (s *Source) Labels() []*store.Label {
+	labels, _ := s.im.Labels()
+	return labels
+}
+
+func (s *Source) Commit() error {
+	return nil
+}
+
+func (s *Source) Checkpoint() error {
+	return nil
+}
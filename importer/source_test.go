@@ -0,0 +1,83 @@
+package importer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMboxSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calliope-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mbox := "From a@example.com Tue Apr 21 18:37:26 2020\n" +
+		"Subject: one\nX-Gmail-Labels: Receipts\n\nHello\n\n" +
+		"From b@example.com Wed Apr 22 09:00:00 2020\n" +
+		"Subject: two\n\nBye\n"
+	path := filepath.Join(dir, "all.mbox")
+	if err := ioutil.WriteFile(path, []byte(mbox), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.mbox")
+
+	src := MboxSource(New("home", nil), []string{missing, path})
+	var opened []string
+	var listed int
+	src.OnOpen = func(path string) { opened = append(opened, path) }
+	src.OnListed = func(n int) { listed += n }
+	messages, err := src.Download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	for message := range messages {
+		subjects = append(subjects, message.Subject)
+		src.Finished(message.Id, true)
+	}
+	if want := []string{"one", "two"}; !reflect.DeepEqual(subjects, want) {
+		t.Errorf("subjects = %v, want %v", subjects, want)
+	}
+	if want := []string{missing, path}; !reflect.DeepEqual(opened, want) || listed != 2 {
+		t.Errorf("opened %v and listed %v, want %v and 2", opened, listed, want)
+	}
+	if src.Err() == nil {
+		t.Errorf("Expected an error for the missing file")
+	}
+	labels := src.Labels()
+	if len(labels) != 1 || labels[0].Name != "Receipts" {
+		t.Errorf("Labels() = %+v, want the Receipts label", labels)
+	}
+}
+
+func TestMboxSource_stopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calliope-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "all.mbox")
+	mbox := "From a@example.com Tue Apr 21 18:37:26 2020\nSubject: one\n\nHello\n\n" +
+		"From b@example.com Wed Apr 22 09:00:00 2020\nSubject: two\n\nBye\n"
+	if err := ioutil.WriteFile(path, []byte(mbox), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	src := MboxSource(New("home", nil), []string{path, path})
+	messages, err := src.Download(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-messages
+	cancel()
+	for range messages {
+	}
+	if err := src.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil after being stopped", err)
+	}
+}
@@ -29,5 +29,6 @@ func (c Logger) Write(p []byte) (n int, err error) {
 func main() {
 	logger := NewLogger("calliope.log")
 	log.SetOutput(logger)
+	cmd.LogFile = logger.Writer
 	cmd.Execute()
 }
@@ -0,0 +1,131 @@
+package misc
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/oaktown/calliope/auth"
+	"github.com/oaktown/calliope/store"
+	"github.com/spf13/viper"
+)
+
+// Account is an account from the accounts section of the config: a Gmail account, unless Type
+// says otherwise.
+type Account struct {
+	Name string
+	// AccountGmail (the default) or AccountImap
+	Type         string
+	ClientSecret string `mapstructure:"client_secret"`
+	Token        string
+	InboxUrl     string `mapstructure:"inbox_url"`
+	Imap         ImapAccount
+}
+
+// Types of account
+const (
+	AccountGmail = "gmail"
+	AccountImap  = "imap"
+)
+
+// ImapAccount is where to download an account of type imap from.
+type ImapAccount struct {
+	// host:port, e.g. imap.fastmail.com:993
+	Server string
+	User   string
+	// Environment variable that has the password in it (default CALLIOPE_IMAP_PASSWORD), so
+	// that it isn't in the config
+	PasswordEnv string `mapstructure:"password_env"`
+	// Folders to download; every folder if empty
+	Folders []string
+	// Connect without TLS
+	Insecure bool
+}
+
+// DefaultImapPasswordEnv is the environment variable that IMAP passwords are read from by default.
+const DefaultImapPasswordEnv = "CALLIOPE_IMAP_PASSWORD"
+
+// Password returns the password from the environment.
+func (a ImapAccount) Password() string {
+	if a.PasswordEnv == "" {
+		return os.Getenv(DefaultImapPasswordEnv)
+	}
+	return os.Getenv(a.PasswordEnv)
+}
+
+// Accounts returns the configured accounts with defaults filled in. If there are none, there is
+// just the default account, which uses client_secret.json and oauth_token.json.
+func Accounts() ([]Account, error) {
+	var accounts []Account
+	if err := viper.UnmarshalKey("accounts", &accounts); err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return []Account{{
+			Name:         store.DefaultAccount,
+			Type:         AccountGmail,
+			ClientSecret: auth.DefaultClientSecretFile,
+			Token:        auth.DefaultTokenFile,
+		}}, nil
+	}
+	for i := range accounts {
+		account := &accounts[i]
+		if account.Name == "" {
+			return nil, fmt.Errorf("account %d in config has no name", i+1)
+		}
+		switch account.Type {
+		case "":
+			account.Type = AccountGmail
+		case AccountGmail, AccountImap:
+		default:
+			return nil, fmt.Errorf("account %v in config has unknown type %v", account.Name, account.Type)
+		}
+		if account.ClientSecret == "" {
+			account.ClientSecret = auth.DefaultClientSecretFile
+		}
+		if account.Token == "" {
+			account.Token = fmt.Sprintf("oauth_token_%v.json", account.Name)
+		}
+	}
+	return accounts, nil
+}
+
+// GetAccount returns the named account. The name can be left out if there is only one account.
+func GetAccount(name string) Account {
+	accounts, err := Accounts()
+	if err != nil {
+		log.Fatalf("could not read accounts from config, %v", err)
+	}
+	if name == "" {
+		if len(accounts) > 1 {
+			log.Fatalf("there are %v accounts in the config; choose one with --account", len(accounts))
+		}
+		return accounts[0]
+	}
+	for _, account := range accounts {
+		if account.Name == name {
+			return account
+		}
+	}
+	log.Fatalf("account %v is not in the config", name)
+	return Account{}
+}
+
+// GetGmailHttpClientFor returns the authorized HTTP client for the account.
+func GetGmailHttpClientFor(account Account) *http.Client {
+	client, err := GmailHttpClientFor(account)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return client
+}
+
+// GmailHttpClientFor is GetGmailHttpClientFor for callers that carry on after an error.
+func GmailHttpClientFor(account Account) (*http.Client, error) {
+	client, err := auth.ClientFor(ctx, account.ClientSecret, account.Token)
+	if err != nil {
+		return nil, fmt.Errorf("could not get auth client for account %v, %v", account.Name, err)
+	}
+	return client, nil
+}
@@ -0,0 +1,21 @@
+package misc
+
+import (
+	"log"
+
+	"github.com/oaktown/calliope/blob"
+	"github.com/spf13/viper"
+)
+
+// AttachmentsDir returns the directory attachments are saved in, or "" if they aren't saved.
+func AttachmentsDir() string {
+	return viper.GetString("attachments_dir")
+}
+
+func GetBlobStore(dir string) *blob.Store {
+	s, err := blob.New(dir)
+	if err != nil {
+		log.Fatalf("could not create attachments directory %v, %v", dir, err)
+	}
+	return s
+}
@@ -3,6 +3,7 @@ package misc
 import (
 	"context"
 	"log"
+	"net/http"
 
 	"github.com/oaktown/calliope/auth"
 	"github.com/oaktown/calliope/store"
@@ -16,6 +17,10 @@ func GetGmailClient() *gmail.Service {
 	if err != nil {
 		log.Fatalf("could not get auth client, %v", err)
 	}
+	return NewGmailService(client)
+}
+
+func NewGmailService(client *http.Client) *gmail.Service {
 	svc, err := gmail.New(client)
 	if err != nil {
 		log.Fatalf("could not create gmail client, %v", err)
@@ -0,0 +1,17 @@
+package misc
+
+import (
+	"github.com/oaktown/calliope/rules"
+	"github.com/spf13/viper"
+)
+
+// Rules returns the download rules from the config: the rules under rules, followed by the ones
+// converted from exclude_headers_with_values.
+func Rules() ([]rules.Rule, error) {
+	var configured []rules.Rule
+	if err := viper.UnmarshalKey("rules", &configured); err != nil {
+		return nil, err
+	}
+	excludeHeaders := viper.GetStringMapStringSlice("exclude_headers_with_values")
+	return append(configured, rules.FromExcludeHeaders(excludeHeaders)...), nil
+}
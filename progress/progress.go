@@ -0,0 +1,246 @@
+// Package progress keeps running totals for a download and reports them as it goes, either as a
+// progress bar on a terminal or as JSON lines for scripts.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of event
+const (
+	Listed    = "listed"    // message ids found by the search (Count of them)
+	Fetched   = "fetched"   // a message was downloaded from Gmail
+	Skipped   = "skipped"   // a message was not saved because of a rule
+	Saved     = "saved"     // a message was saved to Elasticsearch
+	Failed    = "failed"    // a message could not be downloaded or saved
+	Throttled = "throttled" // Gmail said we were over quota
+	Done      = "done"      // the download has finished
+)
+
+// Formats
+const (
+	Auto = "auto" // Bar on a terminal, otherwise None
+	Bar  = "bar"
+	JSON = "json"
+	None = "none"
+)
+
+// How often the progress bar is redrawn
+const redrawInterval = 200 * time.Millisecond
+
+// Totals are the running totals of each kind of event.
+type Totals struct {
+	Listed    int64 `json:"listed"`
+	Fetched   int64 `json:"fetched"`
+	Skipped   int64 `json:"skipped"`
+	Saved     int64 `json:"saved"`
+	Failed    int64 `json:"failed"`
+	Throttled int64 `json:"throttled"`
+}
+
+// Finished is the number of listed messages there's nothing more to do for.
+func (t Totals) Finished() int64 {
+	return t.Saved + t.Skipped + t.Failed
+}
+
+// Event is one thing that happened, along with the totals after it. Rate is finished messages
+// per second, and ETA is how long the rest of the listed messages should take at that rate.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"event"`
+	Id         string    `json:"id,omitempty"`
+	Count      int64     `json:"count,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	Totals     Totals    `json:"totals"`
+	Rate       float64   `json:"rate"`
+	ETASeconds float64   `json:"eta_seconds"`
+}
+
+// Reporter keeps the totals and renders events. All of its methods are safe to call from many
+// goroutines, and on a nil Reporter (which does nothing).
+type Reporter struct {
+	mu       sync.Mutex
+	format   string
+	out      io.Writer
+	started  time.Time
+	now      func() time.Time
+	totals   Totals
+	lastDraw time.Time
+	drawn    bool
+}
+
+// New returns a Reporter for the format (Auto, Bar, JSON or None). JSON lines are written to
+// stdout; the progress bar is drawn on stderr, along with the log.
+func New(format string) (*Reporter, error) {
+	switch format {
+	case Auto, "":
+		format = None
+		if isTerminal(os.Stderr) {
+			format = Bar
+		}
+	case Bar, JSON, None:
+	default:
+		return nil, fmt.Errorf("unknown progress format %q (should be %v, %v, %v or %v)", format, Auto, Bar, JSON, None)
+	}
+	out := os.Stderr
+	if format == JSON {
+		out = os.Stdout
+	}
+	return newReporter(format, out, time.Now), nil
+}
+
+func newReporter(format string, out io.Writer, now func() time.Time) *Reporter {
+	return &Reporter{format: format, out: out, started: now(), now: now}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Format returns the format events are rendered in.
+func (r *Reporter) Format() string {
+	if r == nil {
+		return None
+	}
+	return r.format
+}
+
+func (r *Reporter) Listed(count int) {
+	r.event(Event{Kind: Listed, Count: int64(count)}, func(t *Totals) { t.Listed += int64(count) })
+}
+
+func (r *Reporter) Fetched(id string) {
+	r.event(Event{Kind: Fetched, Id: id}, func(t *Totals) { t.Fetched++ })
+}
+
+// Skipped records a message skipped because of the named rule.
+func (r *Reporter) Skipped(id, rule string) {
+	r.event(Event{Kind: Skipped, Id: id, Detail: rule}, func(t *Totals) { t.Skipped++ })
+}
+
+func (r *Reporter) Saved(id string) {
+	r.event(Event{Kind: Saved, Id: id}, func(t *Totals) { t.Saved++ })
+}
+
+func (r *Reporter) Failed(id string, err error) {
+	r.event(Event{Kind: Failed, Id: id, Detail: err.Error()}, func(t *Totals) { t.Failed++ })
+}
+
+// Throttled records a call to the API method that was refused because of the quota.
+func (r *Reporter) Throttled(method string) {
+	r.event(Event{Kind: Throttled, Detail: method}, func(t *Totals) { t.Throttled++ })
+}
+
+// Finish renders the final totals.
+func (r *Reporter) Finish() {
+	r.event(Event{Kind: Done}, func(t *Totals) {})
+}
+
+// Totals returns the totals so far.
+func (r *Reporter) Totals() Totals {
+	if r == nil {
+		return Totals{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.totals
+}
+
+func (r *Reporter) event(e Event, update func(*Totals)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	update(&r.totals)
+	e.Time = r.now()
+	e.Totals = r.totals
+	e.Rate, e.ETASeconds = r.rate(e.Time)
+	switch r.format {
+	case JSON:
+		line, _ := json.Marshal(e)
+		fmt.Fprintf(r.out, "%s\n", line)
+	case Bar:
+		if e.Kind == Done || e.Time.Sub(r.lastDraw) >= redrawInterval {
+			r.draw(e)
+		}
+		if e.Kind == Done {
+			fmt.Fprintln(r.out)
+			r.drawn = false
+		}
+	}
+}
+
+// rate returns finished messages per second and the seconds left for the rest, or 0 if there's
+// nothing to go on yet.
+func (r *Reporter) rate(now time.Time) (float64, float64) {
+	elapsed := now.Sub(r.started).Seconds()
+	finished := r.totals.Finished()
+	if elapsed <= 0 || finished == 0 {
+		return 0, 0
+	}
+	rate := float64(finished) / elapsed
+	remaining := r.totals.Listed - finished
+	if remaining < 0 {
+		remaining = 0
+	}
+	return rate, float64(remaining) / rate
+}
+
+const barWidth = 30
+
+func (r *Reporter) draw(e Event) {
+	t := e.Totals
+	filled := 0
+	if t.Listed > 0 {
+		filled = int(float64(barWidth) * float64(t.Finished()) / float64(t.Listed))
+		if filled > barWidth {
+			filled = barWidth
+		}
+	}
+	eta := "?"
+	if e.Rate > 0 {
+		eta = (time.Duration(e.ETASeconds) * time.Second).String()
+	}
+	fmt.Fprintf(r.out, "\r[%s%s] %d/%d  saved %d  skipped %d  failed %d  throttled %d  %.1f/s  ETA %s\x1b[K",
+		strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled),
+		t.Finished(), t.Listed, t.Saved, t.Skipped, t.Failed, t.Throttled, e.Rate, eta)
+	r.lastDraw = e.Time
+	r.drawn = true
+}
+
+// LogWriter wraps the writer that log output goes to so that, when a progress bar is showing, log
+// lines are written above the bar instead of through it.
+func (r *Reporter) LogWriter(w io.Writer) io.Writer {
+	if r == nil || r.format != Bar {
+		return w
+	}
+	return logWriter{r: r, w: w}
+}
+
+type logWriter struct {
+	r *Reporter
+	w io.Writer
+}
+
+func (l logWriter) Write(p []byte) (int, error) {
+	l.r.mu.Lock()
+	defer l.r.mu.Unlock()
+	if l.r.drawn {
+		fmt.Fprint(l.r.out, "\r\x1b[K")
+	}
+	n, err := l.w.Write(p)
+	if l.r.drawn {
+		e := Event{Time: l.r.now(), Totals: l.r.totals}
+		e.Rate, e.ETASeconds = l.r.rate(e.Time)
+		l.r.draw(e)
+	}
+	return n, err
+}
@@ -0,0 +1,88 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReporter_json(t *testing.T) {
+	start := time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	var out bytes.Buffer
+	r := newReporter(JSON, &out, func() time.Time { return now })
+
+	r.Listed(10)
+	now = now.Add(time.Second)
+	r.Fetched("1")
+	r.Saved("1")
+	r.Fetched("2")
+	r.Skipped("2", "newsletters")
+	r.Throttled("messages.get")
+	now = now.Add(time.Second)
+	r.Failed("3", errors.New("oops"))
+	r.Finish()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 8 {
+		t.Fatalf("got %v events, want 8:\n%v", len(lines), out.String())
+	}
+	var events []Event
+	for _, line := range lines {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid JSON %v: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	if e := events[4]; e.Kind != Skipped || e.Id != "2" || e.Detail != "newsletters" {
+		t.Errorf("skipped event = %+v", e)
+	}
+	last := events[len(events)-1]
+	want := Totals{Listed: 10, Fetched: 2, Skipped: 1, Saved: 1, Failed: 1, Throttled: 1}
+	if last.Kind != Done || last.Totals != want {
+		t.Errorf("last event = %+v, want done with totals %+v", last, want)
+	}
+	// 3 finished in 2 seconds, 7 to go
+	if last.Rate != 1.5 {
+		t.Errorf("rate = %v, want 1.5", last.Rate)
+	}
+	if eta := last.ETASeconds; eta < 4.66 || eta > 4.67 {
+		t.Errorf("ETA = %v, want 4.67", eta)
+	}
+}
+
+func TestReporter_bar(t *testing.T) {
+	now := time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC)
+	var out, log bytes.Buffer
+	r := newReporter(Bar, &out, func() time.Time { return now })
+	logWriter := r.LogWriter(&log)
+
+	r.Listed(4)
+	now = now.Add(time.Second)
+	r.Saved("1")
+	r.Saved("2")
+	logWriter.Write([]byte("a log line\n"))
+	r.Finish()
+
+	if log.String() != "a log line\n" {
+		t.Errorf("log = %q", log.String())
+	}
+	lastBar := out.String()[strings.LastIndex(out.String(), "\r"):]
+	if !strings.Contains(lastBar, "[###############---------------] 2/4") || !strings.Contains(lastBar, "ETA 1s") {
+		t.Errorf("bar = %q", lastBar)
+	}
+}
+
+func TestReporter_nil(t *testing.T) {
+	var r *Reporter
+	r.Listed(1)
+	r.Saved("1")
+	r.Finish()
+	if r.Totals() != (Totals{}) {
+		t.Error("nil Reporter has totals")
+	}
+}
@@ -1,12 +1,13 @@
 package report
 
 import (
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/oaktown/calliope/gmailservice"
 	"github.com/oaktown/calliope/store"
 	parser "golang.org/x/net/html"
+	"google.golang.org/api/gmail/v1"
 	"html/template"
 	"log"
 	"strings"
@@ -18,18 +19,28 @@ type MessageWithHtml struct {
 }
 
 type QueryOptions struct {
-	StartDate     string
-	EndDate       string
-	Timezone      string
-	Participants  string
-	BodyOrSubject string
-	Label         string
-	InboxUrl      string
-	Size          int
-	Starred       bool
-	SortField     string
-	SortAscending bool
-	Query         string
+	StartDate      string
+	EndDate        string
+	Timezone       string
+	Participants   string
+	BodyOrSubject  string
+	Label          string
+	InboxUrl       string
+	Size           int
+	Starred        bool
+	SortField      string
+	SortAscending  bool
+	Query          string
+	IncludeDeleted bool
+	Account        string
+	// Each is "Name: value" (the header contains value) or "Name" (the message has the header)
+	Headers []string
+	// The id of a conversation (see store.Message.Conversation)
+	Conversation string
+	// Match BodyOrSubject against only what the sender wrote, not what they quoted
+	NewContentOnly bool
+	// Words in the filename of one of the message's attachments
+	Attachment string
 }
 
 type BarData struct {
@@ -70,8 +81,10 @@ func FillInHtmlBody(messages []*store.Message) []*MessageWithHtml {
 }
 
 func GetMessageHtmlBody(message store.Message) string {
-	htmlBodyEncoded := gmailservice.GetBodyPartByMimeType(message.Source, "text/html")
-	htmlBody, _ := base64.URLEncoding.DecodeString(htmlBodyEncoded)
+	htmlBody := message.Content.Html()
+	if htmlBody == "" && len(message.Source) > 0 {
+		htmlBody = legacyHtmlBody(message)
+	}
 	var unsafeHtml string
 	if len(htmlBody) > 0 {
 		unsafeHtml = string(htmlBody)
@@ -98,19 +111,50 @@ func GetMessageHtmlBody(message store.Message) string {
 	return html
 }
 
+// legacyHtmlBody gets the HTML body from the Gmail API message that messages were saved with
+// before there was Content.
+func legacyHtmlBody(message store.Message) string {
+	var source gmail.Message
+	if err := json.Unmarshal(message.Source, &source); err != nil {
+		log.Printf("Unable to read source of message %v: %v\n", message.Id, err)
+		return ""
+	}
+	htmlBody, err := gmailservice.BodyText(source, "text/html")
+	if err != nil {
+		log.Printf("Unable to decode all of message %v: %v\n", message.Id, err)
+	}
+	return htmlBody
+}
+
 func setupMessageSearch(opt QueryOptions, svc *store.Service) store.MessageSearch {
 	var messageSearch store.MessageSearch
 	if opt.Query != "" {
-		messageSearch = svc.NewRawMessageSearch(opt.Query)
+		messageSearch = svc.NewRawMessageSearch(opt.Query).IncludeDeleted(opt.IncludeDeleted)
 	} else {
-		messageSearch = svc.NewStructuredMessageSearch().
+		structured := svc.NewStructuredMessageSearch().
+			Account(opt.Account).
 			Label(opt.Label).
 			DateRange(opt.StartDate, opt.EndDate, opt.Timezone).
 			Participants(opt.Participants).
-			BodyOrSubject(opt.BodyOrSubject).
+			Conversation(opt.Conversation).
+			Attachment(opt.Attachment)
+		if opt.NewContentOnly {
+			structured = structured.NewContentOrSubject(opt.BodyOrSubject)
+		} else {
+			structured = structured.BodyOrSubject(opt.BodyOrSubject)
+		}
+		for _, header := range opt.Headers {
+			name, value := header, ""
+			if colon := strings.Index(header, ":"); colon >= 0 {
+				name, value = header[:colon], strings.TrimSpace(header[colon+1:])
+			}
+			structured = structured.Header(name, value)
+		}
+		messageSearch = structured.
 			Size(opt.Size).
 			Sort(opt.SortField, opt.SortAscending).
-			Starred(opt.Starred)
+			Starred(opt.Starred).
+			IncludeDeleted(opt.IncludeDeleted)
 	}
 	return messageSearch
 }
@@ -0,0 +1,363 @@
+// Package rules decides which downloaded messages are saved. Rules are declared in the config:
+//
+//	rules:
+//	  - name: newsletters
+//	    action: exclude
+//	    match:
+//	      any:
+//	        - header: List-Unsubscribe
+//	        - header: From
+//	          pattern: "(?i)no-?reply"
+//	  - name: starred
+//	    action: include
+//	    match:
+//	      label: STARRED
+//
+// A message is skipped if it matches an exclude rule and doesn't match any include rule, so include
+// rules carve exceptions out of exclude rules whatever order they are in.
+package rules
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	Include = "include"
+	Exclude = "exclude"
+)
+
+// Rule is a named condition and what to do with the messages that match it.
+type Rule struct {
+	Name   string
+	Action string // Include or Exclude
+	Match  Condition
+}
+
+// Condition matches messages. Every field that is set has to match, so a condition with both
+// Header and Label set matches messages with that header and that label.
+type Condition struct {
+	All []Condition `json:",omitempty"`
+	Any []Condition `json:",omitempty"`
+	Not *Condition  `json:",omitempty"`
+
+	// Header matches messages that have the header. If Pattern is set, the value of the header
+	// also has to match the regular expression.
+	Header  string `json:",omitempty"`
+	Pattern string `json:",omitempty"`
+
+	// Label matches label ids (e.g. STARRED) or label names, ignoring case.
+	Label string `json:",omitempty"`
+
+	// FromDomain matches messages from the domain or any of its subdomains.
+	FromDomain string `mapstructure:"from_domain" json:",omitempty"`
+
+	// Body is a regular expression that the plain text body has to match.
+	Body string `json:",omitempty"`
+
+	// Sizes are in bytes
+	LargerThan  int64 `mapstructure:"larger_than" json:",omitempty"`
+	SmallerThan int64 `mapstructure:"smaller_than" json:",omitempty"`
+
+	// Dates are YYYY-MM-DD, in UTC
+	Before string `json:",omitempty"`
+	After  string `json:",omitempty"`
+}
+
+// Message is what rules are evaluated against.
+type Message struct {
+	Headers    map[string][]string // keys are lower case
+	LabelIds   []string
+	LabelNames []string
+	Size       int64
+	Date       time.Time
+	Body       string
+}
+
+// Match says which rule a message matched, and why.
+type Match struct {
+	Rule   string
+	Reason string
+}
+
+// RuleSet is a list of rules ready to be evaluated.
+type RuleSet struct {
+	Rules    []Rule
+	includes []compiledRule
+	excludes []compiledRule
+}
+
+type compiledRule struct {
+	name      string
+	condition *compiledCondition
+}
+
+type compiledCondition struct {
+	all         []*compiledCondition
+	any         []*compiledCondition
+	not         *compiledCondition
+	header      string
+	pattern     *regexp.Regexp
+	label       string
+	fromDomain  string
+	body        *regexp.Regexp
+	largerThan  int64
+	smallerThan int64
+	before      time.Time
+	after       time.Time
+}
+
+// Compile checks the rules and prepares them for evaluation.
+func Compile(rules []Rule) (*RuleSet, error) {
+	set := &RuleSet{Rules: rules}
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+		}
+		condition, err := compileCondition(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		compiled := compiledRule{name: name, condition: condition}
+		switch strings.ToLower(rule.Action) {
+		case Include:
+			set.includes = append(set.includes, compiled)
+		case Exclude, "":
+			set.excludes = append(set.excludes, compiled)
+		default:
+			return nil, fmt.Errorf("%v: action must be %v or %v, not %q", name, Include, Exclude, rule.Action)
+		}
+	}
+	return set, nil
+}
+
+func compileCondition(c Condition) (*compiledCondition, error) {
+	var err error
+	compiled := &compiledCondition{
+		header:      strings.ToLower(c.Header),
+		label:       strings.ToLower(c.Label),
+		fromDomain:  strings.ToLower(strings.TrimPrefix(c.FromDomain, "@")),
+		largerThan:  c.LargerThan,
+		smallerThan: c.SmallerThan,
+	}
+	for _, sub := range c.All {
+		s, err := compileCondition(sub)
+		if err != nil {
+			return nil, err
+		}
+		compiled.all = append(compiled.all, s)
+	}
+	for _, sub := range c.Any {
+		s, err := compileCondition(sub)
+		if err != nil {
+			return nil, err
+		}
+		compiled.any = append(compiled.any, s)
+	}
+	if c.Not != nil {
+		if compiled.not, err = compileCondition(*c.Not); err != nil {
+			return nil, err
+		}
+	}
+	if c.Pattern != "" {
+		if c.Header == "" {
+			return nil, fmt.Errorf("pattern %q needs a header to match", c.Pattern)
+		}
+		if compiled.pattern, err = regexp.Compile(c.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	if c.Body != "" {
+		if compiled.body, err = regexp.Compile(c.Body); err != nil {
+			return nil, err
+		}
+	}
+	if c.Before != "" {
+		if compiled.before, err = time.Parse("2006-01-02", c.Before); err != nil {
+			return nil, err
+		}
+	}
+	if c.After != "" {
+		if compiled.after, err = time.Parse("2006-01-02", c.After); err != nil {
+			return nil, err
+		}
+	}
+	if reflect.DeepEqual(*compiled, compiledCondition{}) {
+		// Most likely a misspelt key, which would otherwise match (and skip) every message
+		return nil, fmt.Errorf("condition has nothing to match")
+	}
+	return compiled, nil
+}
+
+// Skip returns the exclude rule that means the message shouldn't be saved, or false if it should.
+func (s *RuleSet) Skip(m Message) (Match, bool) {
+	if s == nil {
+		return Match{}, false
+	}
+	for _, rule := range s.includes {
+		if ok, _ := rule.condition.match(m); ok {
+			return Match{}, false
+		}
+	}
+	for _, rule := range s.excludes {
+		if ok, reason := rule.condition.match(m); ok {
+			return Match{Rule: rule.name, Reason: reason}, true
+		}
+	}
+	return Match{}, false
+}
+
+// match returns whether the message matches and a short description of what matched.
+func (c *compiledCondition) match(m Message) (bool, string) {
+	var reasons []string
+	matched := func(reason string) {
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+	for _, sub := range c.all {
+		ok, reason := sub.match(m)
+		if !ok {
+			return false, ""
+		}
+		matched(reason)
+	}
+	if len(c.any) > 0 {
+		found := false
+		for _, sub := range c.any {
+			if ok, reason := sub.match(m); ok {
+				matched(reason)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, ""
+		}
+	}
+	if c.not != nil {
+		if ok, _ := c.not.match(m); ok {
+			return false, ""
+		}
+	}
+	if c.header != "" {
+		values, ok := m.Headers[c.header]
+		if !ok {
+			return false, ""
+		}
+		if c.pattern == nil {
+			matched(c.header)
+		} else {
+			found := false
+			for _, value := range values {
+				if c.pattern.MatchString(value) {
+					matched(fmt.Sprintf("%v: %v", c.header, value))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false, ""
+			}
+		}
+	}
+	if c.label != "" {
+		if !hasLabel(m, c.label) {
+			return false, ""
+		}
+		matched("label " + c.label)
+	}
+	if c.fromDomain != "" {
+		domain := senderDomain(m)
+		if domain != c.fromDomain && !strings.HasSuffix(domain, "."+c.fromDomain) {
+			return false, ""
+		}
+		matched("from " + domain)
+	}
+	if c.body != nil {
+		if !c.body.MatchString(m.Body) {
+			return false, ""
+		}
+		matched("body")
+	}
+	if c.largerThan > 0 && m.Size <= c.largerThan {
+		return false, ""
+	}
+	if c.smallerThan > 0 && m.Size >= c.smallerThan {
+		return false, ""
+	}
+	if c.largerThan > 0 || c.smallerThan > 0 {
+		matched(fmt.Sprintf("size %v", m.Size))
+	}
+	if !c.before.IsZero() && !m.Date.Before(c.before) {
+		return false, ""
+	}
+	if !c.after.IsZero() && m.Date.Before(c.after) {
+		return false, ""
+	}
+	if !c.before.IsZero() || !c.after.IsZero() {
+		matched("date " + m.Date.Format("2006-01-02"))
+	}
+	return true, strings.Join(reasons, ", ")
+}
+
+func hasLabel(m Message, label string) bool {
+	for _, labels := range [][]string{m.LabelIds, m.LabelNames} {
+		for _, l := range labels {
+			if strings.ToLower(l) == label {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// senderDomain returns the lower case domain of the From address, or "".
+func senderDomain(m Message) string {
+	from := m.Headers["from"]
+	if len(from) == 0 {
+		return ""
+	}
+	address := from[0]
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		address = parsed.Address
+	}
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(address[at+1:], "> "))
+}
+
+// FromExcludeHeaders converts the old exclude_headers_with_values config, which skips messages
+// where the header contains any of the values (ignoring case), into rules.
+func FromExcludeHeaders(excludeHeaders map[string][]string) []Rule {
+	var rules []Rule
+	for header, values := range excludeHeaders {
+		// Headers without values never excluded anything, so there's nothing to convert.
+		if len(values) == 0 {
+			continue
+		}
+		quoted := make([]string, len(values))
+		for i, value := range values {
+			quoted[i] = regexp.QuoteMeta(value)
+		}
+		rules = append(rules, Rule{
+			Name:   "exclude_headers_with_values: " + header,
+			Action: Exclude,
+			Match: Condition{
+				Header:  header,
+				Pattern: "(?i)" + strings.Join(quoted, "|"),
+			},
+		})
+	}
+	// Map order is random; keep the rules (and which one gets the blame) the same every run.
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
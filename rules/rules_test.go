@@ -0,0 +1,134 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuleSet_Skip(t *testing.T) {
+	newsletter := Message{
+		Headers: map[string][]string{
+			"from":             {"News <noreply@mail.example.com>"},
+			"list-unsubscribe": {"<mailto:unsubscribe@example.com>"},
+		},
+		LabelIds:   []string{"INBOX", "Label_1"},
+		LabelNames: []string{"INBOX", "Receipts"},
+		Size:       2000,
+		Date:       time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC),
+		Body:       "Our biggest sale of the year",
+	}
+	tests := []struct {
+		name       string
+		rules      []Rule
+		wantSkip   bool
+		wantRule   string
+		wantReason string
+	}{
+		{"No rules", nil, false, "", ""},
+		{"Header present",
+			[]Rule{{Name: "lists", Action: Exclude, Match: Condition{Header: "List-Unsubscribe"}}},
+			true, "lists", "list-unsubscribe"},
+		{"Header pattern",
+			[]Rule{{Name: "noreply", Match: Condition{Header: "From", Pattern: "(?i)no-?reply"}}},
+			true, "noreply", "from: News <noreply@mail.example.com>"},
+		{"Header pattern doesn't match",
+			[]Rule{{Match: Condition{Header: "From", Pattern: "^bob"}}},
+			false, "", ""},
+		{"Label name",
+			[]Rule{{Name: "receipts", Match: Condition{Label: "receipts"}}},
+			true, "receipts", "label receipts"},
+		{"Subdomain of sender domain",
+			[]Rule{{Name: "example", Match: Condition{FromDomain: "example.com"}}},
+			true, "example", "from mail.example.com"},
+		{"Other sender domain",
+			[]Rule{{Match: Condition{FromDomain: "ample.com"}}},
+			false, "", ""},
+		{"All",
+			[]Rule{{Name: "big sales", Match: Condition{All: []Condition{{Body: "sale"}, {LargerThan: 1000}}}}},
+			true, "big sales", "body, size 2000"},
+		{"All with one not matching",
+			[]Rule{{Match: Condition{All: []Condition{{Body: "sale"}, {SmallerThan: 1000}}}}},
+			false, "", ""},
+		{"Any",
+			[]Rule{{Name: "old or starred", Match: Condition{Any: []Condition{{Label: "STARRED"}, {Before: "2019-01-01"}}}}},
+			true, "old or starred", "date 2018-12-01"},
+		{"Not",
+			[]Rule{{Match: Condition{Header: "From", Not: &Condition{FromDomain: "example.com"}}}},
+			false, "", ""},
+		{"Date range",
+			[]Rule{{Name: "december", Match: Condition{After: "2018-12-01", Before: "2019-01-01"}}},
+			true, "december", "date 2018-12-01"},
+		{"Include wins over exclude",
+			[]Rule{
+				{Name: "lists", Action: Exclude, Match: Condition{Header: "List-Unsubscribe"}},
+				{Name: "receipts", Action: Include, Match: Condition{Label: "Receipts"}},
+			},
+			false, "", ""},
+		{"Include that doesn't match",
+			[]Rule{
+				{Name: "starred", Action: Include, Match: Condition{Label: "STARRED"}},
+				{Name: "lists", Action: Exclude, Match: Condition{Header: "List-Unsubscribe"}},
+			},
+			true, "lists", "list-unsubscribe"},
+		{"Unnamed rule",
+			[]Rule{{Match: Condition{Label: "inbox"}}},
+			true, "rule 1", "label inbox"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := Compile(tt.rules)
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			match, skip := set.Skip(newsletter)
+			if skip != tt.wantSkip || match.Rule != tt.wantRule || match.Reason != tt.wantReason {
+				t.Errorf("Skip() = %+v, %v, want {Rule:%v Reason:%v}, %v", match, skip, tt.wantRule, tt.wantReason, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestCompile_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"Bad action", Rule{Action: "drop", Match: Condition{Label: "INBOX"}}},
+		{"Bad pattern", Rule{Match: Condition{Header: "From", Pattern: "("}}},
+		{"Pattern without header", Rule{Match: Condition{Pattern: "x"}}},
+		{"Bad date", Rule{Match: Condition{Before: "December"}}},
+		{"Empty condition", Rule{Name: "typo"}},
+		{"Empty nested condition", Rule{Match: Condition{All: []Condition{{Label: "INBOX"}, {}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile([]Rule{tt.rule}); err == nil {
+				t.Error("Compile() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestFromExcludeHeaders(t *testing.T) {
+	set, err := Compile(FromExcludeHeaders(map[string][]string{
+		"From":             {"noreply", "no-reply"},
+		"List-Unsubscribe": {},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from     string
+		wantSkip bool
+	}{
+		{"NoReply@example.com", true},
+		{"no-reply@example.com", true},
+		{"bob@example.com", false},
+	}
+	for _, tt := range tests {
+		m := Message{Headers: map[string][]string{"from": {tt.from}, "list-unsubscribe": {"x"}}}
+		if _, skip := set.Skip(m); skip != tt.wantSkip {
+			t.Errorf("Skip(%v) = %v, want %v", tt.from, skip, tt.wantSkip)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Package scheduler runs the sync of each account every so often, backing off when a sync fails
+// and keeping track of how each one went.
+package scheduler
+
+import (
+	"context"
+	"github.com/jonboulle/clockwork"
+	"github.com/oaktown/calliope/store"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Longest time to wait after failed runs, unless the interval is longer than that
+const MaxBackoff = 6 * time.Hour
+
+// How long a lock is taken for, and how often it's extended while a run goes on
+const (
+	LockTTL      = 10 * time.Minute
+	LockRenewal  = LockTTL / 3
+	lockPrefix   = "sync-"
+	skippedError = "skipped: another sync of this account is running"
+)
+
+// Scheduler runs Run for each account every Every. Runs happen one at a time, so a run that
+// takes longer than Every only delays the next one. After a failed run the wait is doubled for
+// each failure in a row (up to MaxBackoff).
+type Scheduler struct {
+	Every    time.Duration
+	Accounts []string
+	// Run syncs the account and returns the number of messages saved. It should stop early
+	// if ctx is cancelled.
+	Run func(ctx context.Context, account string) (int64, error)
+	// Lock, if set, is called before each run and the run is skipped if it returns false. It is
+	// called again every LockRenewal while the run goes on, and Unlock is called after.
+	Lock   func(account string) (bool, error)
+	Unlock func(account string)
+	// OnStatus, if set, is called whenever the status of an account changes (e.g. to save it).
+	OnStatus func(store.SyncStatus)
+	clock    clockwork.Clock
+	mu       sync.Mutex
+	statuses map[string]*store.SyncStatus
+}
+
+func New(every time.Duration, accounts []string, run func(context.Context, string) (int64, error)) *Scheduler {
+	return &Scheduler{
+		Every:    every,
+		Accounts: accounts,
+		Run:      run,
+		clock:    clockwork.NewRealClock(),
+		statuses: make(map[string]*store.SyncStatus),
+	}
+}
+
+// StoreLock locks accounts with locks in the store, so that syncs in other processes (e.g. the
+// web server and `calliope sync`) don't overlap either.
+func (s *Scheduler) StoreLock(svc *store.Service, owner string) {
+	s.Lock = func(account string) (bool, error) {
+		return svc.AcquireLock(lockPrefix+account, owner, LockTTL)
+	}
+	s.Unlock = func(account string) {
+		if err := svc.ReleaseLock(lockPrefix+account, owner); err != nil {
+			log.Printf("Error releasing sync lock of account %v: %v\n", account, err)
+		}
+	}
+}
+
+// Start runs every account straight away and then on schedule, until ctx is cancelled. It
+// returns once the run under way (if any) has finished.
+func (s *Scheduler) Start(ctx context.Context) {
+	now := s.clock.Now()
+	for _, account := range s.Accounts {
+		s.update(account, func(status *store.SyncStatus) { status.NextRun = now })
+	}
+	for {
+		account, next := s.next()
+		if account == "" {
+			return
+		}
+		if wait := next.Sub(s.clock.Now()); wait > 0 {
+			log.Printf("Next sync: %v at %v\n", account, next.Format(time.RFC3339))
+			select {
+			case <-s.clock.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.runOnce(ctx, account)
+	}
+}
+
+// RunAll runs every account once, now, and returns their statuses.
+func (s *Scheduler) RunAll(ctx context.Context) []store.SyncStatus {
+	for _, account := range s.Accounts {
+		if ctx.Err() != nil {
+			break
+		}
+		s.runOnce(ctx, account)
+	}
+	return s.Statuses()
+}
+
+// next returns the account that is due to run first.
+func (s *Scheduler) next() (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var account string
+	var next time.Time
+	for _, name := range s.Accounts {
+		status := s.statuses[name]
+		if account == "" || status.NextRun.Before(next) {
+			account, next = name, status.NextRun
+		}
+	}
+	return account, next
+}
+
+// runOnce runs the account now and schedules its next run.
+func (s *Scheduler) runOnce(ctx context.Context, account string) {
+	if s.Lock != nil {
+		locked, err := s.Lock(account)
+		if err != nil || !locked {
+			reason := skippedError
+			if err != nil {
+				reason = "unable to lock: " + err.Error()
+			}
+			log.Printf("Not syncing %v: %v\n", account, reason)
+			s.update(account, func(status *store.SyncStatus) {
+				status.LastError = reason
+				status.NextRun = s.clock.Now().Add(s.Every)
+			})
+			return
+		}
+		defer s.Unlock(account)
+		done := make(chan bool)
+		defer close(done)
+		go s.renewLock(account, done)
+	}
+	started := s.clock.Now()
+	s.update(account, func(status *store.SyncStatus) {
+		status.Running = true
+		status.LastStarted = started
+	})
+	log.Printf("Syncing %v\n", account)
+	saved, err := s.Run(ctx, account)
+	finished := s.clock.Now()
+	s.update(account, func(status *store.SyncStatus) {
+		status.Running = false
+		status.LastFinished = finished
+		status.LastSaved = saved
+		if err != nil {
+			status.Failures++
+			status.LastError = err.Error()
+			log.Printf("Sync of %v failed (%v in a row): %v\n", account, status.Failures, err)
+		} else {
+			status.Failures = 0
+			status.LastError = ""
+			status.LastSucceeded = finished
+		}
+		status.NextRun = finished.Add(s.wait(status.Failures))
+	})
+}
+
+func (s *Scheduler) renewLock(account string, done <-chan bool) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.clock.After(LockRenewal):
+			if _, err := s.Lock(account); err != nil {
+				log.Printf("Error extending sync lock of account %v: %v\n", account, err)
+			}
+		}
+	}
+}
+
+// wait returns how long to wait before the next run after failures runs have failed in a row.
+func (s *Scheduler) wait(failures int) time.Duration {
+	wait := s.Every
+	max := MaxBackoff
+	if s.Every > max {
+		max = s.Every
+	}
+	for i := 0; i < failures && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+func (s *Scheduler) update(account string, change func(*store.SyncStatus)) {
+	s.mu.Lock()
+	status, ok := s.statuses[account]
+	if !ok {
+		status = &store.SyncStatus{Account: account}
+		s.statuses[account] = status
+	}
+	change(status)
+	copied := *status
+	s.mu.Unlock()
+	if s.OnStatus != nil {
+		s.OnStatus(copied)
+	}
+}
+
+// Statuses returns the status of each account, sorted by account.
+func (s *Scheduler) Statuses() []store.SyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]store.SyncStatus, 0, len(s.statuses))
+	for _, status := range s.statuses {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Account < statuses[j].Account })
+	return statuses
+}
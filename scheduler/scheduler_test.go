@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"github.com/jonboulle/clockwork"
+	"testing"
+	"time"
+)
+
+func TestScheduler_wait(t *testing.T) {
+	tests := []struct {
+		every    time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{15 * time.Minute, 0, 15 * time.Minute},
+		{15 * time.Minute, 1, 30 * time.Minute},
+		{15 * time.Minute, 3, 2 * time.Hour},
+		{15 * time.Minute, 10, MaxBackoff},
+		{24 * time.Hour, 2, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		s := New(tt.every, nil, nil)
+		if got := s.wait(tt.failures); got != tt.want {
+			t.Errorf("wait(%v) every %v = %v, want %v", tt.failures, tt.every, got, tt.want)
+		}
+	}
+}
+
+func TestScheduler_runOnce(t *testing.T) {
+	start := time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC)
+	clock := clockwork.NewFakeClockAt(start)
+	errs := []error{errors.New("offline"), errors.New("offline"), nil}
+	var runs int
+	s := New(15*time.Minute, []string{"work"}, func(ctx context.Context, account string) (int64, error) {
+		err := errs[runs]
+		runs++
+		return 3, err
+	})
+	s.clock = clock
+	ctx := context.Background()
+
+	s.runOnce(ctx, "work")
+	s.runOnce(ctx, "work")
+	status := s.Statuses()[0]
+	if status.Failures != 2 || status.LastError != "offline" || !status.LastSucceeded.IsZero() {
+		t.Errorf("after 2 failures, status = %+v", status)
+	}
+	if want := start.Add(time.Hour); !status.NextRun.Equal(want) {
+		t.Errorf("after 2 failures, next run = %v, want %v", status.NextRun, want)
+	}
+
+	s.runOnce(ctx, "work")
+	status = s.Statuses()[0]
+	if status.Failures != 0 || status.LastError != "" || !status.LastSucceeded.Equal(start) || status.LastSaved != 3 {
+		t.Errorf("after success, status = %+v", status)
+	}
+	if want := start.Add(15 * time.Minute); !status.NextRun.Equal(want) {
+		t.Errorf("after success, next run = %v, want %v", status.NextRun, want)
+	}
+}
+
+func TestScheduler_runOnce_locked(t *testing.T) {
+	var runs, unlocks int
+	s := New(15*time.Minute, []string{"work"}, func(ctx context.Context, account string) (int64, error) {
+		runs++
+		return 0, nil
+	})
+	s.clock = clockwork.NewFakeClock()
+	s.Lock = func(account string) (bool, error) { return false, nil }
+	s.Unlock = func(account string) { unlocks++ }
+
+	s.runOnce(context.Background(), "work")
+	if runs != 0 || unlocks != 0 {
+		t.Errorf("ran %v times and unlocked %v times while locked elsewhere, want 0", runs, unlocks)
+	}
+	if status := s.Statuses()[0]; status.LastError != skippedError || status.Failures != 0 {
+		t.Errorf("status = %+v, want skipped", status)
+	}
+}
@@ -0,0 +1,34 @@
+// Package source defines what a way of getting mail into Calliope (an IMAP server, say) has to
+// provide, so that the commands that save messages don't depend on where they come from.
+package source
+
+import (
+	"context"
+	"github.com/oaktown/calliope/store"
+)
+
+// Source is a mailbox that messages are downloaded from (Gmail, an IMAP server or files). A Source
+// is used for one download: Download, then Finished for each message as it's saved, then (once
+// the channel is closed) Err and Labels, then Commit if every message was saved or Checkpoint if
+// not.
+type Source interface {
+	// Download starts sending messages on the channel, and closes it when there are no more or
+	// ctx is cancelled. Messages that have been sent before need not be sent again, unless the
+	// source was set up to download everything. Messages that couldn't be downloaded are sent
+	// with FetchError set.
+	Download(ctx context.Context) (<-chan *store.Message, error)
+	// Finished is called with the id of each message that was sent once it has been saved, or
+	// saving it failed. It may be called from several goroutines at once.
+	Finished(id string, saved bool)
+	// Err returns what went wrong with the download, if anything, once the channel is closed.
+	// Messages that were sent can still be saved and committed.
+	Err() error
+	// Labels returns every label of the account, including any the download came across.
+	Labels() []*store.Label
+	// Commit records that every message sent has been saved, so that the next download can
+	// start from there. It isn't called if the download was interrupted or a save failed.
+	Commit() error
+	// Checkpoint records how far a download that didn't finish (because it was interrupted or a
+	// save failed) got, if the source can pick up from there.
+	Checkpoint() error
+}
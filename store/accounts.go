@@ -0,0 +1,56 @@
+package store
+
+import (
+	"github.com/olivere/elastic"
+	"sort"
+)
+
+// DefaultAccount is the name of the account when no accounts are configured. Messages saved
+// before there were accounts have no Account and are treated as belonging to it.
+const DefaultAccount = "default"
+
+// accountQuery matches documents that belong to the account.
+func accountQuery(account string) elastic.Query {
+	query := elastic.NewTermQuery("Account.keyword", account)
+	if account != DefaultAccount {
+		return query
+	}
+	noAccount := elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("Account"))
+	return elastic.NewBoolQuery().Should(query, noAccount).MinimumNumberShouldMatch(1)
+}
+
+// AccountNames returns the name of every account with messages in the store, including those
+// that aren't in the config (e.g. made by an import).
+func (s *Service) AccountNames() ([]string, error) {
+	results, err := s.Client.Search().
+		Index(MailIndex).
+		Size(0).
+		Aggregation("accounts", elastic.NewTermsAggregation().Field("Account.keyword").Size(1000)).
+		Aggregation("noAccount", elastic.NewMissingAggregation().Field("Account.keyword")).
+		Do(s.Ctx)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if accounts, found := results.Aggregations.Terms("accounts"); found {
+		for _, bucket := range accounts.Buckets {
+			if name, ok := bucket.Key.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	if missing, found := results.Aggregations.Missing("noAccount"); found && missing.DocCount > 0 && !hasName(names, DefaultAccount) {
+		names = append(names, DefaultAccount)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"fmt"
+	"github.com/olivere/elastic"
+	"golang.org/x/net/context"
+	"regexp"
+	"strings"
+)
+
+// Address is an email address from an address header, e.g. From. Address and Domain are
+// lowercased so that they can be matched exactly.
+type Address struct {
+	Name    string `json:",omitempty"`
+	Address string
+	Domain  string
+}
+
+// Addresses are the parsed address headers of a message.
+type Addresses struct {
+	From    []Address
+	To      []Address
+	Cc      []Address
+	Bcc     []Address
+	ReplyTo []Address
+}
+
+// Fields of Addresses, as they're named in the mail index
+var addressFields = []string{"From", "To", "Cc", "Bcc", "ReplyTo"}
+
+// The addresses that Participants matches
+var participantFields = []string{"From", "To", "Cc", "Bcc"}
+
+// addressesMapping maps the parts of every address as keywords, so that they're matched whole
+// rather than word by word.
+func addressesMapping() string {
+	address := `{"properties": {"Name": {"type": "keyword"}, "Address": {"type": "keyword"}, "Domain": {"type": "keyword"}}}`
+	var fields []string
+	for _, field := range addressFields {
+		fields = append(fields, fmt.Sprintf(`"%v": %v`, field, address))
+	}
+	return `{"properties": {"Addresses": {"properties": {` + strings.Join(fields, ", ") + `}}}}`
+}
+
+// putMapping adds fields to the mapping of an index that already exists.
+func putMapping(index string, mapping string, client *elastic.Client, ctx context.Context) error {
+	_, err := client.PutMapping().Index(index).Type("document").BodyString(mapping).Do(ctx)
+	return err
+}
+
+// A host name: labels of letters, digits and hyphens separated by dots, ending in a top level
+// domain that isn't all digits
+var hostname = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]([a-z0-9-]*[a-z0-9])?$`)
+
+// participantQuery matches messages that participant (an address, a domain like "@acme.com", or
+// otherwise part of a name or address) sent, received or was copied on. Domains match their
+// subdomains too. Something shaped like a host name without the "@" ("acme.com") matches as a
+// domain, but could just as well be part of a name or address ("john.doe"), so it's matched on
+// the headers' text as well. Messages saved before addresses were parsed are matched on the
+// headers' text.
+func participantQuery(participant string) elastic.Query {
+	participant = strings.ToLower(strings.TrimSpace(participant))
+	query := elastic.NewBoolQuery()
+	text := elastic.NewMultiMatchQuery(participant, "From", "To", "Cc", "Bcc").
+		Type("cross_fields").
+		Operator("and")
+	legacy := elastic.NewBoolQuery().Must(text).MustNot(elastic.NewExistsQuery("Addresses"))
+	switch {
+	case strings.HasPrefix(participant, "@"):
+		return query.Should(domainQueries(strings.TrimPrefix(participant, "@"))...).Should(legacy)
+	case strings.Contains(participant, "@"):
+		for _, field := range participantFields {
+			query = query.Should(elastic.NewTermQuery("Addresses."+field+".Address", participant))
+		}
+		return query.Should(legacy)
+	case hostname.MatchString(participant):
+		return query.Should(domainQueries(participant)...).Should(text)
+	}
+	return text
+}
+
+// domainQueries match an address in the domain, or a subdomain of it.
+func domainQueries(domain string) []elastic.Query {
+	var queries []elastic.Query
+	for _, field := range participantFields {
+		queries = append(queries,
+			elastic.NewTermQuery("Addresses."+field+".Domain", domain),
+			elastic.NewWildcardQuery("Addresses."+field+".Domain", "*."+domain))
+	}
+	return queries
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAddressesMapping(t *testing.T) {
+	var mapping map[string]interface{}
+	if err := json.Unmarshal([]byte(addressesMapping()), &mapping); err != nil {
+		t.Fatalf("mapping is not valid JSON: %v", err)
+	}
+}
+
+func TestParticipantQuery(t *testing.T) {
+	tests := []struct {
+		participant string
+		want        []string
+		notWant     []string
+	}{
+		{" Amy@Example.com", []string{`"Addresses.From.Address":"amy@example.com"`, `"Addresses.Bcc.Address"`, `"exists"`}, []string{"Domain", "ReplyTo"}},
+		{"@acme.com", []string{`"Addresses.To.Domain":"acme.com"`, `"Addresses.Cc.Domain":{"wildcard":"*.acme.com"}`}, []string{".Address"}},
+		{"acme.com", []string{`"Addresses.From.Domain":"acme.com"`, `"multi_match"`}, []string{`"exists"`}},
+		{"john.doe", []string{`"Addresses.From.Domain":"john.doe"`, `"multi_match":{"fields":["From","To","Cc","Bcc"],"operator":"and","query":"john.doe"`}, nil},
+		{"j.r.r. tolkien", []string{`"multi_match"`}, []string{"Addresses"}},
+		{"1.5", []string{`"multi_match"`}, []string{"Addresses"}},
+		{"amy", []string{`"multi_match"`}, []string{"Addresses"}},
+	}
+	for _, test := range tests {
+		source, err := participantQuery(test.participant).Source()
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, _ := json.Marshal(source)
+		for _, want := range test.want {
+			if !strings.Contains(string(query), want) {
+				t.Errorf("participantQuery(%q) = %s, want it to have %s", test.participant, query, want)
+			}
+		}
+		for _, notWant := range test.notWant {
+			if strings.Contains(string(query), notWant) {
+				t.Errorf("participantQuery(%q) = %s, don't want %s", test.participant, query, notWant)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/oaktown/calliope/rules"
+	"github.com/olivere/elastic"
+	"time"
+)
+
+const CheckpointIndex = "checkpoints"
+
+// DownloadCheckpointId is the id of the checkpoint for `calliope download` of the default account.
+const DownloadCheckpointId = "download"
+
+// DownloadCheckpointIdFor returns the id of the download checkpoint of the account.
+func DownloadCheckpointIdFor(account string) string {
+	if account == DefaultAccount || account == "" {
+		return DownloadCheckpointId
+	}
+	return DownloadCheckpointId + "-" + account
+}
+
+// DownloadOptions are the options a download was started with, so that a resumed download
+// runs the same query.
+type DownloadOptions struct {
+	Query    string
+	Limit    int64
+	InboxUrl string
+	Rules    []rules.Rule
+	Threads  bool
+	Raw      bool
+}
+
+// Checkpoint records the progress of a download so it can be resumed. PageToken is the list page
+// that still has unsaved messages on it, Listed is the number of messages listed before that page
+// and PendingIds are the ids on it that haven't been saved (nil if no page had been listed yet, in
+// which case the whole page is downloaded). FailedIds are messages on earlier pages
+// that couldn't be saved.
+type Checkpoint struct {
+	Id         string
+	Options    DownloadOptions
+	PageToken  string
+	Listed     int64
+	PendingIds []string
+	FailedIds  []string
+	HistoryId  uint64
+	StartedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (s *Service) SaveCheckpoint(checkpoint Checkpoint) error {
+	checkpointJson, _ := json.Marshal(checkpoint)
+	if _, err := s.saveDoc(s.Ctx, CheckpointIndex, checkpoint.Id, string(checkpointJson)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetCheckpoint returns the saved checkpoint, or false if there isn't one.
+func (s *Service) GetCheckpoint(id string) (Checkpoint, bool, error) {
+	var checkpoint Checkpoint
+	doc, err := s.Client.Get().Index(CheckpointIndex).Type("document").Id(id).Do(s.Ctx)
+	if elastic.IsNotFound(err) {
+		return checkpoint, false, nil
+	}
+	if err != nil {
+		return checkpoint, false, err
+	}
+	if err := json.Unmarshal(*doc.Source, &checkpoint); err != nil {
+		return checkpoint, false, err
+	}
+	return checkpoint, true, nil
+}
+
+func (s *Service) DeleteCheckpoint(id string) error {
+	_, err := s.Client.Delete().Index(CheckpointIndex).Type("document").Id(id).Do(s.Ctx)
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/oaktown/calliope/threading"
+	"github.com/olivere/elastic"
+	"golang.org/x/net/context"
+	"io"
+)
+
+// Conversation returns the id of the conversation the message is in, which is also the id of
+// its thread summary. Messages saved before there were conversation ids are in their Gmail
+// thread.
+func (m Message) Conversation() string {
+	if m.ConversationId != "" {
+		return m.ConversationId
+	}
+	return m.ThreadId
+}
+
+// conversationQuery matches the messages in a conversation, including those saved before there
+// were conversation ids if it's a Gmail thread.
+func conversationQuery(conversationId string) elastic.Query {
+	legacy := elastic.NewBoolQuery().
+		Must(elastic.NewTermQuery("ThreadId.keyword", conversationId)).
+		MustNot(elastic.NewExistsQuery("ConversationId"))
+	return elastic.NewBoolQuery().
+		Should(elastic.NewTermQuery("ConversationId.keyword", conversationId), legacy).
+		MinimumNumberShouldMatch(1)
+}
+
+// unthreadedConversation returns the conversation of a message whose source doesn't thread
+// messages: the one it was put in when it was saved before (perhaps by Thread), or else the one
+// its own headers point to. If it was saved before there were conversation ids, the thread
+// summary it was in then is returned too, so that it can be taken out of it.
+func (s *Service) unthreadedConversation(ctx context.Context, m Message) (string, string) {
+	var saved struct{ ThreadId, ConversationId string }
+	doc, err := s.Client.Get().
+		Index(MailIndex).
+		Type("document").
+		Id(m.Id).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("ThreadId", "ConversationId")).
+		Do(ctx)
+	if err == nil && doc.Source != nil {
+		json.Unmarshal(*doc.Source, &saved)
+	}
+	if saved.ConversationId != "" {
+		return saved.ConversationId, ""
+	}
+	if m.Headers == nil {
+		return "", saved.ThreadId
+	}
+	conversation := threading.ConversationId(m.Account, threading.NewMessage(m.Id, m.Headers.Get, m.Date))
+	if saved.ThreadId == conversation {
+		return conversation, ""
+	}
+	return conversation, saved.ThreadId
+}
+
+// ThreadingMessages returns every message in the account that has headers to thread it with,
+// along with its Gmail thread if it has one, and the conversation each of them is in now.
+func (s *Service) ThreadingMessages(account string) ([]threading.Message, map[string]string, error) {
+	var messages []threading.Message
+	conversations := make(map[string]string)
+	scroll := s.Client.Scroll(MailIndex).
+		Type("document").
+		Query(elastic.NewBoolQuery().Must(accountQuery(account), elastic.NewNestedQuery("Headers", elastic.NewExistsQuery("Headers.Name")))).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include(
+			"Date", "ThreadId", "ConversationId", "Headers")).
+		Size(1000)
+	defer scroll.Clear(s.Ctx)
+	for {
+		results, err := scroll.Do(s.Ctx)
+		if err == io.EOF {
+			return messages, conversations, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, hit := range results.Hits.Hits {
+			var message Message
+			if hit.Source != nil {
+				if err := json.Unmarshal(*hit.Source, &message); err != nil {
+					return nil, nil, err
+				}
+			}
+			message.Id = hit.Id
+			m := threading.NewMessage(message.Id, message.Headers.Get, message.Date)
+			m.ThreadId = message.ThreadId
+			messages = append(messages, m)
+			conversations[message.Id] = message.Conversation()
+		}
+	}
+}
+
+// MoveToConversation changes the conversation a message is in, and moves it from the summary of
+// the thread it was in to the new one.
+func (s *Service) MoveToConversation(id, conversationId string) error {
+	message, err := s.GetMessage(id)
+	if err != nil {
+		return err
+	}
+	old := message.Conversation()
+	_, err = s.Client.Update().
+		Index(MailIndex).
+		Type("document").
+		Id(id).
+		Doc(map[string]interface{}{"ConversationId": conversationId}).
+		RetryOnConflict(3).
+		Do(s.Ctx)
+	if err != nil {
+		return err
+	}
+	message.ConversationId = conversationId
+	s.RemoveFromThread(old, id)
+	s.AddToThread(message)
+	return nil
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"github.com/olivere/elastic"
+	"strings"
+)
+
+// Header is one header of a message. Name is lower case.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Headers are all of the headers of a message, including repeated ones (e.g. Received) in the
+// order they appear. They're a nested field of the mail index (see headersMapping), so that
+// every header name doesn't become fields of its own.
+type Headers []Header
+
+// HeaderKey is the Name of a header in Headers: its name in lower case.
+func HeaderKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Add adds a value of the header.
+func (h *Headers) Add(name, value string) {
+	*h = append(*h, Header{Name: HeaderKey(name), Value: value})
+}
+
+// Get returns the first value of the header, or "" if there isn't one.
+func (h Headers) Get(name string) string {
+	values := h.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Values returns all of the values of the header, in order.
+func (h Headers) Values(name string) []string {
+	key := HeaderKey(name)
+	var values []string
+	for _, header := range h {
+		if header.Name == key {
+			values = append(values, header.Value)
+		}
+	}
+	return values
+}
+
+// headersMapping maps Headers as nested documents, with the name as a keyword and the value as
+// text, so that a search can match a value in a particular header.
+func headersMapping() string {
+	return `{"properties": {"Headers": {"type": "nested", "properties": {"Name": {"type": "keyword"}, "Value": {"type": "text"}}}}}`
+}
+
+// headerQuery matches messages with the header, and if value isn't "", where the header contains
+// value as a phrase, ignoring case.
+func headerQuery(name, value string) elastic.Query {
+	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("Headers.Name", HeaderKey(name)))
+	if value != "" {
+		query = query.Must(elastic.NewMatchPhraseQuery("Headers.Value", value))
+	}
+	return elastic.NewNestedQuery("Headers", query)
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	var headers Headers
+	headers.Add("Received", "from a")
+	headers.Add("X-Mailer.Version", "2")
+	headers.Add("RECEIVED", "from b")
+	want := Headers{{"received", "from a"}, {"x-mailer.version", "2"}, {"received", "from b"}}
+	if !reflect.DeepEqual(headers, want) {
+		t.Errorf("headers = %v, want %v", headers, want)
+	}
+	if got := headers.Get("received"); got != "from a" {
+		t.Errorf("Get(received) = %q, want the first one", got)
+	}
+	if got := headers.Values("Received"); !reflect.DeepEqual(got, []string{"from a", "from b"}) {
+		t.Errorf("Values(Received) = %q, want both in order", got)
+	}
+	if got := headers.Get("Message-Id"); got != "" {
+		t.Errorf("Get(Message-Id) = %q, want \"\"", got)
+	}
+}
+
+func TestHeaderQuery(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        string
+	}{
+		{"X-Spam-Flag", "", `{"nested":{"path":"Headers","query":{"bool":{"must":{"term":{"Headers.Name":"x-spam-flag"}}}}}}`},
+		{"List-Id", "golang-nuts.googlegroups.com", `{"nested":{"path":"Headers","query":{"bool":{"must":[{"term":{"Headers.Name":"list-id"}},{"match_phrase":{"Headers.Value":{"query":"golang-nuts.googlegroups.com"}}}]}}}}`},
+	}
+	for _, test := range tests {
+		source, err := headerQuery(test.name, test.value).Source()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query, _ := json.Marshal(source); string(query) != test.want {
+			t.Errorf("headerQuery(%q, %q) = %s, want %s", test.name, test.value, query, test.want)
+		}
+	}
+}
+
+func TestHeadersMapping(t *testing.T) {
+	var mapping interface{}
+	if err := json.Unmarshal([]byte(headersMapping()), &mapping); err != nil {
+		t.Errorf("headersMapping isn't valid JSON: %v", err)
+	}
+}
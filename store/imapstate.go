@@ -0,0 +1,47 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/olivere/elastic"
+	"time"
+)
+
+// ImapState is the checkpoint for incremental IMAP downloads of one folder of an account: every
+// message with a UID up to LastUid has been saved. UIDs are only meaningful while the folder's
+// UIDVALIDITY stays the same; when it changes, the folder has to be downloaded again.
+type ImapState struct {
+	Id          string
+	Account     string
+	Folder      string
+	UidValidity uint32
+	LastUid     uint32
+	UpdatedAt   time.Time
+}
+
+func imapStateId(account, folder string) string {
+	return "imap-" + account + "-" + folder
+}
+
+func (s *Service) SaveImapState(state ImapState) error {
+	state.Id = imapStateId(state.Account, state.Folder)
+	state.UpdatedAt = time.Now()
+	stateJson, _ := json.MarshalIndent(state, "", "\t")
+	_, err := s.saveDoc(s.Ctx, SyncIndex, state.Id, string(stateJson))
+	return err
+}
+
+// GetImapState returns the saved checkpoint for the folder, or false if there isn't one yet.
+func (s *Service) GetImapState(account, folder string) (ImapState, bool, error) {
+	var state ImapState
+	doc, err := s.Client.Get().Index(SyncIndex).Type("document").Id(imapStateId(account, folder)).Do(s.Ctx)
+	if elastic.IsNotFound(err) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, err
+	}
+	if err := json.Unmarshal(*doc.Source, &state); err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
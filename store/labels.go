@@ -7,44 +7,115 @@ import (
 )
 
 type Label struct {
-	Id   string
-	Name string
+	Id      string
+	Name    string
+	Account string
 }
 
 const LabelsIndex = "labels"
 
+// LabelsDoc is all the labels of one account.
 type LabelsDoc struct {
-	Id     string
-	Labels []*Label
+	Id      string
+	Account string
+	Labels  []*Label
 }
 
-func (s *Service) SaveLabels(labels []*Label) error {
-	doc := LabelsDoc{
-		Id:     "labels",
-		Labels: labels,
+// labelsDocId is "labels" for the default account, which is what it was before there were
+// accounts, and "labels-" followed by the name for other accounts.
+func labelsDocId(account string) string {
+	if account == DefaultAccount || account == "" {
+		return "labels"
 	}
-	labelsJson, _ := json.MarshalIndent(doc, "", "\t")
+	return "labels-" + account
+}
+
+// SaveLabels saves the labels of the account, keeping any stored labels that aren't among them
+// (e.g. labels made by an import into an account that is also downloaded from Gmail).
+func (s *Service) SaveLabels(account string, labels []*Label) error {
+	id := labelsDocId(account)
+	var stored LabelsDoc
+	doc, err := s.Client.Get().Index(LabelsIndex).Type("document").Id(id).Do(s.Ctx)
+	switch {
+	case elastic.IsNotFound(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(*doc.Source, &stored); err != nil {
+			return err
+		}
+	}
+	labels = mergeLabels(stored.Labels, labels)
+	for _, label := range labels {
+		label.Account = account
+	}
+	labelsDoc := LabelsDoc{
+		Id:      id,
+		Account: account,
+		Labels:  labels,
+	}
+	labelsJson, _ := json.MarshalIndent(labelsDoc, "", "\t")
 
-	if _, err := s.saveDoc(LabelsIndex, "labels", string(labelsJson)); err != nil {
+	if _, err := s.saveDoc(s.Ctx, LabelsIndex, labelsDoc.Id, string(labelsJson)); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (s *Service) getLabelsFromStore() ([]*Label, error) {
-	var doc LabelsDoc
-	query := elastic.NewTermQuery("Id", "labels")
-	result, _ := s.Client.Search().
+// mergeLabels returns the stored labels updated with the new ones (which win if they have the
+// same id), followed by the new labels that weren't stored.
+func mergeLabels(stored, labels []*Label) []*Label {
+	byId := make(map[string]*Label, len(labels))
+	for _, label := range labels {
+		byId[label.Id] = label
+	}
+	merged := make([]*Label, 0, len(stored)+len(labels))
+	for _, label := range stored {
+		if updated, ok := byId[label.Id]; ok {
+			label = updated
+			delete(byId, label.Id)
+		}
+		merged = append(merged, label)
+	}
+	for _, label := range labels {
+		if byId[label.Id] == label {
+			merged = append(merged, label)
+		}
+	}
+	return merged
+}
+
+// getLabelsFromStore returns the labels of the account, or of every account if account is "".
+func (s *Service) getLabelsFromStore(account string) ([]*Label, error) {
+	var query elastic.Query = elastic.NewMatchAllQuery()
+	if account != "" {
+		query = accountQuery(account)
+	}
+	result, err := s.Client.Search().
 		Index(LabelsIndex).
 		Query(query).
+		Size(100).
 		Do(s.Ctx)
-	labelsJson := result.Hits.Hits[0].Source
-	if err := json.Unmarshal(*labelsJson, &doc); err != nil {
-		log.Println("Unable to unmarshal labels json. err: ", err)
+	if err != nil {
 		return nil, err
 	}
-	return doc.Labels, nil
+	var labels []*Label
+	for _, hit := range result.Hits.Hits {
+		var doc LabelsDoc
+		if err := json.Unmarshal(*hit.Source, &doc); err != nil {
+			log.Println("Unable to unmarshal labels json. err: ", err)
+			return nil, err
+		}
+		if doc.Account == "" {
+			doc.Account = DefaultAccount
+		}
+		for _, label := range doc.Labels {
+			label.Account = doc.Account
+		}
+		labels = append(labels, doc.Labels...)
+	}
+	return labels, nil
 }
 
 var googleLabel = map[string]bool{
@@ -67,10 +138,11 @@ var googleLabel = map[string]bool{
 	"Deleted Messages":    true,
 }
 
-func (s *Service) GetLabels(userOnly bool) ([]*Label, error) {
-	labels, err := s.getLabelsFromStore()
+// GetLabels returns the labels of the account, or of every account if account is "".
+func (s *Service) GetLabels(account string, userOnly bool) ([]*Label, error) {
+	labels, err := s.getLabelsFromStore(account)
 	if err != nil {
-		// TODO: handle error
+		return nil, err
 	}
 	if userOnly {
 		userLabels := labels[:0]
@@ -83,3 +155,13 @@ func (s *Service) GetLabels(userOnly bool) ([]*Label, error) {
 	}
 	return labels, nil
 }
+
+// HasLabel says whether labelIds includes labelId (e.g. "STARRED" or "UNREAD").
+func HasLabel(labelIds []string, labelId string) bool {
+	for _, id := range labelIds {
+		if id == labelId {
+			return true
+		}
+	}
+	return false
+}
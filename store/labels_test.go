@@ -0,0 +1,31 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeLabels(t *testing.T) {
+	inbox := &Label{Id: "INBOX", Name: "INBOX"}
+	travel := &Label{Id: "Label_7", Name: "Travel"}
+	renamed := &Label{Id: "Label_7", Name: "Trips"}
+	imported := &Label{Id: "Imported_Receipts", Name: "Receipts"}
+	tests := []struct {
+		name   string
+		stored []*Label
+		labels []*Label
+		want   []*Label
+	}{
+		{"Nothing stored", nil, []*Label{inbox, travel}, []*Label{inbox, travel}},
+		{"Imported labels kept", []*Label{inbox, imported}, []*Label{inbox, travel}, []*Label{inbox, imported, travel}},
+		{"Renamed", []*Label{inbox, travel}, []*Label{renamed}, []*Label{inbox, renamed}},
+		{"Nothing new", []*Label{inbox, imported}, nil, []*Label{inbox, imported}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeLabels(tt.stored, tt.labels); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
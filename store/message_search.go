@@ -14,32 +14,71 @@ type MessageSearch interface {
 }
 
 type RawMessageSearch struct {
-	svc           *Service
-	rawQuery      string
-	searchService *elastic.SearchService
+	svc            *Service
+	rawQuery       string
+	includeDeleted bool
 }
 
 func (s *Service) NewRawMessageSearch(q string) RawMessageSearch {
 	return RawMessageSearch{
-		svc:           s,
-		rawQuery:      q,
-		searchService: s.Client.Search().Source(q),
+		svc:      s,
+		rawQuery: q,
 	}
 }
 
+// IncludeDeleted includes messages that have been deleted or trashed in Gmail, which are left
+// out by default.
+func (r RawMessageSearch) IncludeDeleted(include bool) RawMessageSearch {
+	r.includeDeleted = include
+	return r
+}
+
 func (r RawMessageSearch) QueryString() string {
 	return r.rawQuery
 }
 
 func (r RawMessageSearch) Do() ([]*Message, error) {
-	return r.svc.GetMessages(r.searchService)
+	var source interface{} = r.rawQuery
+	if !r.includeDeleted {
+		body, err := withoutDeletedSource(r.rawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse query: %v", err)
+		}
+		source = body
+	}
+	return r.svc.GetMessages(r.svc.Client.Search().Index(MailIndex).Source(source))
+}
+
+// withoutDeletedSource wraps the query of a raw search body so that it leaves out tombstoned
+// messages, keeping the rest of the body (size, sort and so on) as it is.
+func withoutDeletedSource(rawQuery string) (map[string]interface{}, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(rawQuery), &body); err != nil {
+		return nil, err
+	}
+	var query elastic.Query = elastic.NewMatchAllQuery()
+	if q, ok := body["query"]; ok {
+		queryJson, err := json.Marshal(q)
+		if err != nil {
+			return nil, err
+		}
+		query = elastic.NewRawStringQuery(string(queryJson))
+	}
+	source, err := withoutDeleted(query).Source()
+	if err != nil {
+		return nil, err
+	}
+	body["query"] = source
+	return body, nil
 }
 
 type StructuredMessageSearch struct {
-	svc           *Service
-	query         *elastic.BoolQuery
-	searchSource  *elastic.SearchSource
-	searchService *elastic.SearchService
+	svc            *Service
+	query          *elastic.BoolQuery
+	searchSource   *elastic.SearchSource
+	searchService  *elastic.SearchService
+	includeDeleted bool
+	account        string
 }
 
 func (s *Service) NewStructuredMessageSearch() StructuredMessageSearch {
@@ -58,13 +97,31 @@ func (s StructuredMessageSearch) newOrExistingQuery() *elastic.BoolQuery {
 	return query
 }
 
+// Account limits the search to messages from one account. Call it before Label so that the label
+// is looked up in that account.
+func (s StructuredMessageSearch) Account(account string) StructuredMessageSearch {
+	if account == "" {
+		return s
+	}
+	s.account = account
+	query := s.newOrExistingQuery()
+	return s.updateQuery(query.Must(accountQuery(account)))
+}
+
 func (s StructuredMessageSearch) Label(labelName string) StructuredMessageSearch {
-	labelId, err := s.svc.FindLabelId(labelName)
+	if labelName == "" {
+		return s
+	}
+	labelIds, err := s.svc.FindLabelIds(s.account, labelName)
 	if err != nil {
 		// TODO: Deal with errors. Maybe add an errors field; in the meantime, do nothing
 		return s
 	}
-	labelQuery := elastic.NewTermQuery("LabelIds.keyword", labelId)
+	values := make([]interface{}, len(labelIds))
+	for i, id := range labelIds {
+		values[i] = id
+	}
+	labelQuery := elastic.NewTermsQuery("LabelIds.keyword", values...)
 	query := s.newOrExistingQuery()
 	return s.updateQuery(query.Must(labelQuery))
 }
@@ -78,19 +135,50 @@ func (s StructuredMessageSearch) Starred(starred bool) StructuredMessageSearch {
 	return s.updateQuery(query.Must(starredQuery))
 }
 
+// Participants limits the search to messages that every one of the comma separated participants
+// (addresses, domains or names) sent, received or was copied on.
 func (s StructuredMessageSearch) Participants(participants string) StructuredMessageSearch {
 	if participants == "" {
 		return s
 	}
-	emails := strings.Split(participants, ",")
 	query := s.newOrExistingQuery()
-	for _, email := range emails {
-		mm := elastic.NewMultiMatchQuery(email, "From", "To", "Cc").Type("cross_fields").Operator("and")
-		query = query.Must(mm)
+	for _, participant := range strings.Split(participants, ",") {
+		if strings.TrimSpace(participant) != "" {
+			query = query.Must(participantQuery(participant))
+		}
 	}
 	return s.updateQuery(query)
 }
 
+// Header limits the search to messages with the header. If value isn't "", the header has to
+// contain it as a phrase, ignoring case, e.g. Header("List-Id", "golang-nuts.googlegroups.com").
+func (s StructuredMessageSearch) Header(name, value string) StructuredMessageSearch {
+	if strings.TrimSpace(name) == "" {
+		return s
+	}
+	query := s.newOrExistingQuery()
+	return s.updateQuery(query.Must(headerQuery(name, value)))
+}
+
+// Conversation limits the search to the messages in a conversation (see Message.Conversation).
+func (s StructuredMessageSearch) Conversation(conversationId string) StructuredMessageSearch {
+	if conversationId == "" {
+		return s
+	}
+	query := s.newOrExistingQuery()
+	return s.updateQuery(query.Must(conversationQuery(conversationId)))
+}
+
+// Attachment limits the search to messages with an attachment whose filename contains the words
+// as a phrase, ignoring case, e.g. Attachment("invoice.pdf") or Attachment("invoice").
+func (s StructuredMessageSearch) Attachment(filename string) StructuredMessageSearch {
+	if strings.TrimSpace(filename) == "" {
+		return s
+	}
+	query := s.newOrExistingQuery()
+	return s.updateQuery(query.Must(elastic.NewMatchPhraseQuery("Attachments.Filename", filename)))
+}
+
 func (s StructuredMessageSearch) BodyOrSubject(term string) StructuredMessageSearch {
 	if term == "" {
 		return s
@@ -104,6 +192,25 @@ func (s StructuredMessageSearch) BodyOrSubject(term string) StructuredMessageSea
 	return s.updateQuery(query)
 }
 
+// NewContentOrSubject is BodyOrSubject, but only matches what the sender wrote, not what they
+// quoted or their signature, so that a search doesn't find every reply to the message that has
+// the words. Messages saved before bodies were split are matched on their whole body.
+func (s StructuredMessageSearch) NewContentOrSubject(term string) StructuredMessageSearch {
+	if term == "" {
+		return s
+	}
+	query := s.newOrExistingQuery()
+	newContentQuery := elastic.
+		NewMultiMatchQuery(term, "Subject", "NewContent").
+		Type("cross_fields").
+		Operator("and")
+	legacy := elastic.NewBoolQuery().
+		Must(elastic.NewMultiMatchQuery(term, "Subject", "Body").Type("cross_fields").Operator("and")).
+		MustNot(elastic.NewExistsQuery("NewContent"))
+	query = query.Must(elastic.NewBoolQuery().Should(newContentQuery, legacy).MinimumNumberShouldMatch(1))
+	return s.updateQuery(query)
+}
+
 func (s StructuredMessageSearch) DateRange(d1, d2, tz string) StructuredMessageSearch {
 	query := s.newOrExistingQuery()
 	startDate, startErr := time.Parse("2006-01-02 15:04:05 -0700", fmt.Sprintf("%s 00:00:00 %s", d1, tz))
@@ -127,6 +234,13 @@ func (s StructuredMessageSearch) DateRange(d1, d2, tz string) StructuredMessageS
 	return s.updateQuery(query.Must(rangeQuery))
 }
 
+// IncludeDeleted includes messages that have been deleted or trashed in Gmail, which are left
+// out by default.
+func (s StructuredMessageSearch) IncludeDeleted(include bool) StructuredMessageSearch {
+	s.includeDeleted = include
+	return s
+}
+
 func (s StructuredMessageSearch) Size(size int) StructuredMessageSearch {
 	searchSource := s.getSearchSource()
 	s.searchSource = searchSource.Size(size)
@@ -137,19 +251,34 @@ func (s StructuredMessageSearch) Size(size int) StructuredMessageSearch {
 func (s StructuredMessageSearch) Sort(field string, asc bool) StructuredMessageSearch {
 	searchSource := s.getSearchSource()
 	s.searchSource = searchSource.Sort(field, asc)
-	s.searchService = s.svc.Client.Search().SearchSource(s.searchSource)
+	s.searchService = s.getSearchService()
 	return s
 }
 
 func (s StructuredMessageSearch) QueryString() string {
-	source, _ := s.getSearchSource().Source()
+	source, _ := s.finalSearchSource().Source()
 	queryJson, _ := json.MarshalIndent(source, "", "  ")
 	query := string(queryJson)
 	return query
 }
 
 func (s StructuredMessageSearch) Do() ([]*Message, error) {
-	return s.svc.GetMessages(s.searchService)
+	searchService := s.svc.Client.Search().Index(MailIndex).SearchSource(s.finalSearchSource())
+	return s.svc.GetMessages(searchService)
+}
+
+// finalSearchSource filters out tombstoned messages unless they were asked for. The query is
+// set again here so it doesn't matter what order the search was built up in.
+func (s StructuredMessageSearch) finalSearchSource() *elastic.SearchSource {
+	searchSource := s.getSearchSource()
+	var query elastic.Query = elastic.NewMatchAllQuery()
+	if s.query != nil {
+		query = s.query
+	}
+	if s.includeDeleted {
+		return searchSource.Query(query)
+	}
+	return searchSource.Query(withoutDeleted(query))
 }
 
 func (s StructuredMessageSearch) getSearchSource() *elastic.SearchSource {
@@ -175,6 +304,6 @@ func (s StructuredMessageSearch) updateQuery(query *elastic.BoolQuery) Structure
 }
 
 func (s StructuredMessageSearch) getSearchService() *elastic.SearchService {
-	ss := s.svc.Client.Search().SearchSource(s.searchSource)
+	ss := s.svc.Client.Search().Index(MailIndex).SearchSource(s.searchSource)
 	return ss
 }
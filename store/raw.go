@@ -0,0 +1,86 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const RawIndex = "raw"
+
+// The compressed message is stored but not indexed.
+const rawMapping = `{
+	"mappings": {
+		"document": {
+			"properties": {
+				"Gzip": {"type": "binary"}
+			}
+		}
+	}
+}`
+
+// RawMessage is the original RFC 822 source of a message, gzipped.
+type RawMessage struct {
+	Id      string
+	Sha256  string
+	Size    int
+	Gzip    []byte
+	SavedAt time.Time
+}
+
+// SaveRawMessage saves the compressed source of a message and returns its SHA-256 digest.
+func (s *Service) SaveRawMessage(ctx context.Context, id string, raw []byte) (string, error) {
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(raw); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	doc := RawMessage{
+		Id:      id,
+		Sha256:  hex.EncodeToString(sum[:]),
+		Size:    len(raw),
+		Gzip:    compressed.Bytes(),
+		SavedAt: time.Now(),
+	}
+	rawJson, _ := json.Marshal(doc)
+	if _, err := s.saveDoc(ctx, RawIndex, id, string(rawJson)); err != nil {
+		return "", err
+	}
+	return doc.Sha256, nil
+}
+
+// GetRawMessage returns the original source of a message, checking that it hasn't changed
+// since it was saved.
+func (s *Service) GetRawMessage(id string) ([]byte, error) {
+	doc, err := s.Client.Get().Index(RawIndex).Type("document").Id(id).Do(s.Ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rawMessage RawMessage
+	if err := json.Unmarshal(*doc.Source, &rawMessage); err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(rawMessage.Gzip))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	if hex.EncodeToString(sum[:]) != rawMessage.Sha256 {
+		return nil, fmt.Errorf("raw message %v does not match its SHA-256 digest", id)
+	}
+	return raw, nil
+}
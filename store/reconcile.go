@@ -0,0 +1,122 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/olivere/elastic"
+	"io"
+	"sort"
+	"time"
+)
+
+// notDeleted matches messages that haven't been tombstoned.
+func notDeleted() elastic.Query {
+	return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("DeletedAt"))
+}
+
+// withoutDeleted restricts query to messages that haven't been tombstoned.
+func withoutDeleted(query elastic.Query) elastic.Query {
+	return elastic.NewBoolQuery().Must(query).MustNot(elastic.NewExistsQuery("DeletedAt"))
+}
+
+// TombstoneMessage marks a message as deleted in Gmail without removing it from the store, and
+// takes it out of its thread.
+func (s *Service) TombstoneMessage(id string, deletedAt time.Time) error {
+	_, err := s.Client.Update().
+		Index(MailIndex).
+		Type("document").
+		Id(id).
+		Doc(map[string]interface{}{"DeletedAt": deletedAt}).
+		RetryOnConflict(3).
+		Do(s.Ctx)
+	if elastic.IsNotFound(err) {
+		// Never downloaded (e.g. excluded by a header filter), nothing to mark.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if message, err := s.GetMessage(id); err == nil {
+		s.RemoveFromThread(message.Conversation(), id)
+	}
+	return nil
+}
+
+// RestoreMessage removes the tombstone from a message that has turned up in Gmail again
+// (e.g. it was taken out of the trash).
+func (s *Service) RestoreMessage(id string) error {
+	script := elastic.NewScript("ctx._source.remove('DeletedAt')")
+	_, err := s.Client.Update().
+		Index(MailIndex).
+		Type("document").
+		Id(id).
+		Script(script).
+		RetryOnConflict(3).
+		Do(s.Ctx)
+	if err != nil {
+		return err
+	}
+	if message, err := s.GetMessage(id); err == nil {
+		s.AddToThread(message)
+	}
+	return nil
+}
+
+// gmailQuery matches messages that came from Gmail, including those saved before there was
+// Content (which have the Gmail API message as their Source), as opposed to imported ones.
+func gmailQuery() elastic.Query {
+	return elastic.NewBoolQuery().
+		Should(elastic.NewTermQuery("Content.Source.keyword", SourceGmail), elastic.NewExistsQuery("Source")).
+		MinimumNumberShouldMatch(1)
+}
+
+// GmailMessageIds returns the id of every message in the account that came from Gmail and
+// whether it has been tombstoned. Messages imported into the account are left out, since Gmail
+// doesn't know about them.
+func (s *Service) GmailMessageIds(account string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	scroll := s.Client.Scroll(MailIndex).
+		Type("document").
+		Query(elastic.NewBoolQuery().Must(accountQuery(account)).Filter(gmailQuery())).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("DeletedAt")).
+		Size(1000)
+	defer scroll.Clear(s.Ctx)
+	for {
+		results, err := scroll.Do(s.Ctx)
+		if err == io.EOF {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range results.Hits.Hits {
+			var fields struct{ DeletedAt *time.Time }
+			if hit.Source != nil {
+				if err := json.Unmarshal(*hit.Source, &fields); err != nil {
+					return nil, err
+				}
+			}
+			ids[hit.Id] = fields.DeletedAt != nil
+		}
+	}
+}
+
+// Reconcile compares the ids listed in Gmail with the ids in the store (see GmailMessageIds). It
+// returns the stored messages that are no longer in Gmail and haven't been tombstoned yet, and the
+// tombstoned messages that are back in Gmail.
+func Reconcile(gmailIds []string, stored map[string]bool) (tombstone []string, restore []string) {
+	inGmail := make(map[string]bool, len(gmailIds))
+	for _, id := range gmailIds {
+		inGmail[id] = true
+		if deleted, ok := stored[id]; ok && deleted {
+			restore = append(restore, id)
+		}
+	}
+	for id, deleted := range stored {
+		if !deleted && !inGmail[id] {
+			tombstone = append(tombstone, id)
+		}
+	}
+	sort.Strings(tombstone)
+	sort.Strings(restore)
+	return tombstone, restore
+}
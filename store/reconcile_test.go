@@ -0,0 +1,65 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name          string
+		gmailIds      []string
+		stored        map[string]bool
+		wantTombstone []string
+		wantRestore   []string
+	}{
+		{"Nothing changed", []string{"1", "2"}, map[string]bool{"1": false, "2": false}, nil, nil},
+		{"Deleted in Gmail", []string{"1"}, map[string]bool{"1": false, "2": false, "3": false}, []string{"2", "3"}, nil},
+		{"Already tombstoned", []string{"1"}, map[string]bool{"1": false, "2": true}, nil, nil},
+		{"Back in Gmail", []string{"1", "2"}, map[string]bool{"1": false, "2": true}, nil, []string{"2"}},
+		{"Not downloaded yet", []string{"1", "2"}, map[string]bool{"1": false}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tombstone, restore := Reconcile(tt.gmailIds, tt.stored)
+			if !reflect.DeepEqual(tombstone, tt.wantTombstone) {
+				t.Errorf("Reconcile() tombstone = %v, want %v", tombstone, tt.wantTombstone)
+			}
+			if !reflect.DeepEqual(restore, tt.wantRestore) {
+				t.Errorf("Reconcile() restore = %v, want %v", restore, tt.wantRestore)
+			}
+		})
+	}
+}
+
+func TestWithoutDeletedSource(t *testing.T) {
+	notDeleted := `"must_not":{"exists":{"field":"DeletedAt"}}`
+	tests := []struct {
+		name     string
+		rawQuery string
+		want     string
+		wantErr  bool
+	}{
+		{"Query", `{"query":{"term":{"Starred":true}},"size":5}`,
+			`{"query":{"bool":{"must":{"term":{"Starred":true}},` + notDeleted + `}},"size":5}`, false},
+		{"No query", `{"size":5}`,
+			`{"query":{"bool":{"must":{"match_all":{}},` + notDeleted + `}},"size":5}`, false},
+		{"Not JSON", `Starred:true`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := withoutDeletedSource(tt.rawQuery)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("withoutDeletedSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, _ := json.Marshal(body)
+			if string(got) != tt.want {
+				t.Errorf("withoutDeletedSource() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/olivere/elastic"
 	"golang.org/x/net/context"
-	"google.golang.org/api/gmail/v1"
 	"log"
 	"reflect"
 	"time"
@@ -21,18 +20,94 @@ type Service struct {
 
 type Message struct {
 	Id                  string
+	Account             string
 	Url                 string
 	ThreadId            string
+	ConversationId      string `json:",omitempty"`
 	LabelIds            []string
+	Starred             bool
+	Unread              bool
 	Date                time.Time
 	DownloadedStartedAt time.Time
 	To                  string
 	Cc                  string
+	Bcc                 string
 	From                string
+	ReplyTo             string
 	Subject             string
 	Snippet             string
 	Body                string
-	Source              gmail.Message
+	Attachments         []Attachment
+	RawSha256           string
+	// Parsed from the address headers, for matching people and domains exactly
+	Addresses Addresses
+	Headers   Headers `json:",omitempty"`
+	// Body split up by who wrote it (see gmailservice.SplitBody). NewContent is saved even if
+	// it's "", so that messages saved before bodies were split can be told apart.
+	NewContent    string
+	QuotedContent string `json:",omitempty"`
+	Signature     string `json:",omitempty"`
+	// DeletedAt is set when the message is found to have been deleted or trashed in Gmail.
+	// Tombstoned messages are kept, but left out of searches unless asked for.
+	DeletedAt *time.Time `json:",omitempty"`
+	Content   Content
+	// Source is the Gmail API message that messages downloaded before there was Content were
+	// saved with, kept as it was saved so that they can still be shown.
+	Source json.RawMessage `json:",omitempty"`
+	// Raw is the original RFC 822 message, if it was downloaded. It is saved separately
+	// (see SaveRawMessage) rather than as part of the message document.
+	Raw []byte `json:"-"`
+	// FetchError is set when the message couldn't be downloaded, in which case only the id is
+	// known and the error is saved as the subject (see SaveFetchFailure).
+	FetchError string `json:"-"`
+}
+
+// Where messages come from, for Content.Source
+const (
+	SourceGmail = "gmail"
+	SourceImap  = "imap"
+	SourceFile  = "file"
+)
+
+// Content is the body of a message as its source gave it, in the same form whichever source it
+// came from (the Gmail API, an IMAP server or a file), so that it can be shown without knowing
+// where it came from. Its headers are the message's Headers.
+type Content struct {
+	// Where the message came from, e.g. SourceGmail
+	Source string
+	// Every part of the body that isn't made of other parts (as multipart/* parts are), in the
+	// order they appear in the message
+	Parts []Part `json:",omitempty"`
+}
+
+// Part is one part of the body of a message.
+type Part struct {
+	MimeType string
+	Filename string `json:",omitempty"`
+	// The content of a text/plain or text/html part that isn't an attachment, decoded to UTF-8;
+	// other parts are only described (see Message.Attachments for where attachments are kept)
+	Text string `json:",omitempty"`
+	// Size of the content in bytes, as the source reported it or once it was decoded
+	Size int64 `json:",omitempty"`
+}
+
+// Html returns the first text/html part that isn't an attachment, or "" if there isn't one.
+func (c Content) Html() string {
+	for _, part := range c.Parts {
+		if part.MimeType == "text/html" && part.Filename == "" && part.Text != "" {
+			return part.Text
+		}
+	}
+	return ""
+}
+
+// Attachment is the metadata for a file attached to a message. Sha256 is only set if the
+// content was downloaded, and can be used to find the content in the blob directory.
+type Attachment struct {
+	Filename string
+	MimeType string
+	Size     int64
+	Sha256   string
 }
 
 const MailIndex = "mail"
@@ -49,10 +124,34 @@ func New(ctx context.Context) (*Service, error) {
 		log.Printf("Error creating %v index: %v\n", MailIndex, err)
 		return nil, err
 	}
+	if err := putMapping(MailIndex, addressesMapping(), client, ctx); err != nil {
+		log.Printf("Error adding address fields to %v index: %v\n", MailIndex, err)
+		return nil, err
+	}
+	if err := putMapping(MailIndex, headersMapping(), client, ctx); err != nil {
+		log.Printf("Error adding header fields to %v index: %v\n", MailIndex, err)
+		return nil, err
+	}
 	if err := createIndex(LabelsIndex, client, ctx); err != nil {
 		log.Printf("Error creating %v index: %v\n", LabelsIndex, err)
 		return nil, err
 	}
+	if err := createIndex(SyncIndex, client, ctx); err != nil {
+		log.Printf("Error creating %v index: %v\n", SyncIndex, err)
+		return nil, err
+	}
+	if err := createIndex(CheckpointIndex, client, ctx); err != nil {
+		log.Printf("Error creating %v index: %v\n", CheckpointIndex, err)
+		return nil, err
+	}
+	if err := createIndex(ThreadsIndex, client, ctx); err != nil {
+		log.Printf("Error creating %v index: %v\n", ThreadsIndex, err)
+		return nil, err
+	}
+	if err := createIndexWithMapping(RawIndex, rawMapping, client, ctx); err != nil {
+		log.Printf("Error creating %v index: %v\n", RawIndex, err)
+		return nil, err
+	}
 
 	svc := Service{
 		Client:      client,
@@ -64,13 +163,23 @@ func New(ctx context.Context) (*Service, error) {
 }
 
 func createIndex(name string, client *elastic.Client, ctx context.Context) error {
+	return createIndexWithMapping(name, "", client, ctx)
+}
+
+// createIndexWithMapping creates the index if it doesn't exist yet, using the mapping (if not
+// empty) as the body of the create index request.
+func createIndexWithMapping(name string, mapping string, client *elastic.Client, ctx context.Context) error {
 	exists, err := client.IndexExists(name).Do(ctx)
 	if err != nil {
 		log.Printf("failed to discover if index '%s' exists, %v", name, err)
 		return err
 	}
 	if !exists {
-		if _, err := client.CreateIndex(name).Do(ctx); err != nil {
+		request := client.CreateIndex(name)
+		if mapping != "" {
+			request = request.BodyString(mapping)
+		}
+		if _, err := request.Do(ctx); err != nil {
 			log.Printf("failed to create '%s' index, %v", name, err)
 			return err
 		}
@@ -78,13 +187,13 @@ func createIndex(name string, client *elastic.Client, ctx context.Context) error
 	return nil
 }
 
-func (s *Service) saveDoc(index string, id string, json string) (*elastic.IndexResponse, error) {
+func (s *Service) saveDoc(ctx context.Context, index string, id string, json string) (*elastic.IndexResponse, error) {
 	response, err := s.Client.Index().
 		Index(index).
 		Id(id).
 		Type("document").
 		BodyJson(json).
-		Do(s.Ctx)
+		Do(ctx)
 	if err != nil {
 		log.Printf("################ Failed to index data id %s in index %s, err: %v", id, index, err)
 	}
@@ -96,10 +205,30 @@ type MessageResponse struct {
 	Response *elastic.IndexResponse
 }
 
-func (s *Service) SaveMessage(data Message, responses chan<- *MessageResponse) error {
+// SaveMessage saves the message (and its source, if it has one) and adds it to its thread. A message
+// without a ConversationId is in its ThreadId's conversation if its source threads messages (as
+// Gmail does), or else stays in the conversation it was in when it was saved before, or is given
+// the one its own headers point to. Messages that were saved before are sent on responses. The
+// message isn't saved if ctx is cancelled first.
+func (s *Service) SaveMessage(ctx context.Context, data Message, responses chan<- *MessageResponse) error {
 	log.Println("saving Message ID: ", data.Id)
+	var oldThread string
+	switch {
+	case data.ConversationId != "":
+	case data.ThreadId != "":
+		data.ConversationId = data.ThreadId
+	default:
+		data.ConversationId, oldThread = s.unthreadedConversation(ctx, data)
+	}
+	if len(data.Raw) > 0 {
+		sha, err := s.SaveRawMessage(ctx, data.Id, data.Raw)
+		if err != nil {
+			return err
+		}
+		data.RawSha256 = sha
+	}
 	messageJson, _ := json.MarshalIndent(data, "", "\t")
-	response, err := s.saveDoc(MailIndex, data.Id, string(messageJson))
+	response, err := s.saveDoc(ctx, MailIndex, data.Id, string(messageJson))
 	if err != nil {
 		return err
 	}
@@ -112,25 +241,59 @@ func (s *Service) SaveMessage(data Message, responses chan<- *MessageResponse) e
 		}
 	}
 	log.Printf("\nIndexed Message\nid: %s\n%s version:%d\nSubject:%s\n\n", response.Id, alert, response.Version, data.Subject)
+	// The message is saved even if its thread can't be updated, so don't report this as a failure.
+	if oldThread != "" {
+		s.RemoveFromThread(oldThread, data.Id)
+	}
+	s.AddToThread(data)
 	return nil
 }
 
-func (s *Service) FindLabelId(labelName string) (string, error) {
-	labels, err := s.GetLabels(false)
+// SaveFetchFailure saves a message that couldn't be downloaded (see Message.FetchError) so that
+// the failure shows up in searches, unless the message was saved before, in which case the
+// document that's already there is kept.
+func (s *Service) SaveFetchFailure(ctx context.Context, data Message) error {
+	messageJson, _ := json.MarshalIndent(data, "", "\t")
+	_, err := s.Client.Index().
+		Index(MailIndex).
+		Type("document").
+		Id(data.Id).
+		OpType("create").
+		BodyJson(string(messageJson)).
+		Do(ctx)
+	if elastic.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+// FindLabelId returns the id of the label in the account (any account if account is "").
+func (s *Service) FindLabelId(account, labelName string) (string, error) {
+	labelIds, err := s.FindLabelIds(account, labelName)
+	if err != nil {
+		return "", err
+	}
+	return labelIds[0], nil
+}
+
+// FindLabelIds returns the ids of every label with the name in the account, or in every account
+// if account is "". User labels with the same name have different ids in different accounts.
+func (s *Service) FindLabelIds(account, labelName string) ([]string, error) {
+	labels, err := s.GetLabels(account, false)
 	if err != nil {
-		return "", errors.New("Could not get labels from Elasticsearch")
+		return nil, errors.New("Could not get labels from Elasticsearch")
 	}
-	var labelId string
+	var labelIds []string
 	for _, label := range labels {
-		if label.Name == labelName {
-			labelId = label.Id
+		if label.Name == labelName && !HasLabel(labelIds, label.Id) {
+			labelIds = append(labelIds, label.Id)
 		}
 	}
-	if labelId == "" {
+	if len(labelIds) == 0 {
 		err := fmt.Sprintf("Label %v not found.", labelName)
-		return "", errors.New(err)
+		return nil, errors.New(err)
 	}
-	return labelId, nil
+	return labelIds, nil
 }
 
 func (s *Service) GetMessage(id string) (Message, error) {
@@ -172,7 +335,7 @@ type Stats struct {
 
 func (s *Service) GetStats() (Stats, error) {
 	var stats Stats
-	builder := s.Client.Search().Index(MailIndex).Query(elastic.NewMatchAllQuery())
+	builder := s.Client.Search().Index(MailIndex).Query(notDeleted())
 	builder = builder.Aggregation("maxDate", elastic.NewMaxAggregation().Field("Date"))
 	builder = builder.Aggregation("minDate", elastic.NewMinAggregation().Field("Date"))
 	results, err := builder.Pretty(true).Do(s.Ctx)
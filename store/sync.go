@@ -0,0 +1,117 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/olivere/elastic"
+	"time"
+)
+
+const SyncIndex = "sync"
+
+// SyncState is the checkpoint for incremental downloads. Id is the Gmail address of the
+// account and HistoryId is the Gmail history id that everything in the store is current as of.
+type SyncState struct {
+	Id        string
+	HistoryId uint64
+	UpdatedAt time.Time
+}
+
+func (s *Service) SaveSyncState(state SyncState) error {
+	stateJson, _ := json.MarshalIndent(state, "", "\t")
+	if _, err := s.saveDoc(s.Ctx, SyncIndex, state.Id, string(stateJson)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetSyncState returns the saved checkpoint for the account, or false if there isn't one yet.
+func (s *Service) GetSyncState(account string) (SyncState, bool, error) {
+	var state SyncState
+	doc, err := s.Client.Get().Index(SyncIndex).Type("document").Id(account).Do(s.Ctx)
+	if elastic.IsNotFound(err) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, err
+	}
+	if err := json.Unmarshal(*doc.Source, &state); err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
+
+const updateLabelsScript = `
+if (ctx._source.LabelIds == null) {
+	ctx._source.LabelIds = [];
+}
+for (label in params.removed) {
+	ctx._source.LabelIds.removeIf(l -> l == label);
+}
+for (label in params.added) {
+	if (!ctx._source.LabelIds.contains(label)) {
+		ctx._source.LabelIds.add(label);
+	}
+}
+ctx._source.Starred = ctx._source.LabelIds.contains('STARRED');
+ctx._source.Unread = ctx._source.LabelIds.contains('UNREAD');`
+
+// UpdateLabels adds and removes label ids on a saved message without re-indexing the rest of it.
+func (s *Service) UpdateLabels(id string, added, removed []string) error {
+	script := elastic.NewScript(updateLabelsScript).Params(map[string]interface{}{
+		"added":   stringsOrEmpty(added),
+		"removed": stringsOrEmpty(removed),
+	})
+	_, err := s.Client.Update().
+		Index(MailIndex).
+		Type("document").
+		Id(id).
+		Script(script).
+		RetryOnConflict(3).
+		Do(s.Ctx)
+	if elastic.IsNotFound(err) {
+		// Message was never downloaded (e.g. excluded by a header filter), nothing to update.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if message, err := s.GetMessage(id); err == nil {
+		s.AddToThread(message)
+	}
+	return nil
+}
+
+// SetLabels replaces the label ids (and starred and unread state) of a saved message without
+// re-indexing the rest of it. Returns false if the labels were already up to date.
+func (s *Service) SetLabels(id string, labelIds []string) (bool, error) {
+	labelIds = stringsOrEmpty(labelIds)
+	response, err := s.Client.Update().
+		Index(MailIndex).
+		Type("document").
+		Id(id).
+		Doc(map[string]interface{}{
+			"LabelIds": labelIds,
+			"Starred":  HasLabel(labelIds, "STARRED"),
+			"Unread":   HasLabel(labelIds, "UNREAD"),
+		}).
+		DetectNoop(true).
+		RetryOnConflict(3).
+		Do(s.Ctx)
+	if err != nil {
+		return false, err
+	}
+	if response.Result == "noop" {
+		return false, nil
+	}
+	if message, err := s.GetMessage(id); err == nil {
+		s.AddToThread(message)
+	}
+	return true, nil
+}
+
+func stringsOrEmpty(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
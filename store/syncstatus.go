@@ -0,0 +1,143 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/olivere/elastic"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// SyncStatus is the state of the background sync of an account (see `calliope sync --every`).
+// Statuses are kept in the sync index so that the web server can show them whichever process
+// is doing the syncing.
+type SyncStatus struct {
+	Id            string
+	Account       string
+	Running       bool
+	LastStarted   time.Time
+	LastFinished  time.Time
+	LastSucceeded time.Time
+	LastError     string
+	LastSaved     int64
+	Failures      int // runs that have failed in a row
+	NextRun       time.Time
+	UpdatedAt     time.Time
+}
+
+func syncStatusId(account string) string {
+	return "status-" + account
+}
+
+func (s *Service) SaveSyncStatus(status SyncStatus) error {
+	status.Id = syncStatusId(status.Account)
+	status.UpdatedAt = time.Now()
+	statusJson, _ := json.MarshalIndent(status, "", "\t")
+	_, err := s.saveDoc(s.Ctx, SyncIndex, status.Id, string(statusJson))
+	return err
+}
+
+// GetSyncStatuses returns the status of every account that has been synced in the background,
+// sorted by account.
+func (s *Service) GetSyncStatuses() ([]SyncStatus, error) {
+	results, err := s.Client.Search().
+		Index(SyncIndex).
+		// Only statuses have NextRun; the index also has sync checkpoints and locks
+		Query(elastic.NewExistsQuery("NextRun")).
+		Size(1000).
+		Do(s.Ctx)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []SyncStatus
+	for _, item := range results.Each(reflect.TypeOf(SyncStatus{})) {
+		statuses = append(statuses, item.(SyncStatus))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Account < statuses[j].Account })
+	return statuses, nil
+}
+
+// Lock is held by one process at a time until it is released or expires.
+type Lock struct {
+	Id        string
+	Owner     string
+	ExpiresAt time.Time
+}
+
+func lockId(name string) string {
+	return "lock-" + name
+}
+
+// AcquireLock takes the named lock for owner for ttl, and returns false if another owner holds
+// it. The owner that holds a lock can call this again to extend it. Locks are documents in the
+// sync index, so they keep separate processes apart too; a lock left behind by a process that
+// died is taken over once it has expired.
+func (s *Service) AcquireLock(name, owner string, ttl time.Duration) (bool, error) {
+	lock := Lock{Id: lockId(name), Owner: owner, ExpiresAt: time.Now().Add(ttl)}
+	_, err := s.Client.Index().
+		Index(SyncIndex).
+		Type("document").
+		Id(lock.Id).
+		OpType("create").
+		BodyJson(lock).
+		Do(s.Ctx)
+	if err == nil {
+		return true, nil
+	}
+	if !elastic.IsConflict(err) {
+		return false, err
+	}
+	held, version, found, err := s.getLock(lock.Id)
+	if err != nil || !found {
+		// Released in the meantime; try again next time rather than race for it
+		return false, err
+	}
+	if held.Owner != owner && time.Now().Before(held.ExpiresAt) {
+		return false, nil
+	}
+	// Only replaces the lock if nobody else has since
+	_, err = s.Client.Index().
+		Index(SyncIndex).
+		Type("document").
+		Id(lock.Id).
+		Version(version).
+		BodyJson(lock).
+		Do(s.Ctx)
+	if elastic.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseLock releases the named lock if owner holds it.
+func (s *Service) ReleaseLock(name, owner string) error {
+	id := lockId(name)
+	held, version, found, err := s.getLock(id)
+	if err != nil || !found || held.Owner != owner {
+		return err
+	}
+	_, err = s.Client.Delete().Index(SyncIndex).Type("document").Id(id).Version(version).Do(s.Ctx)
+	if elastic.IsNotFound(err) || elastic.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *Service) getLock(id string) (Lock, int64, bool, error) {
+	var lock Lock
+	doc, err := s.Client.Get().Index(SyncIndex).Type("document").Id(id).Do(s.Ctx)
+	if elastic.IsNotFound(err) {
+		return lock, 0, false, nil
+	}
+	if err != nil {
+		return lock, 0, false, err
+	}
+	if err := json.Unmarshal(*doc.Source, &lock); err != nil {
+		return lock, 0, false, err
+	}
+	var version int64
+	if doc.Version != nil {
+		version = *doc.Version
+	}
+	return lock, version, true, nil
+}
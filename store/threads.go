@@ -0,0 +1,237 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/olivere/elastic"
+	"log"
+	"net/mail"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ThreadsIndex = "threads"
+
+// Number of times to retry a thread update when another message in the same thread was saved
+// at the same time
+const threadUpdateAttempts = 5
+
+// Thread is a conversation, kept up to date as its messages are saved. Everything except
+// Messages is derived from Messages.
+type Thread struct {
+	Id string
+	// Account of the thread's first message; DefaultAccount if it was saved without one
+	Account      string
+	Subject      string
+	Participants []string
+	MessageCount int
+	FirstDate    time.Time
+	LastDate     time.Time
+	LabelIds     []string
+	Unread       bool
+	Messages     []ThreadMessage
+}
+
+// ThreadMessage is the part of a message needed to summarize its thread.
+type ThreadMessage struct {
+	Id       string
+	Account  string
+	Date     time.Time
+	Subject  string
+	From     string
+	To       string
+	Cc       string
+	LabelIds []string
+}
+
+func threadMessage(m Message) ThreadMessage {
+	return ThreadMessage{
+		Id:       m.Id,
+		Account:  m.Account,
+		Date:     m.Date,
+		Subject:  m.Subject,
+		From:     m.From,
+		To:       m.To,
+		Cc:       m.Cc,
+		LabelIds: m.LabelIds,
+	}
+}
+
+// AddMessage adds or replaces a message in the thread and updates the summary.
+func (t *Thread) AddMessage(m ThreadMessage) {
+	t.RemoveMessage(m.Id)
+	t.Messages = append(t.Messages, m)
+	t.summarize()
+}
+
+func (t *Thread) RemoveMessage(id string) {
+	messages := t.Messages[:0]
+	for _, m := range t.Messages {
+		if m.Id != id {
+			messages = append(messages, m)
+		}
+	}
+	t.Messages = messages
+	t.summarize()
+}
+
+func (t *Thread) summarize() {
+	sort.Slice(t.Messages, func(i, j int) bool {
+		return t.Messages[i].Date.Before(t.Messages[j].Date)
+	})
+	t.MessageCount = len(t.Messages)
+	t.Subject = ""
+	t.FirstDate = time.Time{}
+	t.LastDate = time.Time{}
+	t.Unread = false
+	labels := make(map[string]bool)
+	participants := make(map[string]bool)
+	for _, m := range t.Messages {
+		for _, label := range m.LabelIds {
+			labels[label] = true
+			if label == "UNREAD" {
+				t.Unread = true
+			}
+		}
+		for _, p := range addresses(m.From, m.To, m.Cc) {
+			participants[p] = true
+		}
+	}
+	t.Account = ""
+	if len(t.Messages) > 0 {
+		t.Account = t.Messages[0].Account
+		if t.Account == "" {
+			t.Account = DefaultAccount
+		}
+		t.Subject = t.Messages[0].Subject
+		t.FirstDate = t.Messages[0].Date
+		t.LastDate = t.Messages[len(t.Messages)-1].Date
+	}
+	t.LabelIds = sortedSet(labels)
+	t.Participants = sortedSet(participants)
+}
+
+// addresses returns the lowercased email addresses in address headers, or the header itself
+// if it can't be parsed.
+func addresses(headers ...string) []string {
+	var result []string
+	for _, header := range headers {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		list, err := mail.ParseAddressList(header)
+		if err != nil {
+			result = append(result, strings.ToLower(strings.TrimSpace(header)))
+			continue
+		}
+		for _, address := range list {
+			result = append(result, strings.ToLower(address.Address))
+		}
+	}
+	return result
+}
+
+func sortedSet(set map[string]bool) []string {
+	result := make([]string, 0, len(set))
+	for k := range set {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// updateThread reads, modifies and writes back a thread, retrying if it was changed in between.
+func (s *Service) updateThread(threadId string, update func(*Thread)) error {
+	var err error
+	for attempt := 1; attempt <= threadUpdateAttempts; attempt++ {
+		thread, version, found, getErr := s.getThread(threadId)
+		if getErr != nil {
+			return getErr
+		}
+		update(&thread)
+		threadJson, _ := json.Marshal(thread)
+		request := s.Client.Index().
+			Index(ThreadsIndex).
+			Type("document").
+			Id(threadId).
+			BodyJson(string(threadJson))
+		if found {
+			request = request.Version(version)
+		} else {
+			request = request.OpType("create")
+		}
+		_, err = request.Do(s.Ctx)
+		if !elastic.IsConflict(err) {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to update thread %s, err: %v", threadId, err)
+	}
+	return err
+}
+
+func (s *Service) getThread(threadId string) (Thread, int64, bool, error) {
+	thread := Thread{Id: threadId}
+	doc, err := s.Client.Get().Index(ThreadsIndex).Type("document").Id(threadId).Do(s.Ctx)
+	if elastic.IsNotFound(err) {
+		return thread, 0, false, nil
+	}
+	if err != nil {
+		return thread, 0, false, err
+	}
+	if err := json.Unmarshal(*doc.Source, &thread); err != nil {
+		return thread, 0, false, err
+	}
+	return thread, *doc.Version, true, nil
+}
+
+// AddToThread updates the summary of the message's conversation (see Message.Conversation) for a
+// saved message. Tombstoned messages are left out of their conversation.
+func (s *Service) AddToThread(message Message) error {
+	if message.Conversation() == "" || message.DeletedAt != nil {
+		return nil
+	}
+	return s.updateThread(message.Conversation(), func(t *Thread) {
+		t.AddMessage(threadMessage(message))
+	})
+}
+
+func (s *Service) RemoveFromThread(threadId, messageId string) error {
+	if threadId == "" {
+		return nil
+	}
+	return s.updateThread(threadId, func(t *Thread) {
+		t.RemoveMessage(messageId)
+	})
+}
+
+// GetThreads returns the most recently active threads, optionally only those in an account or
+// with a label. Threads saved before they had an account are in DefaultAccount.
+func (s *Service) GetThreads(account, labelId string, size int) ([]*Thread, error) {
+	query := elastic.NewBoolQuery()
+	if account != "" {
+		query = query.Filter(accountQuery(account))
+	}
+	if labelId != "" {
+		query = query.Filter(elastic.NewTermQuery("LabelIds.keyword", labelId))
+	}
+	result, err := s.Client.Search().
+		Index(ThreadsIndex).
+		Query(query).
+		SortBy(elastic.NewFieldSort("LastDate").Desc().UnmappedType("date")).
+		Size(size).
+		Do(s.Ctx)
+	if err != nil {
+		log.Println("Couldn't search threads: ", err)
+		return nil, err
+	}
+	var threads []*Thread
+	var threadForReflect Thread
+	for _, t := range result.Each(reflect.TypeOf(threadForReflect)) {
+		thread := t.(Thread)
+		threads = append(threads, &thread)
+	}
+	return threads, nil
+}
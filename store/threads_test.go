@@ -0,0 +1,82 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestThread_AddMessage(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2018, 12, d, 0, 0, 0, 0, time.UTC)
+	}
+	thread := Thread{Id: "t1"}
+	thread.AddMessage(ThreadMessage{
+		Id:       "2",
+		Date:     day(2),
+		Subject:  "Re: Lunch",
+		From:     "Bob <BOB@example.com>",
+		To:       "alice@example.com",
+		LabelIds: []string{"INBOX", "UNREAD"},
+	})
+	thread.AddMessage(ThreadMessage{
+		Id:       "1",
+		Date:     day(1),
+		Subject:  "Lunch",
+		From:     "alice@example.com",
+		To:       "bob@example.com, \"Carol\" <carol@example.com>",
+		LabelIds: []string{"SENT"},
+	})
+
+	if thread.Account != DefaultAccount {
+		t.Errorf("Account = %q, want %q for messages saved without one", thread.Account, DefaultAccount)
+	}
+	if thread.Subject != "Lunch" {
+		t.Errorf("Expected subject of first message, got %v", thread.Subject)
+	}
+	if thread.MessageCount != 2 || !thread.FirstDate.Equal(day(1)) || !thread.LastDate.Equal(day(2)) {
+		t.Errorf("Unexpected count or dates: %+v", thread)
+	}
+	if !thread.Unread {
+		t.Errorf("Expected thread to be unread")
+	}
+	if want := []string{"INBOX", "SENT", "UNREAD"}; !reflect.DeepEqual(thread.LabelIds, want) {
+		t.Errorf("LabelIds = %v, want %v", thread.LabelIds, want)
+	}
+	if want := []string{"alice@example.com", "bob@example.com", "carol@example.com"}; !reflect.DeepEqual(thread.Participants, want) {
+		t.Errorf("Participants = %v, want %v", thread.Participants, want)
+	}
+
+	// Reading the reply replaces it rather than adding it again
+	thread.AddMessage(ThreadMessage{Id: "2", Date: day(2), LabelIds: []string{"INBOX"}})
+	if thread.MessageCount != 2 || thread.Unread {
+		t.Errorf("Expected 2 read messages, got %+v", thread)
+	}
+
+	thread.RemoveMessage("1")
+	if thread.MessageCount != 1 || !thread.FirstDate.Equal(day(2)) {
+		t.Errorf("Expected only the reply to be left, got %+v", thread)
+	}
+
+	thread.AddMessage(ThreadMessage{Id: "3", Account: "work", Date: day(1)})
+	if thread.Account != "work" {
+		t.Errorf("Account = %q, want the first message's, work", thread.Account)
+	}
+}
+
+func TestMessage_Conversation(t *testing.T) {
+	tests := []struct {
+		message Message
+		want    string
+	}{
+		{Message{ThreadId: "16a", ConversationId: "9f3"}, "9f3"},
+		// Saved before there were conversation ids
+		{Message{ThreadId: "16a"}, "16a"},
+		{Message{}, ""},
+	}
+	for _, test := range tests {
+		if got := test.message.Conversation(); got != test.want {
+			t.Errorf("Conversation() of %+v = %q, want %q", test.message, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+// Package threading groups messages into conversations from their Message-ID, In-Reply-To and
+// References headers, falling back to their subjects when the references are missing, using
+// the algorithm from https://www.jwz.org/doc/threading.html. It's for messages from sources that
+// don't thread them, and for joining Gmail threads that Gmail split (e.g. when the subject
+// changed); messages in the same Gmail thread are always kept together.
+package threading
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Replies are only joined to a conversation by subject if they're sent within this long of its
+// start, so that a "Re: Lunch" isn't filed with a "Lunch" from years before.
+const subjectWindow = 60 * 24 * time.Hour
+
+// Message is the part of a message needed to thread it.
+type Message struct {
+	// The id the message is stored with
+	Id string
+	// The Message-ID header, without the angle brackets; "" if it doesn't have one
+	MessageId string
+	// The Message-IDs of the messages it replies to, oldest first, from References and
+	// In-Reply-To
+	References []string
+	Subject    string
+	Date       time.Time
+	// The Gmail thread the message is in, if it came from Gmail
+	ThreadId string
+}
+
+// NewMessage gets what's needed to thread a message from its headers, which get returns by name.
+func NewMessage(id string, get func(name string) string, date time.Time) Message {
+	var messageId string
+	if ids := ParseIds(get("Message-Id")); len(ids) > 0 {
+		messageId = ids[0]
+	}
+	var references []string
+	seen := map[string]bool{messageId: true}
+	for _, ref := range ParseIds(get("References")) {
+		if !seen[ref] {
+			seen[ref] = true
+			references = append(references, ref)
+		}
+	}
+	// In-Reply-To is the parent, which References should end with but sometimes doesn't.
+	if inReplyTo := ParseIds(get("In-Reply-To")); len(inReplyTo) > 0 && !seen[inReplyTo[0]] {
+		references = append(references, inReplyTo[0])
+	}
+	return Message{Id: id, MessageId: messageId, References: references, Subject: get("Subject"), Date: date}
+}
+
+var msgId = regexp.MustCompile(`<([^<>\s]+)>`)
+
+// ParseIds returns the message ids in a Message-ID, In-Reply-To or References header. Ids are
+// meant to be in angle brackets, but if there are none, anything with an @ in it will do.
+func ParseIds(header string) []string {
+	var ids []string
+	for _, match := range msgId.FindAllStringSubmatch(header, -1) {
+		ids = append(ids, match[1])
+	}
+	if len(ids) > 0 {
+		return ids
+	}
+	for _, field := range strings.Fields(header) {
+		if strings.Contains(field, "@") {
+			ids = append(ids, strings.Trim(field, "<>,;\"'()"))
+		}
+	}
+	return ids
+}
+
+// key is what a message's container is found by. Messages without a Message-ID are only ever
+// in a conversation of their own, unless their subject joins them to one.
+func (m Message) key() string {
+	if m.MessageId == "" {
+		return "id:" + m.Id
+	}
+	return m.MessageId
+}
+
+// ConversationId returns the conversation id of a message on its own, before it's threaded
+// with the rest of the account: that of the oldest message it refers to, or its own. It's the
+// same as Thread gives it unless the references are broken or it's joined by subject.
+func ConversationId(account string, m Message) string {
+	if len(m.References) > 0 {
+		return conversationId(account, m.References[0])
+	}
+	return conversationId(account, m.key())
+}
+
+// conversationId makes the id of the conversation that starts with root (a message id, which
+// needn't be one that was saved). The same root in different accounts is a different
+// conversation.
+func conversationId(account, root string) string {
+	sum := sha256.Sum256([]byte(account + "\x00" + root))
+	return hex.EncodeToString(sum[:8])
+}
+
+type container struct {
+	key      string
+	message  *Message
+	parent   *container
+	children []*container
+}
+
+func (c *container) root() *container {
+	for c.parent != nil {
+		c = c.parent
+	}
+	return c
+}
+
+// isAncestorOf reports whether c is above descendant in its tree, or is descendant itself.
+func (c *container) isAncestorOf(descendant *container) bool {
+	for d := descendant; d != nil; d = d.parent {
+		if d == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *container) setParent(parent *container) {
+	if c.parent != nil {
+		siblings := c.parent.children[:0]
+		for _, sibling := range c.parent.children {
+			if sibling != c {
+				siblings = append(siblings, sibling)
+			}
+		}
+		c.parent.children = siblings
+	}
+	c.parent = parent
+	if parent != nil {
+		parent.children = append(parent.children, c)
+	}
+}
+
+// first returns the earliest message in the tree under c.
+func (c *container) first() *Message {
+	first := c.message
+	for _, child := range c.children {
+		if m := child.first(); m != nil && (first == nil || m.Date.Before(first.Date)) {
+			first = m
+		}
+	}
+	return first
+}
+
+// Thread groups the messages of an account into conversations, and returns the conversation id
+// of each message by its Id. The conversation id of a message depends only on the messages it's
+// threaded with, not the order they're in. Messages in the same Gmail thread are in the same
+// conversation, and a conversation with Gmail threads in it has the id of the earliest one.
+func Thread(account string, messages []Message) map[string]string {
+	containers := make(map[string]*container)
+	get := func(key string) *container {
+		c, ok := containers[key]
+		if !ok {
+			c = &container{key: key}
+			containers[key] = c
+		}
+		return c
+	}
+	// Sorting makes the result the same whatever order messages come in, since the first
+	// reference to a parent wins.
+	sorted := make([]*Message, len(messages))
+	for i := range messages {
+		sorted[i] = &messages[i]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].Date.Equal(sorted[j].Date) {
+			return sorted[i].Date.Before(sorted[j].Date)
+		}
+		return sorted[i].Id < sorted[j].Id
+	})
+
+	var threaded []*container
+	for _, m := range sorted {
+		c := get(m.key())
+		if c.message != nil {
+			// The same Message-ID again (e.g. a copy in another folder): keep it next to the first
+			c = get("id:" + m.Id)
+			if c.parent == nil && !c.isAncestorOf(containers[m.key()]) {
+				c.setParent(containers[m.key()])
+			}
+		}
+		c.message = m
+		threaded = append(threaded, c)
+
+		// Link the references together, oldest first, without undoing links that were already made
+		var parent *container
+		for _, ref := range m.References {
+			r := get(ref)
+			if parent != nil && r.parent == nil && !r.isAncestorOf(parent) {
+				r.setParent(parent)
+			}
+			parent = r
+		}
+		// The message's own parent is always its last reference
+		if parent != nil && !c.isAncestorOf(parent) && c.parent != parent {
+			c.setParent(parent)
+		}
+	}
+
+	joinBySubject(roots(threaded))
+
+	// Join the trees with messages in the same Gmail thread, and find the earliest Gmail thread
+	// in each (threaded is oldest first)
+	group := make(map[*container]*container)
+	var find func(root *container) *container
+	find = func(root *container) *container {
+		if g, ok := group[root]; ok && g != root {
+			g = find(g)
+			group[root] = g
+			return g
+		}
+		return root
+	}
+	gmailThreads := make(map[string]*container)
+	for _, c := range threaded {
+		if c.message.ThreadId == "" {
+			continue
+		}
+		root := find(c.root())
+		if other, ok := gmailThreads[c.message.ThreadId]; ok {
+			if other := find(other); other != root {
+				group[root] = other
+			}
+			continue
+		}
+		gmailThreads[c.message.ThreadId] = root
+	}
+	gmailThread := make(map[*container]string)
+	for _, c := range threaded {
+		if root := find(c.root()); c.message.ThreadId != "" && gmailThread[root] == "" {
+			gmailThread[root] = c.message.ThreadId
+		}
+	}
+
+	result := make(map[string]string, len(threaded))
+	for _, c := range threaded {
+		root := find(c.root())
+		if threadId := gmailThread[root]; threadId != "" {
+			result[c.message.Id] = threadId
+		} else {
+			result[c.message.Id] = conversationId(account, root.key)
+		}
+	}
+	return result
+}
+
+// roots returns the root of the tree every container is in, each once, oldest first.
+func roots(containers []*container) []*container {
+	seen := make(map[*container]bool)
+	var result []*container
+	for _, c := range containers {
+		if root := c.root(); !seen[root] {
+			seen[root] = true
+			result = append(result, root)
+		}
+	}
+	return result
+}
+
+// joinBySubject joins conversations that start with a reply (whose parent was never seen) to
+// the conversation with the same subject, preferring one that starts with the original
+// message. Conversations that don't start with a reply are never joined, since unrelated
+// messages often have the same subject.
+func joinBySubject(roots []*container) {
+	type start struct {
+		root    *container
+		first   *Message
+		subject string
+		reply   bool
+	}
+	var starts []start
+	bySubject := make(map[string]*start)
+	for _, root := range roots {
+		first := root.first()
+		subject, reply := baseSubject(first.Subject)
+		if subject == "" {
+			continue
+		}
+		starts = append(starts, start{root: root, first: first, subject: subject, reply: reply})
+	}
+	// The conversation each subject is joined to: the earliest original, or else the earliest reply
+	for i := range starts {
+		s := &starts[i]
+		if best, ok := bySubject[s.subject]; !ok || best.reply && !s.reply {
+			bySubject[s.subject] = s
+		}
+	}
+	for _, s := range starts {
+		best := bySubject[s.subject]
+		if !s.reply || best.root == s.root {
+			continue
+		}
+		if gap := s.first.Date.Sub(best.first.Date); gap < 0 || gap > subjectWindow {
+			continue
+		}
+		s.root.setParent(best.root)
+	}
+}
+
+var replyPrefix = regexp.MustCompile(`(?i)^\s*(re|fwd?|aw|sv|vs)(\[\d+\])?\s*:\s*`)
+
+// baseSubject removes any "Re:" and "Fwd:" prefixes (and the like) from a subject, and reports
+// whether there were any.
+func baseSubject(subject string) (string, bool) {
+	reply := false
+	for {
+		location := replyPrefix.FindStringIndex(subject)
+		if location == nil {
+			break
+		}
+		subject = subject[location[1]:]
+		reply = true
+	}
+	return strings.ToLower(strings.Join(strings.Fields(subject), " ")), reply
+}
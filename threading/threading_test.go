@@ -0,0 +1,221 @@
+package threading
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func day(d int) time.Time {
+	return time.Date(2019, 3, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestNewMessage(t *testing.T) {
+	headers := map[string]string{
+		"Message-Id":  "<c@example.com>",
+		"References":  "<a@example.com>\r\n <b@example.com> <a@example.com>",
+		"In-Reply-To": "<x@example.com> (Amy's message of Monday)",
+		"Subject":     "Re: Lunch",
+	}
+	got := NewMessage("3", func(name string) string { return headers[name] }, day(3))
+	want := Message{
+		Id:         "3",
+		MessageId:  "c@example.com",
+		References: []string{"a@example.com", "b@example.com", "x@example.com"},
+		Subject:    "Re: Lunch",
+		Date:       day(3),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewMessage = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseIds(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", nil},
+		{"<a@example.com>", []string{"a@example.com"}},
+		{"<a@example.com> <b@example.com>", []string{"a@example.com", "b@example.com"}},
+		{"a@example.com", []string{"a@example.com"}},
+		{"Amy's message of Monday", nil},
+	}
+	for _, test := range tests {
+		if got := ParseIds(test.header); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseIds(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestThread(t *testing.T) {
+	message := func(id string, d int, subject, messageId string, references ...string) Message {
+		return Message{Id: id, MessageId: messageId, References: references, Subject: subject, Date: day(d)}
+	}
+	tests := []struct {
+		name     string
+		messages []Message
+		// Messages with the same letter should be in the same conversation
+		want map[string]string
+	}{
+		{
+			"references",
+			[]Message{
+				message("1", 1, "Lunch", "1@x"),
+				message("2", 2, "Re: Lunch", "2@x", "1@x"),
+				message("3", 3, "Re: Lunch", "3@x", "1@x", "2@x"),
+				message("4", 4, "Lunch", "4@x"),
+			},
+			map[string]string{"1": "a", "2": "a", "3": "a", "4": "b"},
+		},
+		{
+			"missing parent",
+			[]Message{
+				message("2", 2, "Re: Plans", "2@x", "1@x"),
+				message("3", 3, "Something else", "3@x", "1@x", "2@x"),
+			},
+			map[string]string{"2": "a", "3": "a"},
+		},
+		{
+			"broken references",
+			[]Message{
+				message("1", 1, "Lunch", "1@x"),
+				message("2", 2, "Re: Lunch", "2@x", "1@x"),
+				// Only refers to its parent
+				message("3", 3, "Re: Lunch", "3@x", "2@x"),
+			},
+			map[string]string{"1": "a", "2": "a", "3": "a"},
+		},
+		{
+			"subject",
+			[]Message{
+				message("1", 1, "Lunch", "1@x"),
+				message("2", 2, "RE: Re: lunch", "2@x"),
+				message("3", 3, "Fwd: Lunch", ""),
+				message("4", 4, "Lunch", "4@x"),
+				message("5", 5, "Re: Dinner", "5@x"),
+				message("6", 6, "Re: Dinner", "6@x"),
+				message("7", 7, "Re:", "7@x"),
+				message("8", 8, "Re:", "8@x"),
+			},
+			map[string]string{"1": "a", "2": "a", "3": "a", "4": "b", "5": "c", "6": "c", "7": "d", "8": "e"},
+		},
+		{
+			"subject too late",
+			[]Message{
+				message("1", 1, "Lunch", "1@x"),
+				message("2", 1+61, "Re: Lunch", "2@x"),
+			},
+			map[string]string{"1": "a", "2": "b"},
+		},
+		{
+			"loop",
+			[]Message{
+				message("1", 1, "Lunch", "1@x", "2@x"),
+				message("2", 2, "Re: Lunch", "2@x", "1@x"),
+			},
+			map[string]string{"1": "a", "2": "a"},
+		},
+		{
+			"same Message-ID",
+			[]Message{
+				message("1", 1, "Lunch", "1@x"),
+				message("1-copy", 1, "Lunch", "1@x"),
+				message("2", 2, "Something else", "2@x", "1@x"),
+			},
+			map[string]string{"1": "a", "1-copy": "a", "2": "a"},
+		},
+	}
+	for _, test := range tests {
+		got := Thread("amy", test.messages)
+		reversed := make([]Message, len(test.messages))
+		for i, m := range test.messages {
+			reversed[len(reversed)-1-i] = m
+		}
+		if again := Thread("amy", reversed); !reflect.DeepEqual(got, again) {
+			t.Errorf("%v: conversations depend on the order of the messages: %v and %v", test.name, got, again)
+		}
+		conversations := make(map[string]string)
+		for id, letter := range test.want {
+			conversation, ok := got[id]
+			if !ok {
+				t.Errorf("%v: message %v wasn't threaded", test.name, id)
+				continue
+			}
+			if other, ok := conversations[letter]; ok && other != conversation {
+				t.Errorf("%v: message %v should be in the same conversation as the others with %q", test.name, id, letter)
+			}
+			conversations[letter] = conversation
+		}
+		if len(conversations) != len(uniq(got)) {
+			t.Errorf("%v: got %d conversations, want %d", test.name, len(uniq(got)), len(conversations))
+		}
+	}
+}
+
+func uniq(conversations map[string]string) map[string]bool {
+	set := make(map[string]bool)
+	for _, conversation := range conversations {
+		set[conversation] = true
+	}
+	return set
+}
+
+func TestConversationId(t *testing.T) {
+	original := Message{Id: "1", MessageId: "1@x", Date: day(1)}
+	reply := Message{Id: "2", MessageId: "2@x", References: []string{"1@x"}, Date: day(2)}
+	threaded := Thread("amy", []Message{original, reply})
+	for _, m := range []Message{original, reply} {
+		if got := ConversationId("amy", m); got != threaded[m.Id] {
+			t.Errorf("ConversationId(%v) = %v, but Thread gave it %v", m.Id, got, threaded[m.Id])
+		}
+	}
+	if ConversationId("amy", original) == ConversationId("bob", original) {
+		t.Errorf("Expected different conversations in different accounts")
+	}
+}
+
+func TestThread_gmailThreads(t *testing.T) {
+	message := func(id string, d int, threadId, subject, messageId string, references ...string) Message {
+		return Message{Id: id, MessageId: messageId, References: references, Subject: subject, Date: day(d), ThreadId: threadId}
+	}
+	tests := []struct {
+		name     string
+		messages []Message
+		want     map[string]string
+	}{
+		{
+			"kept as they are",
+			[]Message{
+				message("1", 1, "t1", "Lunch", "1@x"),
+				message("2", 2, "t1", "Lunch?", "2@x"),
+				message("3", 3, "t3", "Dinner", "3@x"),
+			},
+			map[string]string{"1": "t1", "2": "t1", "3": "t3"},
+		},
+		{
+			"split by Gmail",
+			[]Message{
+				message("1", 1, "t1", "Lunch", "1@x"),
+				message("2", 2, "t2", "Lunch on Friday instead", "2@x", "1@x"),
+				message("3", 3, "t2", "Re: Lunch on Friday instead", "3@x", "1@x", "2@x"),
+			},
+			map[string]string{"1": "t1", "2": "t1", "3": "t1"},
+		},
+		{
+			"imported reply",
+			[]Message{
+				message("1", 1, "t1", "Lunch", "1@x"),
+				message("2", 2, "", "Re: Lunch", "2@x", "1@x"),
+				message("3", 3, "", "Dinner", "3@x"),
+			},
+			map[string]string{"1": "t1", "2": "t1", "3": conversationId("amy", "3@x")},
+		},
+	}
+	for _, test := range tests {
+		got := Thread("amy", test.messages)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: Thread() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
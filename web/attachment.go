@@ -0,0 +1,43 @@
+package web
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/oaktown/calliope/blob"
+	"github.com/oaktown/calliope/misc"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+func AttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	index, _ := strconv.Atoi(vars["index"])
+	message, err := misc.GetStoreClient().GetMessage(vars["id"])
+	if err != nil || index >= len(message.Attachments) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	attachment := message.Attachments[index]
+	dir := misc.AttachmentsDir()
+	if dir == "" || attachment.Sha256 == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f, err := (&blob.Store{Dir: dir}).Open(attachment.Sha256)
+	if err != nil {
+		log.Printf("Unable to open attachment %v of message %v: %v\n", index, message.Id, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", attachment.MimeType)
+	// Filenames can have quotes, backslashes and non-ASCII characters, which FormatMediaType escapes
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	http.ServeContent(w, r, attachment.Filename, info.ModTime(), f)
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/oaktown/calliope/report"
 	"html/template"
 	"log"
+	"mime"
 	"net/http"
 )
 
@@ -19,6 +20,20 @@ func MessageHandler(w http.ResponseWriter, r *http.Request) {
 	showMessage(id, w, r)
 }
 
+// RawMessageHandler downloads the original source of a message, if it was archived.
+func RawMessageHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	raw, err := misc.GetStoreClient().GetRawMessage(id)
+	if err != nil {
+		log.Printf("Unable to get raw message %v: %v\n", id, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": id + ".eml"}))
+	w.Write(raw)
+}
+
 func showMessage(id string, w http.ResponseWriter, _ *http.Request) {
 	store := misc.GetStoreClient()
 	message, err := store.GetMessage(id)
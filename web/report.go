@@ -35,7 +35,7 @@ func ReportHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	label := r.FormValue("label")
 
-	messageSearch := svc.NewStructuredMessageSearch().Label(label).Size(size)
+	messageSearch := svc.NewStructuredMessageSearch().Account(r.FormValue("account")).Label(label).Size(size)
 	RenderReport(w, messageSearch, inboxUrl)
 }
 
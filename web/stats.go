@@ -2,6 +2,7 @@ package web
 
 import (
 	"github.com/oaktown/calliope/misc"
+	"github.com/oaktown/calliope/store"
 	"html/template"
 	"log"
 	"net/http"
@@ -13,15 +14,22 @@ type Stats struct {
 	Earliest    time.Time
 	Latest      time.Time
 	TotalEmails int64
+	Syncs       []store.SyncStatus
 }
 
 func StatsHandler(w http.ResponseWriter, r *http.Request) {
-	stats, _ := misc.GetStoreClient().GetStats()
+	s := misc.GetStoreClient()
+	stats, _ := s.GetStats()
+	syncs, err := s.GetSyncStatuses()
+	if err != nil {
+		log.Println("Error getting sync statuses: ", err)
+	}
 	data := Stats{
 		Title:       "server stats",
 		Earliest:    stats.Earliest,
 		Latest:      stats.Latest,
 		TotalEmails: stats.Total,
+		Syncs:       syncs,
 	}
 
 	t := template.Must(template.ParseFiles("templates/layout.html", "templates/stats.html"))